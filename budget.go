@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Budget limits the LLM usage and the time of a job or a task, limits that are zero are not enforced.
+type Budget struct {
+	PromptTokens int      `json:"promptTokens,omitempty" yaml:"promptTokens"`
+	EvalTokens   int      `json:"evalTokens,omitempty" yaml:"evalTokens"`
+	Time         Duration `json:"time,omitempty" yaml:"time"`
+	//estimated cost of the LLM invocations, priced with the price table of the pipeline
+	Cost float64 `json:"cost,omitempty" yaml:"cost"`
+}
+
+// ModelPrice is the price of a million prompt and eval tokens of a model.
+type ModelPrice struct {
+	Prompt float64 `json:"prompt" yaml:"prompt"`
+	Eval   float64 `json:"eval" yaml:"eval"`
+}
+
+// PriceTable holds the prices by model name, models without an entry use the price of "default".
+type PriceTable map[string]ModelPrice
+
+// cost estimates the cost of the tokens of an invocation of the model.
+func (t PriceTable) cost(model string, metrics Metrics) float64 {
+	price, ok := t[model]
+	if !ok {
+		price = t["default"]
+	}
+	return (float64(metrics.ConversionPromptTokenCount)*price.Prompt + float64(metrics.ConversionEvalTokenCount)*price.Eval) / 1e6
+}
+
+// BudgetError stops a job that used up its budget or the budget of a task, it is never retried.
+type BudgetError struct {
+	error
+}
+
+func (e BudgetError) Error() string {
+	return e.error.Error()
+}
+
+func isBudgetError(err error) bool {
+	var budgetErr BudgetError
+	return errors.As(err, &budgetErr)
+}
+
+// budgetUsage is what a job used up to some point.
+type budgetUsage struct {
+	PromptTokens int
+	EvalTokens   int
+	Cost         float64
+	//time the job ran, the time it was paused or waited for a restart does not count
+	Time time.Duration
+}
+
+// exceeded describes the first limit of the budget the usage reached, it is empty if none is.
+func (b *Budget) exceeded(used budgetUsage, elapsed time.Duration) string {
+	switch {
+	case b == nil:
+		return ""
+	case b.PromptTokens > 0 && used.PromptTokens >= b.PromptTokens:
+		return fmt.Sprintf("%d of %d prompt tokens", used.PromptTokens, b.PromptTokens)
+	case b.EvalTokens > 0 && used.EvalTokens >= b.EvalTokens:
+		return fmt.Sprintf("%d of %d eval tokens", used.EvalTokens, b.EvalTokens)
+	case b.Cost > 0 && used.Cost >= b.Cost:
+		return fmt.Sprintf("a cost of %.4f of %.4f", used.Cost, b.Cost)
+	case b.Time > 0 && elapsed >= time.Duration(b.Time):
+		return fmt.Sprintf("%s of %s", elapsed.Round(time.Millisecond), b.Time)
+	}
+	return ""
+}
+
+// jobBudget tracks the usage of a job against the budget of the job and the budgets of its tasks. Branches and
+// candidates of the job share it.
+type jobBudget struct {
+	mutex  sync.Mutex
+	budget *Budget
+	prices PriceTable
+	//usage of the job, it continues the metrics of a resumed job, its time is the time of the earlier runs
+	usage budgetUsage
+	//start of this run of the job
+	started time.Time
+	//usage of the job when each task with a budget first started
+	tasks map[*ConversionTask]budgetUsage
+}
+
+func newJobBudget(p *Pipeline, metrics *Metrics) *jobBudget {
+	return &jobBudget{
+		budget: p.Budget,
+		prices: p.Prices,
+		usage: budgetUsage{
+			PromptTokens: metrics.ConversionPromptTokenCount,
+			EvalTokens:   metrics.ConversionEvalTokenCount,
+			Cost:         metrics.Cost,
+			Time:         metrics.ActiveTime,
+		},
+		started: time.Now(),
+		tasks:   make(map[*ConversionTask]budgetUsage),
+	}
+}
+
+// elapsed is the time the job ran, in this and earlier runs.
+func (b *jobBudget) elapsed() time.Duration {
+	return b.usage.Time + time.Since(b.started)
+}
+
+// charge adds the tokens of an LLM invocation to the usage and returns their estimated cost.
+func (b *jobBudget) charge(model string, metrics Metrics) float64 {
+	if b == nil {
+		return 0
+	}
+	cost := b.prices.cost(model, metrics)
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.usage.PromptTokens += metrics.ConversionPromptTokenCount
+	b.usage.EvalTokens += metrics.ConversionEvalTokenCount
+	b.usage.Cost += cost
+	return cost
+}
+
+// check fails once the job or the task used up its budget, a nil task only checks the budget of the job. The usage
+// of a task includes its recovery tasks and starts with its first attempt.
+func (b *jobBudget) check(task *ConversionTask) error {
+	if b == nil {
+		return nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	elapsed := b.elapsed()
+	if exceeded := b.budget.exceeded(b.usage, elapsed); exceeded != "" {
+		return BudgetError{fmt.Errorf("budget exceeded: job used %s", exceeded)}
+	}
+	if task == nil || task.Budget == nil {
+		return nil
+	}
+	start, ok := b.tasks[task]
+	if !ok {
+		start = b.usage
+		start.Time = elapsed
+		b.tasks[task] = start
+	}
+	used := budgetUsage{
+		PromptTokens: b.usage.PromptTokens - start.PromptTokens,
+		EvalTokens:   b.usage.EvalTokens - start.EvalTokens,
+		Cost:         b.usage.Cost - start.Cost,
+	}
+	if exceeded := task.Budget.exceeded(used, elapsed-start.Time); exceeded != "" {
+		return BudgetError{fmt.Errorf("budget exceeded: task %s used %s", task.ID, exceeded)}
+	}
+	return nil
+}
+
+// exceedBudget marks the job as stopped by the budget error.
+func (req *ConversionRequest) exceedBudget(err error) error {
+	log.Errorf("job %s stopped - %v", req.Id, err)
+	req.Metrics.BudgetExceeded = err.Error()
+	return err
+}
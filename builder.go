@@ -16,6 +16,9 @@ import (
 //go:embed test_handler.txt
 var goTestHandler string
 
+// processWaitDelay bounds how long a killed build or test process may keep its output open.
+const processWaitDelay = 5 * time.Second
+
 type GolangBuilder struct {
 	TestHandler string
 }
@@ -47,8 +50,9 @@ func (cc *GolangBuilder) Apply(runner *PipelineRunner, request *ConversionReques
 	code := request.WorkingPackage
 	code.BuildFiles["handler.go"] = string(cc.TestHandler)
 	//Build testable version
-	err = cc.build(request, dir)
+	err = cc.build(runner, request, dir)
 
+	request.span.recordBuild(time.Since(start), err != nil)
 	if err != nil {
 		request.Metrics.BuildError += 1
 		log.Debugf("failed to build: %s", err.Error())
@@ -60,10 +64,10 @@ func (cc *GolangBuilder) Apply(runner *PipelineRunner, request *ConversionReques
 	return nil
 }
 
-func (cc *GolangBuilder) build(requests *ConversionRequest, dir string) error {
+func (cc *GolangBuilder) build(ctx context.Context, requests *ConversionRequest, dir string) error {
 	code := requests.WorkingPackage
 
-	_, err := cc.doBuild(code, dir)
+	_, err := cc.doBuild(ctx, code, dir)
 	if err != nil {
 		log.Debugf("failed to build")
 		return err
@@ -72,13 +76,12 @@ func (cc *GolangBuilder) build(requests *ConversionRequest, dir string) error {
 	return nil
 }
 
-func (cc *GolangBuilder) doBuild(code *DeploymentPackage, dir string) (string, error) {
+func (cc *GolangBuilder) doBuild(ctx context.Context, code *DeploymentPackage, dir string) (string, error) {
 	err := cc.prepareBuildFolder(dir, code)
 	if err != nil {
 		log.Debugf("failed to prepare build folder: %s", err.Error())
 		return "", err
 	}
-	ctx := context.Background()
 	for _, cmd := range code.BuildCmd {
 		out, err := cc.runBuildCommands(ctx, dir, cmd)
 		if err != nil {
@@ -141,6 +144,7 @@ func (cc *GolangBuilder) runBuildCommands(ctx context.Context, dir, build_cmd st
 
 	cmd := exec.CommandContext(ctx, cmds[0], cmds[1:]...)
 	cmd.Dir = dir
+	killOnCancel(cmd)
 	var stdout bytes.Buffer
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stdout
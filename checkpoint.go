@@ -0,0 +1,387 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Checkpoint is the persisted state of a running job, written before each task of the normal execution flow.
+type Checkpoint struct {
+	Id uuid.UUID `json:"id"`
+	//main flow tasks from root to the task the job resumes at, empty if the job did not start yet
+	Path        []string       `json:"path"`
+	RetryCounts map[string]int `json:"retryCounts"`
+	//failed attempts of each task that were charged to the budget of an error class, see RetryPolicy
+	ClassRetries   map[string]map[ErrorClass]int `json:"classRetries,omitempty"`
+	SourcePackage  *DeploymentPackage            `json:"sourcePackage"`
+	WorkingPackage *DeploymentPackage            `json:"workingPackage"`
+	WorkingDir     string                        `json:"workingDir,omitempty"`
+	Metrics        *Metrics                      `json:"metrics"`
+	Errors         []string                      `json:"errors"`
+	LoopScores     map[string]int                `json:"loopScores,omitempty"`
+	LoopIterations map[string]int                `json:"loopIterations,omitempty"`
+	//time the job ran up to the checkpoint, the metrics only have the time of its earlier runs
+	ActiveTime time.Duration `json:"activeTime,omitempty"`
+	Trace      *Span         `json:"trace,omitempty"`
+	Revisions  []*Revision   `json:"revisions,omitempty"`
+	//pipeline the job was started with, the current pipeline of the service is used if empty
+	Pipeline  *PipelineFile  `json:"pipeline,omitempty"`
+	Overrides map[string]any `json:"overrides,omitempty"`
+	//review task the job is paused at, the job is not resumed before a reviewer decided
+	AwaitingReview string    `json:"awaitingReview,omitempty"`
+	Time           time.Time `json:"time"`
+}
+
+// TaskID returns the task the job resumes at.
+func (cp *Checkpoint) TaskID() string {
+	if len(cp.Path) == 0 {
+		return ""
+	}
+	return cp.Path[len(cp.Path)-1]
+}
+
+func makeCheckpoint(p *Pipeline, runner *PipelineRunner, req *ConversionRequest) *Checkpoint {
+	cp := &Checkpoint{
+		Id:             req.Id,
+		Path:           slices.Clone(req.path),
+		RetryCounts:    make(map[string]int),
+		SourcePackage:  req.SourcePackage,
+		Metrics:        req.Metrics,
+		Errors:         make([]string, 0, len(req.err)),
+		LoopScores:     req.loopScores,
+		LoopIterations: req.loopIterations,
+		Trace:          req.Trace,
+		Revisions:      req.Revisions,
+		Overrides:      req.Overrides,
+		Time:           time.Now(),
+	}
+	if req.WorkingPackage != nil {
+		cp.WorkingPackage = req.WorkingPackage.copy()
+	}
+	for _, err := range req.err {
+		cp.Errors = append(cp.Errors, err.Error())
+	}
+	if p != nil {
+		cp.Pipeline = p.source
+		p.walk(func(task *ConversionTask) {
+			cp.RetryCounts[task.ID] = max(cp.RetryCounts[task.ID], req.attempt(task))
+			if len(req.retries[task]) > 0 {
+				if cp.ClassRetries == nil {
+					cp.ClassRetries = make(map[string]map[ErrorClass]int)
+				}
+				cp.ClassRetries[task.ID] = maps.Clone(req.retries[task])
+			}
+		})
+	}
+	if runner != nil {
+		cp.WorkingDir = runner.WorkingDir
+	}
+	cp.ActiveTime = req.Metrics.ActiveTime
+	if req.budget != nil {
+		cp.ActiveTime = req.budget.elapsed()
+	}
+	return cp
+}
+
+// request restores the conversion request of the checkpoint.
+func (cp *Checkpoint) request() *ConversionRequest {
+	req := &ConversionRequest{
+		Id:             cp.Id,
+		SourcePackage:  cp.SourcePackage,
+		WorkingPackage: cp.WorkingPackage,
+		Metrics:        cp.Metrics,
+		err:            make([]error, 0, len(cp.Errors)),
+		loopScores:     cp.LoopScores,
+		loopIterations: cp.LoopIterations,
+		Trace:          cp.Trace,
+		Revisions:      cp.Revisions,
+		Overrides:      cp.Overrides,
+		checkpoint:     cp,
+	}
+	if req.Metrics == nil {
+		req.Metrics = &Metrics{}
+	}
+	if req.Metrics.TestCases == nil {
+		req.Metrics.TestCases = make(map[string]bool)
+	}
+	if req.Metrics.Loops == nil {
+		req.Metrics.Loops = make(map[string]int)
+	}
+	req.Metrics.ActiveTime = max(req.Metrics.ActiveTime, cp.ActiveTime)
+	if req.loopIterations == nil {
+		//checkpoints of older versions only have the iterations of the whole job
+		req.loopIterations = maps.Clone(req.Metrics.Loops)
+	}
+	req.progress = newJobProgress(req.Metrics)
+	for _, err := range cp.Errors {
+		req.err = append(req.err, errors.New(err))
+	}
+	return req
+}
+
+// CheckpointStore keeps one checkpoint file per unfinished job in a local directory.
+type CheckpointStore struct {
+	dir string
+}
+
+func OpenCheckpointStore(dir string) (*CheckpointStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create checkpoint directory %s: %w", dir, err)
+	}
+	return &CheckpointStore{dir: dir}, nil
+}
+
+func (s *CheckpointStore) file(id uuid.UUID) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s.json", id.String()))
+}
+
+// Save replaces the checkpoint of the job, the file is swapped atomically so a crash never leaves a partial file.
+func (s *CheckpointStore) Save(cp *Checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.dir, "checkpoint")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file(cp.Id))
+}
+
+func (s *CheckpointStore) Load(id uuid.UUID) (*Checkpoint, error) {
+	data, err := os.ReadFile(s.file(id))
+	if err != nil {
+		return nil, err
+	}
+	cp := &Checkpoint{}
+	err = json.Unmarshal(data, cp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint %s: %w", id, err)
+	}
+	return cp, nil
+}
+
+// Remove deletes the checkpoint of a finished job.
+func (s *CheckpointStore) Remove(id uuid.UUID) error {
+	err := os.Remove(s.file(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Unfinished loads the checkpoints of all jobs that did not finish, oldest first.
+func (s *CheckpointStore) Unfinished() ([]*Checkpoint, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	checkpoints := make([]*Checkpoint, 0)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".json")
+		if entry.IsDir() || !ok {
+			continue
+		}
+		id, err := uuid.Parse(name)
+		if err != nil {
+			continue
+		}
+		cp, err := s.Load(id)
+		if err != nil {
+			log.Errorf("skipping checkpoint: %v", err)
+			continue
+		}
+		checkpoints = append(checkpoints, cp)
+	}
+	slices.SortFunc(checkpoints, func(a, b *Checkpoint) int {
+		return a.Time.Compare(b.Time)
+	})
+	return checkpoints, nil
+}
+
+// checkpoint persists the job before the next task of the normal execution flow starts. Recovery tasks, pipeline
+// fragments and concurrent branches are not checkpointed, a resumed job repeats the task they belong to.
+func (p *Pipeline) checkpoint(runner *PipelineRunner, req *ConversionRequest) {
+	if runner.checkpoints == nil || req.nested > 0 {
+		return
+	}
+	err := runner.checkpoints.Save(makeCheckpoint(p, runner, req))
+	if err != nil {
+		log.Errorf("failed to checkpoint job %s: %v", req.Id, err)
+	}
+}
+
+// Resume continues a job at the task recorded in the checkpoint. Afterward, the remaining next tasks of every task on
+// the checkpoint path are executed, as if the job never stopped.
+func (p *Pipeline) Resume(runner *PipelineRunner, req *ConversionRequest, cp *Checkpoint) error {
+	frames, err := p.lookupPath(cp.Path)
+	if err != nil {
+		return err
+	}
+	if len(frames) == 0 {
+		return p.Execute(runner, req)
+	}
+	if cp.WorkingDir != "" {
+		if _, err := os.Stat(cp.WorkingDir); err == nil {
+			runner.WorkingDir = cp.WorkingDir
+		}
+	}
+	log.Infof("resuming job %s at task %s", req.Id, cp.TaskID())
+	return p.run(runner, req, func() error {
+		p.walk(func(task *ConversionTask) {
+			req.attempts[task] = cp.RetryCounts[task.ID]
+			if retries, ok := cp.ClassRetries[task.ID]; ok {
+				req.retries[task] = maps.Clone(retries)
+			}
+		})
+		return p.resumeFrames(runner, req, frames)
+	})
+}
+
+func (p *Pipeline) resumeFrames(runner *PipelineRunner, req *ConversionRequest, frames []*ConversionTask) error {
+	last := len(frames) - 1
+	req.path = taskIDs(frames[:last])
+	err := p.executeNext(runner, req, frames[last])
+	for i := last - 1; i >= 0; i-- {
+		parent, child := frames[i], frames[i+1]
+		req.path = taskIDs(frames[:i])
+		if jump, ok := asLoopJump(err); ok && jump.target == parent.ID {
+			req.resetAttempts(parent)
+			req.restartLoops(parent, jump)
+			err = p.executeNext(runner, req, parent)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		req.path = taskIDs(frames[:i+1])
+		for _, next := range parent.Next[slices.Index(parent.Next, child)+1:] {
+			if err = p.executeNext(runner, req, next); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil && !isControlFlow(err) {
+		req.err = append(req.err, err)
+	}
+	return err
+}
+
+// lookupPath finds the tasks of a checkpoint path, each task must be a next task of the one before.
+func (p *Pipeline) lookupPath(path []string) ([]*ConversionTask, error) {
+	frames := make([]*ConversionTask, 0, len(path))
+	candidates := []*ConversionTask{p.FirstTask}
+	for _, id := range path {
+		index := slices.IndexFunc(candidates, func(task *ConversionTask) bool {
+			return task != nil && task.ID == id
+		})
+		if index == -1 {
+			return nil, fmt.Errorf("checkpoint path %s does not match the pipeline at task %s", strings.Join(path, " -> "), id)
+		}
+		frames = append(frames, candidates[index])
+		candidates = candidates[index].Next
+	}
+	return frames, nil
+}
+
+// pathTo finds the main flow tasks from root to the task with the given id.
+func (p *Pipeline) pathTo(taskID string) ([]string, error) {
+	var find func(task *ConversionTask, path []string) []string
+	find = func(task *ConversionTask, path []string) []string {
+		if task == nil {
+			return nil
+		}
+		path = append(path, task.ID)
+		if task.ID == taskID {
+			return path
+		}
+		for _, next := range task.Next {
+			if found := find(next, path); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+	path := find(p.FirstTask, nil)
+	if path == nil {
+		return nil, fmt.Errorf("task %s is not part of the main flow of the pipeline", taskID)
+	}
+	return slices.Clone(path), nil
+}
+
+// ResumeRecord documents that a job was run again from one of its tasks.
+type ResumeRecord struct {
+	TaskID string    `json:"task"`
+	Time   time.Time `json:"time"`
+	//the job was resumed with another pipeline than the one of the service
+	Pipeline bool `json:"pipeline,omitempty"`
+	//the working package was replaced before the job resumed
+	EditedPackage bool           `json:"edited_package,omitempty"`
+	Overrides     map[string]any `json:"overrides,omitempty"`
+}
+
+// reenter prepares a finished job to run again from the given task, with fresh retry budgets. The history of the
+// job, i.e., errors, metrics, trace and revisions, is continued. The pipeline is the one of the service if its
+// source is unknown.
+func (req *ConversionRequest) reenter(p *Pipeline, taskID string, record ResumeRecord) error {
+	path, err := p.pathTo(taskID)
+	if err != nil {
+		return err
+	}
+	record.TaskID = taskID
+	record.Time = time.Now()
+	record.Overrides = req.Overrides
+	req.Metrics.Resumes = append(req.Metrics.Resumes, record)
+	req.Completed = false
+	req.checkpoint = makeCheckpoint(nil, nil, req)
+	req.checkpoint.Path = path
+	req.checkpoint.Pipeline = p.source
+	return nil
+}
+
+// walk visits every task of the pipeline once.
+func (p *Pipeline) walk(visit func(task *ConversionTask)) {
+	seen := make(map[*ConversionTask]bool)
+	var walk func(task *ConversionTask)
+	walk = func(task *ConversionTask) {
+		if task == nil || seen[task] {
+			return
+		}
+		seen[task] = true
+		visit(task)
+		walk(task.OnFailure)
+		for _, class := range errorClasses {
+			walk(task.OnError[class])
+		}
+		for _, next := range task.Next {
+			walk(next)
+		}
+	}
+	walk(p.FirstTask)
+}
+
+func taskIDs(tasks []*ConversionTask) []string {
+	ids := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	return ids
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runCommand executes a command line mode of the service, e.g., `refaas validate pipeline.yaml`.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "validate":
+		return validateCommand(args[1:])
+	case "dryrun":
+		return dryRunCommand(args[1:])
+	case "resume":
+		return resumeCommand(args[1:])
+	case "serve":
+		return MakeConverterService()
+	}
+	return fmt.Errorf("unknown command '%s', expected one of: dryrun, resume, serve, validate", args[0])
+}
+
+// validateCommand validates the given pipeline files, or the default pipeline if no file is given.
+func validateCommand(files []string) error {
+	if len(files) == 0 {
+		return validatePipelineSource("default.yaml", strings.NewReader(defaultPipelineFile))
+	}
+	failed := 0
+	for _, fname := range files {
+		fileContent, err := LoadPipelineFile(fname)
+		if err == nil {
+			err = validatePipelineFile(fname, fileContent)
+		} else {
+			fmt.Printf("%s: %v\n", fname, err)
+		}
+		if err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d pipeline files are invalid", failed, len(files))
+	}
+	return nil
+}
+
+func validatePipelineSource(name string, file io.Reader) error {
+	fileContent, err := ReadPipelineFile(file)
+	if err != nil {
+		fmt.Printf("%s: %v\n", name, err)
+		return err
+	}
+	return validatePipelineFile(name, fileContent)
+}
+
+func validatePipelineFile(name string, fileContent PipelineFile) error {
+	issues := ValidatePipeline(fileContent)
+	for _, issue := range issues {
+		fmt.Printf("%s: %s\n", name, issue)
+	}
+	if err := issues.Err(); err != nil {
+		return err
+	}
+	fmt.Printf("%s: ok\n", name)
+	return nil
+}
+
+// dryRunCommand runs a pipeline file with the scripted outcomes of each scenario file and prints the task sequence,
+// e.g., `refaas dryrun pipeline.yaml scenarios/*.yaml`. Scenarios with an expectation fail the command if it is not met.
+func dryRunCommand(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: dryrun <pipeline file> <scenario file>...")
+	}
+	fileContent, err := LoadPipelineFile(args[0])
+	if err != nil {
+		return err
+	}
+	pipeline, err := compilePipeline(fileContent)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, fname := range args[1:] {
+		fmt.Printf("# %s\n", fname)
+		scenario, err := LoadScenario(fname)
+		var report *DryRunReport
+		if err == nil {
+			report, err = pipeline.DryRun(scenario)
+		}
+		if err != nil {
+			fmt.Printf("%s: %v\n", fname, err)
+			failed++
+			continue
+		}
+		for _, step := range report.Steps {
+			fmt.Println(step)
+		}
+		if report.Err != nil {
+			fmt.Printf("result: %s - %v\n", report.Result(), report.Err)
+		} else {
+			fmt.Printf("result: %s\n", report.Result())
+		}
+		if err := report.Check(scenario.Expect); err != nil {
+			fmt.Printf("%s: %v\n", fname, err)
+			failed++
+		} else if scenario.Expect != nil {
+			fmt.Printf("%s: ok\n", fname)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d scenarios failed", failed, len(args)-1)
+	}
+	return nil
+}
+
+// resumeCommand asks a running service to run a finished job again from a task, e.g.,
+// `refaas resume -model qwen2.5-coder:32b <uuid> tester`.
+func resumeCommand(args []string) error {
+	flags := flag.NewFlagSet("resume", flag.ContinueOnError)
+	server := flags.String("server", setOrDefault("FAASLLM_SERVER", "http://localhost:8080"), "url of the converter service")
+	pipelineFile := flags.String("pipeline", "", "pipeline file to resume the job with instead of the pipeline of the service")
+	packageFile := flags.String("package", "", "zip with the edited main file of the working package")
+	model := flags.String("model", "", "model to resume the job with")
+	options := flags.String("options", "", "JSON object with pipeline options to override")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: resume [flags] <job uuid> <task id>")
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	fields := map[string]string{"task": flags.Arg(1), "model": *model, "options": *options}
+	if *pipelineFile != "" {
+		fileContent, err := LoadPipelineFile(*pipelineFile)
+		if err != nil {
+			return err
+		}
+		if err := validatePipelineFile(*pipelineFile, fileContent); err != nil {
+			return err
+		}
+		// includes are resolved locally, the service may not have access to the included files
+		pipelineData, err := yaml.Marshal(fileContent)
+		if err != nil {
+			return err
+		}
+		fields["pipeline"] = string(pipelineData)
+	}
+	for key, value := range fields {
+		if value == "" {
+			continue
+		}
+		if err := form.WriteField(key, value); err != nil {
+			return err
+		}
+	}
+	if *packageFile != "" {
+		data, err := os.ReadFile(*packageFile)
+		if err != nil {
+			return err
+		}
+		part, err := form.CreateFormFile("file", filepath.Base(*packageFile))
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/%s/resume", strings.TrimSuffix(*server, "/"), flags.Arg(0))
+	client := http.Client{
+		// the service redirects to the job, which is not finished yet
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Post(url, form.FormDataContentType(), &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("failed to resume job %s: %s %s", flags.Arg(0), resp.Status, strings.TrimSpace(string(message)))
+	}
+	fmt.Printf("%s: resumed at task %s, poll %s\n", flags.Arg(0), flags.Arg(1), resp.Header.Get("Location"))
+	return nil
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"sync"
+	"time"
 )
 
 type PipelineRunner struct {
@@ -15,10 +18,20 @@ type PipelineRunner struct {
 
 	pipeline   *Pipeline
 	WorkingDir string
+	//persists running jobs, disabled if nil
+	checkpoints *CheckpointStore
+	//lifecycle events of all jobs, shared with forked runners
+	events *EventBus
+	//overrides the LLM invocation parameters of the converters, e.g., for sampled candidates
+	llmArgs map[string]any
+	//retries do not wait for their backoff, see Pipeline.DryRun
+	dryRun bool
+	//guards pipeline and client against a reconfiguration while a conversion starts
+	configLock sync.RWMutex
 }
 
 type ConverterOptions struct {
-	Pipeline *PipelineFile `json:"pipeline",omitempty`
+	Pipeline *PipelineFile `json:"pipeline,omitempty"`
 
 	LLMClient string         `json:"LLMClient"`
 	Args      map[string]any `json:"args"`
@@ -46,6 +59,27 @@ var DefaultOptions = ConverterOptions{
 	},
 }
 
+// makeLLMClient creates the LLM client named in the options, behind the response cache if LLM_CACHE_DIR is set.
+func makeLLMClient(ops *ConverterOptions) (LLMInvocationClient, error) {
+	client, err := newLLMClient(ops.LLMClient, ops.Args)
+	if err != nil {
+		return nil, err
+	}
+	if dir, ok := ops.Args["LLM_CACHE_DIR"].(string); ok && dir != "" {
+		return makeCachingClient(client, ops.Args)
+	}
+	return client, nil
+}
+
+// newLLMClient creates the LLM client of the factory with the name.
+func newLLMClient(name string, args map[string]interface{}) (LLMInvocationClient, error) {
+	factory, ok := LLMClientFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown LLM client: %s", name)
+	}
+	return factory(args)
+}
+
 func MakeCodeConverter(ops *ConverterOptions) (*PipelineRunner, error) {
 	if ops == nil {
 		ops = &DefaultOptions
@@ -54,7 +88,7 @@ func MakeCodeConverter(ops *ConverterOptions) (*PipelineRunner, error) {
 	}
 
 	//XXX placeholder
-	api_client, err := LLMClientFactories[ops.LLMClient](ops.Args)
+	api_client, err := makeLLMClient(ops)
 	if err != nil {
 		return nil, err
 	}
@@ -70,29 +104,151 @@ func MakeCodeConverter(ops *ConverterOptions) (*PipelineRunner, error) {
 		Context:  context.Background(),
 		pipeline: pipeline,
 		client:   api_client,
+		events:   NewEventBus(),
 	}, nil
 }
 
+// fork creates a runner for a concurrent branch. It shares the LLM client, which serves the branches in parallel, but
+// uses its own build directory.
+func (cc *PipelineRunner) fork(ctx context.Context) *PipelineRunner {
+	return &PipelineRunner{
+		Context:  ctx,
+		client:   cc.client,
+		pipeline: cc.pipeline,
+		events:   cc.events,
+		llmArgs:  cc.llmArgs,
+		dryRun:   cc.dryRun,
+	}
+}
+
+// execution creates the runner of a single conversion. Conversions share the compiled pipeline and the LLM client,
+// but use their own context and build directory, so they can run concurrently.
+func (cc *PipelineRunner) execution() *PipelineRunner {
+	cc.configLock.RLock()
+	defer cc.configLock.RUnlock()
+	run := cc.fork(cc.Context)
+	run.checkpoints = cc.checkpoints
+	return run
+}
+
+// currentPipeline returns the pipeline new conversions are started with.
+func (cc *PipelineRunner) currentPipeline() *Pipeline {
+	cc.configLock.RLock()
+	defer cc.configLock.RUnlock()
+	return cc.pipeline
+}
+
+// Subscribe registers an observer for the lifecycle events of all jobs of the runner.
+func (cc *PipelineRunner) Subscribe(observer PipelineObserver) (unsubscribe func()) {
+	return cc.events.Subscribe(observer)
+}
+
+func (cc *PipelineRunner) emit(event PipelineEvent) {
+	cc.events.Publish(event)
+}
+
+// join takes over the build directory of a finished branch.
+func (cc *PipelineRunner) join(branch *PipelineRunner) {
+	if branch.WorkingDir == "" || branch.WorkingDir == cc.WorkingDir {
+		return
+	}
+	cc.cleanup()
+	cc.WorkingDir = branch.WorkingDir
+}
+
+// cleanup removes the build directory of the runner.
+func (cc *PipelineRunner) cleanup() {
+	if cc.WorkingDir != "" {
+		_ = os.RemoveAll(cc.WorkingDir)
+		cc.WorkingDir = ""
+	}
+}
+
+// withTimeout runs fn with the runner context limited to the given timeout. If the timeout expires before the
+// surrounding context is done, the failure is reported as TimeoutError.
+func (cc *PipelineRunner) withTimeout(timeout time.Duration, reason string, fn func() error) error {
+	if timeout <= 0 {
+		return fn()
+	}
+	parent := cc.Context
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	cc.Context = ctx
+	defer func() {
+		cancel()
+		cc.Context = parent
+	}()
+
+	err := fn()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && parent.Err() == nil {
+		return TimeoutError{fmt.Errorf("%s timed out after %s - %v", reason, timeout, err)}
+	}
+	return err
+}
+
 func MakeConversionRequest(srcPkg *DeploymentPackage) *ConversionRequest {
 	return &ConversionRequest{
 		Id:            uuid.New(),
 		SourcePackage: srcPkg,
 		Metrics: &Metrics{
 			TestCases: make(map[string]bool),
+			Loops:     make(map[string]int),
 		},
-		err: make([]error, 0),
+		err:      make([]error, 0),
+		progress: &JobProgress{},
 	}
 }
 
+// Convert runs the request through the pipeline, it is safe to call for several requests at once.
 func (cc *PipelineRunner) Convert(req *ConversionRequest) error {
+	run := cc.execution()
+	defer run.cleanup()
+	if req.checkpoint != nil {
+		return run.resume(req)
+	}
+	if run.pipeline == nil {
+		return fmt.Errorf("no pipeline configured")
+	}
+	pipeline, err := run.pipeline.forRequest(req)
+	if err != nil {
+		return err
+	}
 	req.WorkingPackage = req.SourcePackage.copy()
 
-	return cc.pipeline.Execute(cc, req)
+	return pipeline.Execute(run, req)
+}
+
+// resume continues a request restored from a checkpoint, with the pipeline the job was started with.
+func (cc *PipelineRunner) resume(req *ConversionRequest) error {
+	cp := req.checkpoint
+	req.checkpoint = nil
+	pipeline := cc.pipeline
+	if cp.Pipeline != nil {
+		file := *cp.Pipeline
+		file.overrides = req.Overrides
+		var err error
+		pipeline, err = compilePipeline(file)
+		if err != nil {
+			return fmt.Errorf("failed to compile pipeline of checkpoint %s: %w", cp.Id, err)
+		}
+	}
+	if pipeline == nil {
+		return fmt.Errorf("no pipeline to resume %s with", cp.Id)
+	}
+	if cp.Pipeline == nil {
+		var err error
+		if pipeline, err = pipeline.forRequest(req); err != nil {
+			return err
+		}
+	}
+	if req.WorkingPackage == nil {
+		req.WorkingPackage = req.SourcePackage.copy()
+	}
+	return pipeline.Resume(cc, req, cp)
 }
 
 func (cc *PipelineRunner) Reconfigure(ops *ConverterOptions) error {
 	ops.setDefaults()
-	api_client, err := LLMClientFactories[ops.LLMClient](ops.Args)
+	api_client, err := makeLLMClient(ops)
 	if err != nil {
 		return err
 	}
@@ -106,11 +262,8 @@ func (cc *PipelineRunner) Reconfigure(ops *ConverterOptions) error {
 		return err
 	}
 
-	if cc.WorkingDir != "" {
-		defer os.RemoveAll(cc.WorkingDir)
-	}
-
-	cc.WorkingDir = ""
+	cc.configLock.Lock()
+	defer cc.configLock.Unlock()
 	cc.pipeline = pipeline
 	cc.client = api_client
 
@@ -16,9 +16,7 @@ import (
 )
 
 type DeepSeekInvocationClient struct {
-	ModelName      string
-	RequestOptions map[string]interface{}
-	client         *api.Client
+	client *api.Client
 }
 
 func (llm *DeepSeekInvocationClient) Configure(args map[string]interface{}) error {
@@ -37,11 +35,15 @@ func (llm *DeepSeekInvocationClient) Configure(args map[string]interface{}) erro
 	return nil
 }
 
-func (llm *DeepSeekInvocationClient) Prepare(args map[string]interface{}) error {
-	model, ok := args["model_name"]
-	if !ok {
-		log.Fatal("model_name must be a string")
-		return nil
+// requestOptions returns the model and the request options of the invocation in the context.
+func (llm *DeepSeekInvocationClient) requestOptions(ctx context.Context) (string, map[string]interface{}, error) {
+	return deepSeekOptions(invocationOf(ctx).Args)
+}
+
+func deepSeekOptions(args map[string]interface{}) (string, map[string]interface{}, error) {
+	model, ok := args["model_name"].(string)
+	if !ok || model == "" {
+		return "", nil, fmt.Errorf("model_name required")
 	}
 
 	nargs := make(map[string]interface{})
@@ -54,15 +56,12 @@ func (llm *DeepSeekInvocationClient) Prepare(args map[string]interface{}) error
 	}
 	maps.Insert(nargs, maps.All(defaultParams))
 
-	llm.ModelName = model.(string)
-	llm.RequestOptions = nargs
-
-	return nil
+	return model, nargs, nil
 }
 
-func (llm *DeepSeekInvocationClient) logLLMResponse(args ...string) {
+func (llm *DeepSeekInvocationClient) logLLMResponse(ctx context.Context, args ...string) {
 	fhash := []byte(args[0])
-	fname := fmt.Sprintf("chatlogs/%s_%8x_%d.log", llm.ModelName, sha256.Sum256(fhash), time.Now().UnixMicro())
+	fname := fmt.Sprintf("chatlogs/%s_%8x_%d.log", invocationModel(ctx, ""), sha256.Sum256(fhash), time.Now().UnixMicro())
 	logf, err := os.OpenFile(fname,
 		os.O_CREATE|os.O_RDWR, 0644)
 	defer logf.Close()
@@ -86,33 +85,27 @@ func (llm *DeepSeekInvocationClient) InvokeLLM(runner context.Context, buf bytes
 		return "", metrics, fmt.Errorf("LLM client not initialized")
 	}
 
+	model, options, err := llm.requestOptions(runner)
+	if err != nil {
+		return "", metrics, err
+	}
 	steam := new(bool)
 	req := api.GenerateRequest{
-		Model:   llm.ModelName,
+		Model:   model,
 		Prompt:  buf.String(),
 		Stream:  steam,
-		Options: llm.RequestOptions,
+		Options: options,
 		Format:  llmOutputSchema,
 		System:  "Act as an assistant that only provided an answer without any explanation, ever. Just return what the user asked for using the formating rules.",
 	}
 
-	callback := make(chan api.GenerateResponse)
-	//TODO: make configurable
-	deadline, cancel := context.WithDeadline(runner, time.Now().Add(time.Minute*5))
+	deadline, cancel := invocationContext(runner)
 	defer cancel()
-	go func() {
-		err := llm.client.Generate(deadline, &req, func(gr api.GenerateResponse) error {
-			callback <- gr
-			return nil
-		})
-		if err != nil {
-			callback <- api.GenerateResponse{
-				DoneReason: err.Error(),
-			}
-		}
-	}()
-
-	response := <-callback
+	var response api.GenerateResponse
+	err = llm.client.Generate(deadline, &req, func(gr api.GenerateResponse) error {
+		response = gr
+		return nil
+	})
 
 	metrics.ConversionTime += response.TotalDuration
 	metrics.ConversionPromptTime += response.PromptEvalDuration
@@ -120,8 +113,11 @@ func (llm *DeepSeekInvocationClient) InvokeLLM(runner context.Context, buf bytes
 	metrics.ConversionPromptTokenCount += response.PromptEvalCount
 	metrics.ConversionEvalTokenCount += response.EvalCount
 
+	if err != nil {
+		return "", metrics, ollamaError(err)
+	}
 	if response.Response == "" {
-		return "", metrics, fmt.Errorf("response is empty - %s", response.DoneReason)
+		return "", metrics, llmContentError(fmt.Errorf("response is empty - %s", response.DoneReason))
 	}
 
 	return response.Response, metrics, nil
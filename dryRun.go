@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcome is the scripted result of one application of a converter: "ok", an error class with an optional message,
+// e.g., "CompilationError: undefined: x", "error: <message>" for an unclassified failure, or "tests 2/3" for a test
+// run that passed two of three test cases.
+type Outcome string
+
+const OutcomeOK Outcome = "ok"
+
+// play returns the effect of the outcome on a request, as if a converter produced it.
+func (o Outcome) play() (func(req *ConversionRequest) error, error) {
+	text := strings.TrimSpace(string(o))
+	if text == "" || Outcome(text) == OutcomeOK {
+		return func(req *ConversionRequest) error { return nil }, nil
+	}
+	var passed, total int
+	if _, err := fmt.Sscanf(text, "tests %d/%d", &passed, &total); err == nil {
+		if passed < 0 || total < passed {
+			return nil, fmt.Errorf("invalid outcome '%s', expected tests <passed>/<total>", text)
+		}
+		return func(req *ConversionRequest) error {
+			req.Metrics.TestCases = make(map[string]bool, total)
+			for i := 0; i < total; i++ {
+				req.Metrics.TestCases[fmt.Sprintf("t%d", i)] = i < passed
+			}
+			req.scoreRevision()
+			if passed < total {
+				return TestingError{error: fmt.Errorf("%d of %d tests failed", total-passed, total)}
+			}
+			return nil
+		}, nil
+	}
+	head, message, _ := strings.Cut(text, ":")
+	message = strings.TrimSpace(message)
+	if message == "" {
+		message = fmt.Sprintf("scripted %s", head)
+	}
+	if head == "error" {
+		return func(req *ConversionRequest) error { return errors.New(message) }, nil
+	}
+	class, err := parseErrorClass(head)
+	if err != nil {
+		return nil, fmt.Errorf("invalid outcome '%s': %w", text, err)
+	}
+	return func(req *ConversionRequest) error { return class.wrap(errors.New(message)) }, nil
+}
+
+// OutcomeScript lists the outcomes of consecutive applications of a converter, the last one repeats once the script
+// ran out. A single outcome can be written without a list.
+type OutcomeScript []Outcome
+
+func (s *OutcomeScript) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*s = OutcomeScript{Outcome(node.Value)}
+		return nil
+	}
+	return node.Decode((*[]Outcome)(s))
+}
+
+// Scenario scripts the converters of a pipeline for a dry run. Tasks are referred to by their id, tasks of a pipeline
+// fragment by `<fragment>/<task>`. Converters without a script succeed.
+type Scenario struct {
+	Tasks      map[string]OutcomeScript `json:"tasks" yaml:"tasks"`
+	Validation map[string]OutcomeScript `json:"validation" yaml:"validation"`
+	CanApply   map[string]OutcomeScript `json:"canApply" yaml:"canApply"`
+	Expect     *ScenarioExpectation     `json:"expect,omitempty" yaml:"expect"`
+}
+
+// ScenarioExpectation turns a scenario into a test of the pipeline topology.
+type ScenarioExpectation struct {
+	//ids of the tasks in the order their attempts start, including retries and recovery tasks
+	Tasks []string `json:"tasks" yaml:"tasks"`
+	//ok, failed or a class of the error the job fails with
+	Result string `json:"result" yaml:"result"`
+}
+
+// ReadScenario parses a yaml or json scenario file.
+func ReadScenario(file io.Reader) (*Scenario, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	scenario := &Scenario{}
+	if err := yaml.Unmarshal(data, scenario); err != nil {
+		return nil, err
+	}
+	errs := make([]error, 0)
+	for _, scripts := range []map[string]OutcomeScript{scenario.Tasks, scenario.Validation, scenario.CanApply} {
+		for _, taskID := range slices.Sorted(maps.Keys(scripts)) {
+			for _, outcome := range scripts[taskID] {
+				if _, err := outcome.play(); err != nil {
+					errs = append(errs, fmt.Errorf("task %s: %w", taskID, err))
+				}
+			}
+		}
+	}
+	if expect := scenario.Expect; expect != nil && expect.Result != "" && expect.Result != "ok" && expect.Result != "failed" {
+		if _, err := parseErrorClass(expect.Result); err != nil {
+			errs = append(errs, fmt.Errorf("expected result: %w", err))
+		}
+	}
+	return scenario, errors.Join(errs...)
+}
+
+// LoadScenario reads a scenario file from disk.
+func LoadScenario(fname string) (*Scenario, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadScenario(f)
+}
+
+// DryRunStep is one entry of the task sequence of a dry run.
+type DryRunStep struct {
+	TaskID string `json:"task"`
+	//start, fail, recover, retry, invalid, rollback or succeed
+	Event   string `json:"event"`
+	Attempt int    `json:"attempt"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+func (s DryRunStep) String() string {
+	line := fmt.Sprintf("%-12s %-8s attempt %d", s.TaskID, s.Event, s.Attempt+1)
+	if s.Detail != "" {
+		line += " - " + s.Detail
+	}
+	return line
+}
+
+// DryRunReport is the outcome of a dry run.
+type DryRunReport struct {
+	Steps []DryRunStep `json:"steps"`
+	Err   error        `json:"-"`
+	mutex sync.Mutex
+}
+
+func (r *DryRunReport) record(event PipelineEvent) {
+	header := event.Header()
+	step := DryRunStep{TaskID: header.TaskID}
+	switch e := event.(type) {
+	case TaskStarted:
+		step.Event, step.Attempt = "start", e.Attempt
+	case AttemptFailed:
+		step.Event, step.Attempt, step.Detail = "fail", e.Attempt, describeError(e.Err)
+	case RetryScheduled:
+		step.Event, step.Attempt = "retry", e.Attempt
+		if e.Delay > 0 {
+			step.Detail = fmt.Sprintf("after %s", e.Delay.Round(time.Millisecond))
+		}
+	case RecoveryStarted:
+		step.Event, step.Attempt, step.Detail = "recover", e.Attempt, fmt.Sprintf("with %s", e.RecoveryID)
+	case ValidationFailed:
+		step.Event, step.Attempt, step.Detail = "invalid", e.Attempt, describeError(e.Err)
+	case WorkingPackageRolledBack:
+		step.Event, step.Attempt = "rollback", e.Attempt
+	case TaskSucceeded:
+		step.Event, step.Attempt = "succeed", e.Attempts-1
+	default:
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Steps = append(r.Steps, step)
+}
+
+// Tasks returns the ids of the tasks in the order their attempts started.
+func (r *DryRunReport) Tasks() []string {
+	tasks := make([]string, 0, len(r.Steps))
+	for _, step := range r.Steps {
+		if step.Event == "start" || step.Event == "retry" {
+			tasks = append(tasks, step.TaskID)
+		}
+	}
+	return tasks
+}
+
+// Result returns ok, or the error class the job failed with, or failed for errors without a class.
+func (r *DryRunReport) Result() string {
+	if r.Err == nil {
+		return "ok"
+	}
+	if class := classOf(r.Err); class != "" {
+		return string(class)
+	}
+	return "failed"
+}
+
+// Check compares the report with the expectation of the scenario.
+func (r *DryRunReport) Check(expect *ScenarioExpectation) error {
+	if expect == nil {
+		return nil
+	}
+	errs := make([]error, 0)
+	if expect.Tasks != nil && !slices.Equal(expect.Tasks, r.Tasks()) {
+		errs = append(errs, fmt.Errorf("expected tasks %s, got %s",
+			strings.Join(expect.Tasks, " -> "), strings.Join(r.Tasks(), " -> ")))
+	}
+	matches := true
+	switch expect.Result {
+	case "":
+	case "ok":
+		matches = r.Err == nil
+	case "failed":
+		matches = r.Err != nil
+	default:
+		matches = ErrorClass(expect.Result).matches(r.Err)
+	}
+	if !matches {
+		errs = append(errs, fmt.Errorf("expected result %s, got %s", expect.Result, r.Result()))
+	}
+	return errors.Join(errs...)
+}
+
+func describeError(err error) string {
+	if class := classOf(err); class != "" {
+		return fmt.Sprintf("%s: %v", class, err)
+	}
+	return err.Error()
+}
+
+// DryRun executes the pipeline with every converter replaced by the scripted outcomes of the scenario. No LLM, build
+// or test runs and retries do not wait for their backoff, the report lists the task sequence with its retries and
+// recoveries.
+func (p *Pipeline) DryRun(scenario *Scenario) (*DryRunReport, error) {
+	if p.source == nil {
+		return nil, fmt.Errorf("dry run requires a pipeline read from a pipeline file")
+	}
+	simulated, err := compilePipeline(*p.source)
+	if err != nil {
+		return nil, err
+	}
+	script := &scenarioScript{scenario: scenario, calls: make(map[scriptKey]int)}
+	known := make(map[string]bool)
+	script.install(simulated, "", known)
+	errs := make([]error, 0)
+	for _, scripts := range []map[string]OutcomeScript{scenario.Tasks, scenario.Validation, scenario.CanApply} {
+		for _, taskID := range slices.Sorted(maps.Keys(scripts)) {
+			if !known[taskID] {
+				errs = append(errs, fmt.Errorf("scenario scripts unknown task %s", taskID))
+			}
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	runner := &PipelineRunner{Context: context.Background(), events: NewEventBus(), dryRun: true}
+	report := &DryRunReport{Steps: make([]DryRunStep, 0)}
+	unsubscribe := runner.Subscribe(ObserverFunc(report.record))
+	defer unsubscribe()
+	req := MakeConversionRequest(&DeploymentPackage{
+		TestFiles:  make(map[string]string),
+		BuildFiles: make(map[string]string),
+	})
+	req.WorkingPackage = req.SourcePackage.copy()
+	report.Err = simulated.Execute(runner, req)
+	return report, nil
+}
+
+type scriptKey struct {
+	slot   string
+	taskID string
+}
+
+// scenarioScript plays the outcomes of a scenario, it is shared by all converters of a dry run.
+type scenarioScript struct {
+	scenario *Scenario
+	mutex    sync.Mutex
+	calls    map[scriptKey]int
+}
+
+// next returns the outcome of the next application of the converter in the slot of the task.
+func (s *scenarioScript) next(key scriptKey) Outcome {
+	var scripts map[string]OutcomeScript
+	switch key.slot {
+	case "execute":
+		scripts = s.scenario.Tasks
+	case "validation":
+		scripts = s.scenario.Validation
+	case "canApply":
+		scripts = s.scenario.CanApply
+	}
+	script := scripts[key.taskID]
+	if len(script) == 0 {
+		return OutcomeOK
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	call := s.calls[key]
+	s.calls[key]++
+	return script[min(call, len(script)-1)]
+}
+
+// install replaces the converters of the pipeline and its fragments with scripted ones.
+func (s *scenarioScript) install(p *Pipeline, prefix string, known map[string]bool) {
+	p.walk(func(task *ConversionTask) {
+		taskID := prefix + task.ID
+		known[taskID] = true
+		if sub, ok := task.Execute.(*SubPipelineConverter); ok {
+			s.install(sub.Pipeline, sub.Fragment+"/", known)
+		} else if task.Execute != nil {
+			task.Execute = &scriptedConverter{script: s, key: scriptKey{"execute", taskID}}
+		}
+		if task.Validation != nil {
+			task.Validation = &scriptedConverter{script: s, key: scriptKey{"validation", taskID}}
+		}
+		if task.CanApply != nil {
+			task.CanApply = &scriptedConverter{script: s, key: scriptKey{"canApply", taskID}}
+		}
+	})
+}
+
+// scriptedConverter takes the place of a converter during a dry run.
+type scriptedConverter struct {
+	script *scenarioScript
+	key    scriptKey
+}
+
+func (c *scriptedConverter) Apply(runner *PipelineRunner, req *ConversionRequest) error {
+	play, err := c.script.next(c.key).play()
+	if err != nil {
+		return err
+	}
+	return play(req)
+}
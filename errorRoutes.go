@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorClass names a failure type that a task can route to its own recovery task.
+type ErrorClass string
+
+const (
+	CompilationFailure  ErrorClass = "CompilationError"
+	TestingFailure      ErrorClass = "TestingError"
+	LLMFailure          ErrorClass = "LLMError"
+	LLMTransportFailure ErrorClass = "LLMTransportError"
+	LLMContentFailure   ErrorClass = "LLMContentError"
+	PreconditionFailure ErrorClass = "PreconditionError"
+	TimeoutFailure      ErrorClass = "TimeoutError"
+	ReviewFailure       ErrorClass = "ReviewError"
+)
+
+// errorClasses lists all routable classes in the order they are matched against an error. LLMTransportError and
+// LLMContentError are the two kinds of LLMError, they are matched before it.
+var errorClasses = []ErrorClass{PreconditionFailure, TimeoutFailure, ReviewFailure, CompilationFailure, TestingFailure, LLMTransportFailure, LLMContentFailure, LLMFailure}
+
+func parseErrorClass(key string) (ErrorClass, error) {
+	for _, class := range errorClasses {
+		if string(class) == key {
+			return class, nil
+		}
+	}
+	return "", fmt.Errorf("unknown error class: %s", key)
+}
+
+// matches reports whether the error, or any error it wraps, belongs to the class.
+func (class ErrorClass) matches(err error) bool {
+	switch class {
+	case PreconditionFailure:
+		var target PreconditionError
+		return errors.As(err, &target)
+	case CompilationFailure:
+		var target CompilationError
+		return errors.As(err, &target)
+	case TestingFailure:
+		var target TestingError
+		return errors.As(err, &target)
+	case LLMFailure:
+		var target LLMError
+		return errors.As(err, &target)
+	case LLMTransportFailure, LLMContentFailure:
+		var target LLMError
+		return errors.As(err, &target) && target.Transport == (class == LLMTransportFailure)
+	case TimeoutFailure:
+		var target TimeoutError
+		return errors.As(err, &target)
+	case ReviewFailure:
+		var target ReviewError
+		return errors.As(err, &target)
+	}
+	return false
+}
+
+// classOf returns the first class the error belongs to, or an empty class if it belongs to none.
+func classOf(err error) ErrorClass {
+	for _, class := range errorClasses {
+		if class.matches(err) {
+			return class
+		}
+	}
+	return ""
+}
+
+// route selects the recovery task that the `on` clauses of the task define for the error.
+func (task *ConversionTask) route(err error) *ConversionTask {
+	for _, class := range errorClasses {
+		if next, ok := task.OnError[class]; ok && class.matches(err) {
+			return next
+		}
+	}
+	return nil
+}
+
+// recoveryFor selects the recovery task for a failed attempt, falling back to the generic recovery task.
+func (task *ConversionTask) recoveryFor(err error) *ConversionTask {
+	if next := task.route(err); next != nil {
+		return next
+	}
+	return task.OnFailure
+}
+
+// wrap turns the error into an error of the class, errors of an empty or unknown class are returned as they are.
+func (class ErrorClass) wrap(err error) error {
+	switch class {
+	case PreconditionFailure:
+		return PreconditionError{err}
+	case CompilationFailure:
+		return CompilationError{err}
+	case TestingFailure:
+		return TestingError{error: err}
+	case LLMFailure, LLMContentFailure:
+		return LLMError{error: err}
+	case LLMTransportFailure:
+		return LLMError{error: err, Transport: true}
+	case TimeoutFailure:
+		return TimeoutError{err}
+	case ReviewFailure:
+		return ReviewError{err}
+	}
+	return err
+}
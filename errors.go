@@ -1,5 +1,11 @@
 package main
 
+import (
+	"context"
+	"errors"
+	"net"
+)
+
 type TestingError struct {
 	error
 	error_code int
@@ -19,8 +25,67 @@ func (e CompilationError) Error() string {
 
 type LLMError struct {
 	error
+	//the LLM could not be reached or did not answer, otherwise the answer was unusable
+	Transport bool
 }
 
 func (e LLMError) Error() string {
 	return e.error.Error()
 }
+
+// llmTransportError marks a failed invocation of an LLM that could not be reached or did not answer.
+func llmTransportError(err error) error {
+	return LLMError{error: err, Transport: true}
+}
+
+// llmContentError marks a failed invocation whose request was rejected or whose answer was unusable.
+func llmContentError(err error) error {
+	return LLMError{error: err}
+}
+
+// llmStatusError classifies a failed HTTP response of an LLM, server errors are transport errors, other statuses,
+// e.g., a bad request or an unknown model, are content errors.
+func llmStatusError(status int, err error) error {
+	if status >= 500 {
+		return llmTransportError(err)
+	}
+	return llmContentError(err)
+}
+
+// classifyLLMError classifies a failed invocation the client did not classify. Network errors and timeouts are
+// transport errors, anything else is a content error.
+func classifyLLMError(err error) error {
+	var llmErr LLMError
+	if errors.As(err, &llmErr) {
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return llmTransportError(err)
+	}
+	return llmContentError(err)
+}
+
+type PreconditionError struct {
+	error
+}
+
+func (e PreconditionError) Error() string {
+	return e.error.Error()
+}
+
+type ReviewError struct {
+	error
+}
+
+func (e ReviewError) Error() string {
+	return e.error.Error()
+}
+
+type TimeoutError struct {
+	error
+}
+
+func (e TimeoutError) Error() string {
+	return e.error.Error()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ExecTask is the task converter that runs an external process, e.g., `task_args: {command: "python3 lint.py"}`.
+const ExecTask = "exec"
+
+// ExecInput is written as JSON to the stdin of an exec converter process.
+type ExecInput struct {
+	RequestID      string             `json:"id"`
+	TaskID         string             `json:"task,omitempty"`
+	Attempt        int                `json:"attempt"`
+	Args           map[string]any     `json:"args,omitempty"`
+	SourcePackage  *DeploymentPackage `json:"sourcePackage"`
+	WorkingPackage *DeploymentPackage `json:"workingPackage"`
+	//build directory of the last build, empty if the package was not built yet
+	WorkingDir string   `json:"workingDir,omitempty"`
+	Errors     []string `json:"errors"`
+	Metrics    *Metrics `json:"metrics"`
+}
+
+// ExecOutput is read as JSON from the stdout of an exec converter process. All fields are optional.
+type ExecOutput struct {
+	//replaces the working package if set
+	WorkingPackage *DeploymentPackage `json:"workingPackage,omitempty"`
+	//fails the task with the message, the class decides which `on` route handles it
+	Error      string     `json:"error,omitempty"`
+	ErrorClass ErrorClass `json:"errorClass,omitempty"`
+	//added to the metrics of the job, test cases replace the results of the last test run
+	Metrics *Metrics `json:"metrics,omitempty"`
+}
+
+// ExecConverter runs a command with the request as JSON on stdin and applies the result it prints on stdout. The
+// process can be written in any language, it fails the task by exiting with a non-zero status or by reporting an error.
+type ExecConverter struct {
+	Command []string
+	Args    map[string]any
+}
+
+func makeExecConverter(args map[string]interface{}) Converter {
+	converter := &ExecConverter{}
+	switch command := args["command"].(type) {
+	case string:
+		converter.Command = strings.Fields(command)
+	case []interface{}:
+		for _, part := range command {
+			converter.Command = append(converter.Command, fmt.Sprint(part))
+		}
+	}
+	if execArgs, ok := args["args"].(map[string]interface{}); ok {
+		converter.Args = execArgs
+	}
+	return converter
+}
+
+func (e *ExecConverter) Apply(runner *PipelineRunner, req *ConversionRequest) error {
+	if len(e.Command) == 0 {
+		return fmt.Errorf("exec converter without command")
+	}
+	input := ExecInput{
+		RequestID:      req.Id.String(),
+		Args:           e.Args,
+		SourcePackage:  req.SourcePackage,
+		WorkingPackage: req.WorkingPackage,
+		WorkingDir:     runner.WorkingDir,
+		Errors:         make([]string, 0, len(req.err)),
+		Metrics:        req.Metrics,
+	}
+	if req.span != nil {
+		input.TaskID, input.Attempt = req.span.TaskID, req.span.Attempt
+	}
+	for _, err := range req.err {
+		input.Errors = append(input.Errors, err.Error())
+	}
+	stdin, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("failed to encode exec input: %w", err)
+	}
+
+	cmd := exec.CommandContext(runner, e.Command[0], e.Command[1:]...)
+	killOnCancel(cmd)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	start := time.Now()
+	runErr := cmd.Run()
+	log.Debugf("exec %s took %s", e.Command[0], time.Since(start))
+
+	var output ExecOutput
+	if stdout.Len() > 0 {
+		if err := json.Unmarshal(stdout.Bytes(), &output); err != nil {
+			err = fmt.Errorf("invalid output of %s: %w", e.Command[0], err)
+			req.err = append(req.err, err)
+			return err
+		}
+	} else if runErr == nil {
+		return nil
+	}
+
+	if output.WorkingPackage != nil {
+		req.WorkingPackage = output.WorkingPackage.withDefaults()
+	}
+	if output.Metrics != nil {
+		req.Metrics.AddMetric(*output.Metrics)
+		if len(output.Metrics.TestCases) > 0 {
+			req.Metrics.TestCases = output.Metrics.TestCases
+			req.scoreRevision()
+		}
+	}
+
+	if output.Error == "" && runErr == nil {
+		return nil
+	}
+	if output.Error == "" {
+		output.Error = fmt.Sprintf("%s failed: %v %s", e.Command[0], runErr, strings.TrimSpace(stderr.String()))
+	}
+	err = output.ErrorClass.wrap(fmt.Errorf("%s", output.Error))
+	req.err = append(req.err, err)
+	return err
+}
+
+// withDefaults initializes the maps a process may have left out of the package.
+func (dp *DeploymentPackage) withDefaults() *DeploymentPackage {
+	if dp.TestFiles == nil {
+		dp.TestFiles = make(map[string]string)
+	}
+	if dp.BuildFiles == nil {
+		dp.BuildFiles = make(map[string]string)
+	}
+	return dp
+}
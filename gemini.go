@@ -36,15 +36,12 @@ func (g *GeminiInvocationClient) Configure(args map[string]interface{}) error {
 	return nil
 }
 
-func (g *GeminiInvocationClient) Prepare(args map[string]interface{}) error {
-	if args == nil {
-		return nil
+// modelOf returns the GEMINI_MODEL of the arguments, or the configured model.
+func (g *GeminiInvocationClient) modelOf(args map[string]interface{}) string {
+	if model, ok := args["GEMINI_MODEL"].(string); ok {
+		return model
 	}
-	model, ok := args["GEMINI_MODEL"]
-	if ok {
-		g.model = model.(string)
-	}
-	return nil
+	return g.model
 }
 
 func (g *GeminiInvocationClient) InvokeLLM(ctx context.Context, buf bytes.Buffer) (string, Metrics, error) {
@@ -55,7 +52,7 @@ func (g *GeminiInvocationClient) InvokeLLM(ctx context.Context, buf bytes.Buffer
 	}
 	defer client.Close()
 
-	model := client.GenerativeModel(g.model)
+	model := client.GenerativeModel(g.modelOf(invocationOf(ctx).Args))
 
 	model.ResponseMIMEType = "application/json"
 	//TODO: figure out Schema
@@ -107,9 +104,9 @@ func (g *GeminiInvocationClient) InvokeLLM(ctx context.Context, buf bytes.Buffer
 	return out, metrics, nil
 }
 
-func (g *GeminiInvocationClient) logLLMResponse(args ...string) {
+func (g *GeminiInvocationClient) logLLMResponse(ctx context.Context, args ...string) {
 	fhash := []byte(args[0])
-	fname := fmt.Sprintf("chatlogs/%s_%8x_%d.log", g.model, sha256.Sum256(fhash), time.Now().UnixMicro())
+	fname := fmt.Sprintf("chatlogs/%s_%8x_%d.log", invocationModel(ctx, g.model), sha256.Sum256(fhash), time.Now().UnixMicro())
 	logf, err := os.OpenFile(fname,
 		os.O_CREATE|os.O_RDWR, 0644)
 	defer logf.Close()
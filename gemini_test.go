@@ -38,8 +38,6 @@ func TestGemini(t *testing.T) {
 		"GEMINI_MODEL":   "gemini-1.5-flash-8b",
 	})
 
-	gic.Prepare(nil)
-
 	response, metrics, err := gic.InvokeLLM(t.Context(), codePrompt)
 	assert.NoError(t, err)
 	assert.NotNil(t, response)
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheEntry is a cached response, stored in a file named after its key.
+type CacheEntry struct {
+	Model    string      `json:"model"`
+	Response string      `json:"response"`
+	Metrics  CallMetrics `json:"metrics"`
+	Stored   time.Time   `json:"stored"`
+}
+
+// CachingInvocationClient answers repeated prompts from a content addressed cache on the local disk and invokes its
+// backend for the others. Entries are keyed by the hash of the model, the request options and the normalized prompt.
+type CachingInvocationClient struct {
+	Dir string
+	//size limit of the cache in bytes, the least recently used entries are evicted first, 0 for no limit
+	MaxBytes int64
+	//entries stored longer ago are not used, 0 for no limit
+	MaxAge time.Duration
+
+	client LLMInvocationClient
+	mutex  sync.Mutex
+}
+
+// makeCachingClient puts the cache configured with LLM_CACHE_DIR, LLM_CACHE_MAX_MB and LLM_CACHE_MAX_AGE in front of
+// the client.
+func makeCachingClient(client LLMInvocationClient, args map[string]interface{}) (LLMInvocationClient, error) {
+	cc := &CachingInvocationClient{client: client}
+	if err := cc.Configure(args); err != nil {
+		return nil, err
+	}
+	return cc, nil
+}
+
+func (cc *CachingInvocationClient) Configure(args map[string]interface{}) error {
+	dir, ok := args["LLM_CACHE_DIR"].(string)
+	if !ok || dir == "" {
+		return fmt.Errorf("LLM_CACHE_DIR required")
+	}
+	cc.Dir = dir
+	if size, ok := args["LLM_CACHE_MAX_MB"].(string); ok && size != "" {
+		mb, err := strconv.ParseFloat(size, 64)
+		if err != nil || mb < 0 {
+			return fmt.Errorf("invalid LLM_CACHE_MAX_MB: %s", size)
+		}
+		cc.MaxBytes = int64(mb * (1 << 20))
+	}
+	if age, ok := args["LLM_CACHE_MAX_AGE"].(string); ok && age != "" {
+		duration, err := time.ParseDuration(age)
+		if err != nil || duration < 0 {
+			return fmt.Errorf("invalid LLM_CACHE_MAX_AGE: %s", age)
+		}
+		cc.MaxAge = duration
+	}
+	return os.MkdirAll(cc.Dir, 0755)
+}
+
+// cacheBypassed is true for tasks that set the option cache to false, e.g., to sample fresh outputs.
+func cacheBypassed(args map[string]interface{}) bool {
+	enabled, ok := args["cache"].(bool)
+	return ok && !enabled
+}
+
+// optionsKey hashes the model and the request options of an invocation.
+func optionsKey(args map[string]interface{}) (string, error) {
+	model := modelOf(args)
+	options := maps.Clone(args)
+	delete(options, "cache")
+	//maps are encoded with sorted keys
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return "", fmt.Errorf("request options can not be cached: %w", err)
+	}
+	sum := sha256.Sum256(append([]byte(model+"\n"), encoded...))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// entryKey combines the key of the request options with the hash of the normalized prompt.
+func entryKey(options, prompt string) string {
+	sum := sha256.Sum256([]byte(options + "\n" + normalizePrompt(prompt)))
+	return hex.EncodeToString(sum[:])
+}
+
+// cacheOptionOf reads the cache option from the LLM arguments and returns the arguments without it, the backends do
+// not know it.
+func cacheOptionOf(args map[string]interface{}) (bypass bool, stripped map[string]interface{}) {
+	if _, ok := args["cache"]; !ok {
+		return false, args
+	}
+	stripped = maps.Clone(args)
+	delete(stripped, "cache")
+	return cacheBypassed(args), stripped
+}
+
+// cacheKey returns the key of the request options of the invocation, it is empty if the invocation bypasses the cache.
+func cacheKey(inv *llmInvocation) (string, error) {
+	if inv.bypassCache {
+		return "", nil
+	}
+	return optionsKey(inv.Args)
+}
+
+func (cc *CachingInvocationClient) entryFile(key string) string {
+	return filepath.Join(cc.Dir, key+".json")
+}
+
+func (cc *CachingInvocationClient) InvokeLLM(ctx context.Context, buf bytes.Buffer) (string, Metrics, error) {
+	inv := invocationOf(ctx)
+	options, err := cacheKey(inv)
+	if err != nil {
+		return "", Metrics{}, err
+	}
+	model := modelOf(inv.Args)
+	if options == "" {
+		return cc.client.InvokeLLM(ctx, buf)
+	}
+	key := entryKey(options, buf.String())
+	if entry := cc.lookup(key); entry != nil {
+		saved := entry.Metrics.ConversionPromptTokenCount + entry.Metrics.ConversionEvalTokenCount
+		log.Debugf("answered prompt %s for model %s from the cache, saved %d tokens", key, model, saved)
+		return entry.Response, Metrics{CacheHits: 1, CacheTokensSaved: saved}, nil
+	}
+
+	response, metrics, err := cc.client.InvokeLLM(ctx, buf)
+	metrics.CacheMisses++
+	if err != nil {
+		return response, metrics, err
+	}
+	cc.store(key, &CacheEntry{
+		Model:    model,
+		Response: response,
+		Metrics:  callMetrics(metrics),
+		Stored:   time.Now(),
+	})
+	return response, metrics, nil
+}
+
+// lookup returns the entry of the key, or nil if it is not cached or expired.
+func (cc *CachingInvocationClient) lookup(key string) *CacheEntry {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	fname := cc.entryFile(key)
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("failed to read cache entry %s: %v", fname, err)
+		}
+		return nil
+	}
+	entry := &CacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		log.Warnf("removing unreadable cache entry %s: %v", fname, err)
+		_ = os.Remove(fname)
+		return nil
+	}
+	if cc.MaxAge > 0 && time.Since(entry.Stored) > cc.MaxAge {
+		_ = os.Remove(fname)
+		return nil
+	}
+	//the modification time orders the entries for eviction
+	now := time.Now()
+	_ = os.Chtimes(fname, now, now)
+	return entry
+}
+
+// store writes the entry, replacing the file only once it is complete, and evicts entries over the size limit.
+func (cc *CachingInvocationClient) store(key string, entry *CacheEntry) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Errorf("failed to cache response of prompt %s: %v", key, err)
+		return
+	}
+	fname := cc.entryFile(key)
+	tmp := fname + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		log.Errorf("failed to cache response of prompt %s: %v", key, err)
+		return
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		log.Errorf("failed to cache response of prompt %s: %v", key, err)
+		return
+	}
+	cc.evict()
+}
+
+// evict removes the least recently used entries until the cache fits its size limit.
+func (cc *CachingInvocationClient) evict() {
+	if cc.MaxBytes <= 0 {
+		return
+	}
+	dirEntries, err := os.ReadDir(cc.Dir)
+	if err != nil {
+		log.Warnf("failed to list cache %s: %v", cc.Dir, err)
+		return
+	}
+	files := make([]os.FileInfo, 0, len(dirEntries))
+	var size int64
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), ".json") {
+			continue
+		}
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, info)
+		size += info.Size()
+	}
+	slices.SortFunc(files, func(a, b os.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, info := range files {
+		if size <= cc.MaxBytes {
+			return
+		}
+		if err := os.Remove(filepath.Join(cc.Dir, info.Name())); err == nil {
+			size -= info.Size()
+		}
+	}
+}
+
+// forget removes the cached response of a prompt, e.g., if the reader rejected it, so that a retry invokes the
+// backend again.
+func (cc *CachingInvocationClient) forget(inv *llmInvocation, prompt string) {
+	options, err := cacheKey(inv)
+	if err != nil || options == "" {
+		return
+	}
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	_ = os.Remove(cc.entryFile(entryKey(options, prompt)))
+}
+
+func (cc *CachingInvocationClient) logLLMResponse(ctx context.Context, args ...string) {
+	cc.client.logLLMResponse(ctx, args...)
+}
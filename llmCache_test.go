@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	stub := &stubClient{}
+	registerStub(t, stub)
+	dir := filepath.Join(t.TempDir(), "cache")
+	client, err := makeLLMClient(&ConverterOptions{LLMClient: "stub", Args: map[string]interface{}{"LLM_CACHE_DIR": dir}})
+	assert.NoError(t, err)
+
+	first := testRequest()
+	err = llmPipeline(t).Execute(&PipelineRunner{Context: context.Background(), client: client}, first)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, first.Metrics.CacheMisses)
+	assert.Equal(t, 0, first.Metrics.CacheHits)
+
+	second := testRequest()
+	err = llmPipeline(t).Execute(&PipelineRunner{Context: context.Background(), client: client}, second)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stub.calls)
+	assert.Equal(t, first.WorkingPackage.RootFile, second.WorkingPackage.RootFile)
+	assert.Equal(t, 1, second.Metrics.CacheHits)
+	assert.Equal(t, 0, second.Metrics.ConversionPromptTokenCount)
+	assert.Equal(t, first.Metrics.ConversionPromptTokenCount+first.Metrics.ConversionEvalTokenCount, second.Metrics.CacheTokensSaved)
+
+	//other request options are a different entry
+	runner := &PipelineRunner{Context: context.Background(), client: client, llmArgs: map[string]interface{}{"temperature": 0.8}}
+	err = llmPipeline(t).Execute(runner, testRequest())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stub.calls)
+
+	bypass := testRequest()
+	runner = &PipelineRunner{Context: context.Background(), client: client, llmArgs: map[string]interface{}{"cache": false}}
+	err = llmPipeline(t).Execute(runner, bypass)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stub.calls)
+	assert.Equal(t, "// qwen2.5-coder:14b 3", bypass.WorkingPackage.RootFile)
+	assert.Equal(t, 0, bypass.Metrics.CacheHits+bypass.Metrics.CacheMisses)
+	entries, _ := os.ReadDir(dir)
+	assert.Len(t, entries, 2)
+
+	//the backends never get the cache option, whether a cache is configured or not
+	var received map[string]interface{}
+	backend := &funcClient{invoke: func(ctx context.Context, model string) (string, error) {
+		received = invocationOf(ctx).Args
+		return `{"main.go": "package main"}`, nil
+	}}
+	cached, err := makeCachingClient(backend, map[string]interface{}{"LLM_CACHE_DIR": t.TempDir()})
+	assert.NoError(t, err)
+	for _, client := range []LLMInvocationClient{backend, cached} {
+		received = nil
+		runner = &PipelineRunner{Context: context.Background(), client: client, llmArgs: map[string]interface{}{"cache": false}}
+		err = llmPipeline(t).Execute(runner, testRequest())
+		assert.NoError(t, err)
+		assert.NotNil(t, received)
+		assert.NotContains(t, received, "cache")
+	}
+}
+
+func TestResponseCacheLimits(t *testing.T) {
+	stub := &stubClient{}
+	dir := t.TempDir()
+	client, err := makeCachingClient(stub, map[string]interface{}{
+		"LLM_CACHE_DIR":     dir,
+		"LLM_CACHE_MAX_AGE": "1h",
+		"LLM_CACHE_MAX_MB":  "1",
+	})
+	assert.NoError(t, err)
+	cache := client.(*CachingInvocationClient)
+	assert.Equal(t, int64(1<<20), cache.MaxBytes)
+	args := map[string]interface{}{"model_name": "m"}
+
+	invoke := func(prompt string) Metrics {
+		ctx := withInvocation(t.Context(), &llmInvocation{Args: args})
+		_, metrics, err := cache.InvokeLLM(ctx, *bytes.NewBufferString(prompt))
+		assert.NoError(t, err)
+		return metrics
+	}
+	invoke("a")
+	entries, _ := os.ReadDir(dir)
+	info, _ := entries[0].Info()
+	//the limit only fits one entry, a was used least recently
+	cache.MaxBytes = info.Size() + info.Size()/2
+	invoke("b")
+	assert.Equal(t, 1, invoke("a").CacheMisses)
+	assert.Equal(t, 1, invoke("a").CacheHits)
+
+	options, err := optionsKey(args)
+	assert.NoError(t, err)
+	key := entryKey(options, "a")
+	entry := cache.lookup(key)
+	entry.Stored = time.Now().Add(-2 * time.Hour)
+	cache.store(key, entry)
+	assert.Equal(t, 1, invoke("a").CacheMisses)
+
+	//invocations with other options are other entries
+	inv := &llmInvocation{Args: map[string]interface{}{"model_name": "other"}}
+	response, _, err := cache.InvokeLLM(withInvocation(t.Context(), inv), *bytes.NewBufferString("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, `{"main.go": "// other 5"}`, response)
+	inv = &llmInvocation{Args: map[string]interface{}{"model_name": "other"}}
+	response, metrics, err := cache.InvokeLLM(withInvocation(t.Context(), inv), *bytes.NewBufferString("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, metrics.CacheHits)
+	assert.Equal(t, `{"main.go": "// other 5"}`, response)
+
+	_, err = makeCachingClient(stub, map[string]interface{}{"LLM_CACHE_DIR": dir, "LLM_CACHE_MAX_AGE": "soon"})
+	assert.ErrorContains(t, err, "invalid LLM_CACHE_MAX_AGE")
+}
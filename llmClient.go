@@ -2,13 +2,59 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"iter"
+	"maps"
 	"strings"
 	"text/template"
+	"time"
 )
 
+// defaultInvocationTimeout bounds LLM invocations of tasks that have no timeout of their own.
+const defaultInvocationTimeout = 5 * time.Minute
+
+// invocationContext applies the default invocation timeout, unless the task or job already set a deadline.
+func invocationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, defaultInvocationTimeout)
+}
+
+// llmInvocation describes an invocation to the LLM client, it is passed in the context of InvokeLLM. Clients that
+// delegate to other clients report the backend that answered on it.
+type llmInvocation struct {
+	TaskID    string
+	Converter string
+	Backend   string
+	//model the invocation is priced with
+	Model string
+	//LLM options of the invocation, e.g., model_name
+	Args map[string]interface{}
+	//set if the task turned the cache off with the option cache, the cache neither answers nor stores the invocation
+	bypassCache bool
+	//if set, clients that can stream pass each chunk of the output to it, an error aborts the generation and is
+	//returned by InvokeLLM
+	observe func(chunk string) error
+}
+
+type llmInvocationKey struct{}
+
+// withInvocation adds the invocation to the context.
+func withInvocation(ctx context.Context, inv *llmInvocation) context.Context {
+	return context.WithValue(ctx, llmInvocationKey{}, inv)
+}
+
+// invocationOf returns the invocation of the context, or an empty one.
+func invocationOf(ctx context.Context) *llmInvocation {
+	if inv, ok := ctx.Value(llmInvocationKey{}).(*llmInvocation); ok {
+		return inv
+	}
+	return &llmInvocation{}
+}
+
 type LLMPackageReader interface {
 	makeDeploymentFile(rawLLMResponse string, original *DeploymentPackage) (*DeploymentPackage, error)
 }
@@ -88,18 +134,31 @@ func (cc *LLMConverter) Apply(runner *PipelineRunner, code *ConversionRequest) e
 		return err
 	}
 
-	err = runner.client.Prepare(cc.args)
-	if err != nil {
-		return LLMError{fmt.Errorf("failed to configure LLMClient: %+v", err)}
+	if err := code.budget.check(nil); err != nil {
+		code.err = append(code.err, err)
+		return code.exceedBudget(err)
 	}
-	//XXX: interface entry point ...
-	response, metrics, err := runner.client.InvokeLLM(runner, codePrompt)
+	stream, args := streamOptionsOf(cc.llmArgs(runner))
+	bypassCache, args := cacheOptionOf(args)
+	inv := &llmInvocation{Model: modelOf(args), Args: args, bypassCache: bypassCache}
+	if code.span != nil {
+		inv.TaskID, inv.Converter = code.span.TaskID, code.span.Converter
+	}
+	var monitor *streamMonitor
+	if stream.Enabled {
+		monitor = cc.streamMonitor(stream, code.progress)
+		inv.observe = monitor.observe
+	}
+	response, metrics, err := cc.invoke(runner, inv, srcFile, codePrompt)
+	code.progress.invoked(monitor.streamed(), metrics)
+	metrics.Cost = code.budget.charge(inv.Model, metrics)
 	code.Metrics.AddMetric(metrics)
+	code.span.recordLLM(metrics)
+	code.span.recordBackend(inv.Backend)
 	if err != nil {
 		return err
 	}
 
-	runner.client.logLLMResponse(srcFile, response, codePrompt.String())
 	original := code.WorkingPackage
 	if original == nil {
 		original = code.SourcePackage
@@ -108,13 +167,62 @@ func (cc *LLMConverter) Apply(runner *PipelineRunner, code *ConversionRequest) e
 	code.WorkingPackage = newPackage
 
 	if err != nil {
-		code.err = append(code.err, LLMError{err})
+		if cache, ok := runner.client.(*CachingInvocationClient); ok {
+			cache.forget(inv, codePrompt.String())
+		}
+		err = LLMError{error: err}
+		code.err = append(code.err, err)
 		return err
 	}
 
 	return nil
 }
 
+// invoke sends the prompt to the shared client, the arguments of this converter travel with the invocation so that
+// concurrent jobs do not change each other's options.
+func (cc *LLMConverter) invoke(runner *PipelineRunner, inv *llmInvocation, srcFile string, codePrompt bytes.Buffer) (string, Metrics, error) {
+	//XXX: interface entry point ...
+	ctx := withInvocation(runner, inv)
+	response, metrics, err := runner.client.InvokeLLM(ctx, codePrompt)
+	if err != nil {
+		return "", metrics, classifyLLMError(err)
+	}
+
+	runner.client.logLLMResponse(ctx, srcFile, response, codePrompt.String())
+	return response, metrics, nil
+}
+
+// invocationModel returns the model of the invocation in the context, or the model of the client if it names none.
+func invocationModel(ctx context.Context, model string) string {
+	inv := invocationOf(ctx)
+	if inv.Model != "" {
+		return inv.Model
+	}
+	if name := modelOf(inv.Args); name != "" {
+		return name
+	}
+	return model
+}
+
+// llmArgs are the arguments of the converter with the LLM arguments of the runner.
+func (cc *LLMConverter) llmArgs(runner *PipelineRunner) map[string]interface{} {
+	if len(runner.llmArgs) == 0 {
+		return cc.args
+	}
+	args := maps.Clone(cc.args)
+	maps.Copy(args, runner.llmArgs)
+	return args
+}
+
+// modelOf returns the model named in the LLM arguments.
+func modelOf(args map[string]interface{}) string {
+	if model, ok := args["model_name"].(string); ok && model != "" {
+		return model
+	}
+	model, _ := args["GEMINI_MODEL"].(string)
+	return model
+}
+
 func getFirstTestFile(code *ConversionRequest) *TestFile {
 	next, stop := iter.Pull2(code.SourcePackage.getTestFiles())
 	result, err, valid := next()
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// streamArgKeys are the LLM arguments of streamed invocations, they are not passed on to the client.
+var streamArgKeys = []string{"stream", "stream_max_tokens"}
+
+// streamOptions configure a streamed invocation, the partial output is checked while the LLM generates it.
+type streamOptions struct {
+	//stream the invocation, clients that can not stream return the full answer at once
+	Enabled bool
+	//abort the generation after this many streamed tokens, unlimited if zero
+	MaxTokens int
+}
+
+// streamOptionsOf reads the stream options from the LLM arguments and returns the arguments without them.
+func streamOptionsOf(args map[string]interface{}) (streamOptions, map[string]interface{}) {
+	options := streamOptions{}
+	if !slices.ContainsFunc(streamArgKeys, func(key string) bool {
+		_, ok := args[key]
+		return ok
+	}) {
+		return options, args
+	}
+	options.Enabled, _ = args["stream"].(bool)
+	switch limit := args["stream_max_tokens"].(type) {
+	case int:
+		options.MaxTokens = limit
+	case float64:
+		options.MaxTokens = int(limit)
+	}
+	stripped := maps.Clone(args)
+	for _, key := range streamArgKeys {
+		delete(stripped, key)
+	}
+	return options, stripped
+}
+
+// partialScanner checks the output of an LLM chunk by chunk and fails as soon as the output can no longer become a
+// valid answer.
+type partialScanner interface {
+	scan(chunk string) error
+}
+
+// streamingReader is implemented by readers that can check a partial response, readers that tolerate chatter around
+// the answer, e.g., the deepseek reader, do not implement it and only get the length limit.
+type streamingReader interface {
+	partialScanner() partialScanner
+}
+
+func (gr BasicLLMDeploymentReader) partialScanner() partialScanner {
+	return &jsonObjectScanner{}
+}
+
+func (gr GoJsonOllamaReader) partialScanner() partialScanner {
+	return &jsonObjectScanner{}
+}
+
+type jsonScanState int
+
+const (
+	scanStart jsonScanState = iota
+	scanFirstKey
+	scanNextKey
+	scanKey
+	scanColon
+	scanValueStart
+	scanValue
+	scanCommaOrEnd
+	scanDone
+)
+
+// jsonObjectScanner accepts the prefixes of a JSON object with string values, the answer the readers expect. It
+// fails on text before or after the object and on values that are not strings.
+type jsonObjectScanner struct {
+	state   jsonScanState
+	escaped bool
+	//characters scanned so far, for the error messages
+	offset int
+}
+
+func isJSONSpace(c rune) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+func (s *jsonObjectScanner) scan(chunk string) error {
+	for _, c := range chunk {
+		if err := s.step(c); err != nil {
+			return fmt.Errorf("%w at offset %d", err, s.offset)
+		}
+		s.offset++
+	}
+	return nil
+}
+
+func (s *jsonObjectScanner) step(c rune) error {
+	switch s.state {
+	case scanKey, scanValue:
+		switch {
+		case s.escaped:
+			s.escaped = false
+		case c == '\\':
+			s.escaped = true
+		case c == '"':
+			if s.state == scanKey {
+				s.state = scanColon
+			} else {
+				s.state = scanCommaOrEnd
+			}
+		case c < 0x20:
+			return fmt.Errorf("control character %q in string", c)
+		}
+		return nil
+	}
+	if isJSONSpace(c) {
+		return nil
+	}
+	switch s.state {
+	case scanStart:
+		if c != '{' {
+			return fmt.Errorf("unexpected %q before the JSON object", c)
+		}
+		s.state = scanFirstKey
+	case scanFirstKey, scanNextKey:
+		switch {
+		case c == '"':
+			s.state = scanKey
+		case c == '}' && s.state == scanFirstKey:
+			s.state = scanDone
+		default:
+			return fmt.Errorf("expected a file name, got %q", c)
+		}
+	case scanColon:
+		if c != ':' {
+			return fmt.Errorf("expected ':' after the file name, got %q", c)
+		}
+		s.state = scanValueStart
+	case scanValueStart:
+		if c != '"' {
+			return fmt.Errorf("expected the file content as string, got %q", c)
+		}
+		s.state = scanValue
+	case scanCommaOrEnd:
+		switch c {
+		case ',':
+			s.state = scanNextKey
+		case '}':
+			s.state = scanDone
+		default:
+			return fmt.Errorf("expected ',' or '}' after the file content, got %q", c)
+		}
+	case scanDone:
+		return fmt.Errorf("unexpected %q after the JSON object", c)
+	}
+	return nil
+}
+
+// streamMonitor checks the chunks of a streamed invocation, its observe method aborts the generation with an
+// LLMError once the output is off format or too long.
+type streamMonitor struct {
+	options  streamOptions
+	scanner  partialScanner
+	progress *JobProgress
+	tokens   int
+}
+
+func (cc *LLMConverter) streamMonitor(options streamOptions, progress *JobProgress) *streamMonitor {
+	monitor := &streamMonitor{options: options, progress: progress}
+	if reader, ok := cc.reader.(streamingReader); ok {
+		monitor.scanner = reader.partialScanner()
+	}
+	return monitor
+}
+
+// observe is called with each chunk of the output, a chunk is about a token.
+func (m *streamMonitor) observe(chunk string) error {
+	m.tokens++
+	m.progress.streamed(1)
+	if m.options.MaxTokens > 0 && m.tokens > m.options.MaxTokens {
+		return LLMError{error: fmt.Errorf("aborted generation: output exceeds %d tokens", m.options.MaxTokens)}
+	}
+	if m.scanner == nil {
+		return nil
+	}
+	if err := m.scanner.scan(chunk); err != nil {
+		return LLMError{error: fmt.Errorf("aborted generation after %d tokens: %w", m.tokens, err)}
+	}
+	return nil
+}
+
+// streamed is the number of tokens the invocation streamed, a nil monitor did not stream.
+func (m *streamMonitor) streamed() int {
+	if m == nil {
+		return 0
+	}
+	return m.tokens
+}
+
+// JobProgress is the progress of a running job, it is shared by the branches and candidates of the job and safe to
+// read while the job runs.
+type JobProgress struct {
+	mutex sync.Mutex
+	//task of the attempt that started last
+	Task    string `json:"task,omitempty"`
+	Attempt int    `json:"attempt,omitempty"`
+	//LLM invocations and their tokens, a resumed job continues the counts of its metrics
+	Invocations  int `json:"invocations"`
+	PromptTokens int `json:"prompt_tokens"`
+	EvalTokens   int `json:"eval_tokens"`
+	//tokens streamed by the invocations that are still running
+	StreamedTokens int       `json:"streamed_tokens"`
+	Updated        time.Time `json:"updated,omitempty"`
+}
+
+func newJobProgress(metrics *Metrics) *JobProgress {
+	return &JobProgress{
+		PromptTokens: metrics.ConversionPromptTokenCount,
+		EvalTokens:   metrics.ConversionEvalTokenCount,
+	}
+}
+
+// started records the start of a task attempt.
+func (p *JobProgress) started(task string, attempt int) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.Task, p.Attempt = task, attempt
+	p.Updated = time.Now()
+}
+
+func (p *JobProgress) streamed(tokens int) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.StreamedTokens += tokens
+	p.Updated = time.Now()
+}
+
+// invoked records a finished invocation, the tokens it streamed are replaced by the tokens it reported.
+func (p *JobProgress) invoked(streamed int, metrics Metrics) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.StreamedTokens -= streamed
+	p.Invocations++
+	p.PromptTokens += metrics.ConversionPromptTokenCount
+	p.EvalTokens += metrics.ConversionEvalTokenCount
+	p.Updated = time.Now()
+}
+
+// snapshot returns a copy of the progress.
+func (p *JobProgress) snapshot() *JobProgress {
+	if p == nil {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return &JobProgress{
+		Task:           p.Task,
+		Attempt:        p.Attempt,
+		Invocations:    p.Invocations,
+		PromptTokens:   p.PromptTokens,
+		EvalTokens:     p.EvalTokens,
+		StreamedTokens: p.StreamedTokens,
+		Updated:        p.Updated,
+	}
+}
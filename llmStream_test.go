@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestJSONObjectScanner(t *testing.T) {
+	cases := map[string]string{
+		`{"main.go": "package main\n\nfunc main() {\"}\"}", "go.mod": ""}`: "",
+		" \n{}\n":                      "",
+		`{"main.go": "package`:         "",
+		"Sure! Here is the code: {":    `unexpected 'S' before the JSON object at offset 0`,
+		"```json\n{":                   "before the JSON object",
+		`{"main.go": ["package"]}`:     "expected the file content as string",
+		`{"main.go": "package"} {}`:    `unexpected '{' after the JSON object at offset 23`,
+		`{"main.go" "package"}`:        "expected ':' after the file name",
+		"{\"main.go\": \"package\n\"}": "control character",
+	}
+	for input, expected := range cases {
+		scanner := &jsonObjectScanner{}
+		var err error
+		for _, c := range input {
+			if err = scanner.scan(string(c)); err != nil {
+				break
+			}
+		}
+		if expected == "" {
+			assert.NoError(t, err, input)
+		} else {
+			assert.ErrorContains(t, err, expected, input)
+		}
+	}
+}
+
+func streamServer(t *testing.T, content string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var received map[string]interface{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		assert.Equal(t, true, received["stream"])
+		assert.NotContains(t, received, "stream_max_tokens")
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, word := range strings.SplitAfter(content, " ") {
+			chunk, _ := json.Marshal(map[string]interface{}{
+				"choices": []map[string]interface{}{{"delta": map[string]string{"content": word}}},
+			})
+			_, _ = fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		_, _ = fmt.Fprint(w, `data: {"choices": [{"delta": {}, "finish_reason": "stop"}]}`+"\n\n")
+		_, _ = fmt.Fprint(w, `data: {"choices": [], "usage": {"prompt_tokens": 40, "completion_tokens": 12}}`+"\n\n")
+		_, _ = fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+}
+
+func streamPipeline(t *testing.T, args string) *Pipeline {
+	pipeline, err := PipelineReader(bytes.NewReader([]byte(`options:
+  model_name: "qwen2.5-coder"
+tasks:
+  - id: "root"
+    task: "llmTask"
+    maxRetryCount: 1
+    task_args:
+      prompt: "convert {{.code}}"
+      stream: true
+` + args)))
+	assert.NoError(t, err)
+	return pipeline
+}
+
+func TestStreamedInvocation(t *testing.T) {
+	convert := func(content string, args string) (*ConversionRequest, error) {
+		server := streamServer(t, content)
+		defer server.Close()
+		client, err := LLMClientFactories["openai"](map[string]interface{}{"OPENAI_BASE_URL": server.URL})
+		assert.NoError(t, err)
+		req := testRequest()
+		err = streamPipeline(t, args).Execute(&PipelineRunner{Context: context.Background(), client: client}, req)
+		return req, err
+	}
+
+	req, err := convert(`{"main.go": "package main // streamed"}`, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "package main // streamed", req.WorkingPackage.RootFile)
+	assert.Equal(t, 12, req.Metrics.ConversionEvalTokenCount)
+	progress := req.progress.snapshot()
+	assert.Equal(t, "root", progress.Task)
+	assert.Equal(t, 1, progress.Invocations)
+	assert.Equal(t, 40, progress.PromptTokens)
+	assert.Equal(t, 12, progress.EvalTokens)
+	assert.Equal(t, 0, progress.StreamedTokens)
+
+	req, err = convert(`Sure! Here is the converted code: {"main.go": "package main"}`, "")
+	assert.ErrorContains(t, err, `aborted generation after 1 tokens: unexpected 'S' before the JSON object`)
+	assert.True(t, LLMContentFailure.matches(err))
+	assert.Equal(t, 1, req.Metrics.ConversionEvalTokenCount)
+	assert.Equal(t, 0, req.progress.snapshot().StreamedTokens)
+
+	_, err = convert(`{"main.go": "package main // this output runs away"}`, "      stream_max_tokens: 3\n")
+	assert.ErrorContains(t, err, "aborted generation: output exceeds 3 tokens")
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	log "github.com/sirupsen/logrus"
+	"os"
 	"strings"
 	"unicode"
 )
@@ -10,6 +11,12 @@ const OLLAMA_API_URL = "http://localhost:11434"
 
 func main() {
 	log.SetLevel(log.DebugLevel)
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	err := MakeConverterService()
 	if err != nil {
 		panic(err)
@@ -4,14 +4,20 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/exp/maps"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -60,7 +66,7 @@ func TestJsonPipelineReader(t *testing.T) {
 			assert.True(t, slices.Contains(keys, "model_name"))
 			t.Logf("%v", keys)
 		}
-		t.Logf("%v/%v", task.RetryCount, task.MaxRetryCount)
+		t.Logf("%s: %v", task.ID, task.MaxRetryCount)
 		assert.GreaterOrEqual(t, task.MaxRetryCount, 1)
 	}
 
@@ -74,10 +80,13 @@ func TestFullConversion(t *testing.T) {
 
 	log.SetLevel(log.DebugLevel)
 	cc, err := MakeCodeConverter(&ConverterOptions{
-		"http://swkgpu1.informatik.uni-hamburg.de:11434",
-	}, pipeline)
+		Args: map[string]any{
+			"OLLAMA_API_URL": "http://swkgpu1.informatik.uni-hamburg.de:11434",
+		},
+	})
 
 	assert.Nil(t, err)
+	cc.pipeline = pipeline
 
 	req, err := cc.ConvertFromFileBest("test/f5.zip")
 	assert.NoError(t, err)
@@ -153,7 +162,6 @@ func testCompileByResponseLog(t *testing.T, test_case string) {
 		ID:            "test",
 		Execute:       makeGolangBuilder(nil),
 		CanApply:      nil,
-		RetryCount:    0,
 		MaxRetryCount: 1,
 		RetryDelay:    0,
 		Next:          nil,
@@ -235,8 +243,10 @@ func validateFromFolder(t *testing.T, dir string) {
 	for _, file := range files {
 		t.Run(fmt.Sprintf("%s_%s", experiment, file), func(t *testing.T) {
 			cc, err := MakeCodeConverter(&ConverterOptions{
-				OLLAMA_API_URL,
-			}, nil)
+				Args: map[string]any{
+					"OLLAMA_API_URL": OLLAMA_API_URL,
+				},
+			})
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -255,7 +265,6 @@ func validateFromFolder(t *testing.T, dir string) {
 				ID:            "test",
 				Execute:       makeGolangBuilder(nil),
 				CanApply:      nil,
-				RetryCount:    0,
 				MaxRetryCount: 1,
 				RetryDelay:    0,
 				Next:          nil,
@@ -316,3 +325,57 @@ func TestDeepSeekReader(t *testing.T) {
 
 	assert.Contains(t, result.RootFile, "handle")
 }
+
+func TestResumableJobsAreBounded(t *testing.T) {
+	service := &ConverterService{finished: make(map[uuid.UUID]*ConversionRequest), resumable: 2}
+	jobs := []*ConversionRequest{testRequest(), testRequest(), testRequest()}
+	for _, job := range jobs {
+		service.keepFinished(job)
+	}
+	assert.NotContains(t, service.finished, jobs[0].Id)
+	assert.Len(t, service.finished, 2)
+
+	resumed, ok := service.takeFinished(jobs[1].Id)
+	assert.True(t, ok)
+	service.keepFinished(testRequest())
+	service.keepFinished(resumed)
+	assert.Equal(t, []uuid.UUID{jobs[1].Id}, service.finishedOrder[1:])
+	assert.NotContains(t, service.finished, jobs[2].Id)
+}
+
+func TestFailedResumeKeepsTheJob(t *testing.T) {
+	pipeline := branchPipeline(JoinSequential, branch("fix", &NoOpConverter{}))
+	pipeline.FirstTask.OnFailure = branch("recover", &NoOpConverter{})
+	service := &ConverterService{
+		converter:    &PipelineRunner{Context: context.Background(), pipeline: pipeline},
+		requestQueue: make(chan *ConversionRequest, 1),
+		results:      make(map[uuid.UUID]*ConversionRequest),
+		finished:     make(map[uuid.UUID]*ConversionRequest),
+		active:       make(map[uuid.UUID]*activeJob),
+		resumable:    1,
+	}
+	job := testRequest()
+	job.Completed = true
+	service.keepFinished(job)
+
+	resume := func(task string) int {
+		form := url.Values{"task": {task}, "model": {"other"}}
+		r := httptest.NewRequest(http.MethodPost, "/"+job.Id.String()+"/resume", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r = mux.SetURLVars(r, map[string]string{"uuid": job.Id.String()})
+		w := httptest.NewRecorder()
+		service.resumeHandler(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, resume("recover"))
+	assert.Contains(t, service.finished, job.Id)
+	assert.Nil(t, job.Overrides)
+	assert.Empty(t, job.Metrics.Resumes)
+
+	assert.Equal(t, http.StatusAccepted, resume("fix"))
+	assert.NotContains(t, service.finished, job.Id)
+	assert.Same(t, job, <-service.requestQueue)
+	assert.Equal(t, "other", job.Overrides["model_name"])
+	assert.Equal(t, []string{"root", "fix"}, job.checkpoint.Path)
+}
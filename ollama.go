@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ollama/ollama/api"
 	log "github.com/sirupsen/logrus"
@@ -12,13 +13,12 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 )
 
 type OllamaInvocationClient struct {
-	ModelName      string
-	RequestOptions map[string]interface{}
-	client         *api.Client
+	client *api.Client
 }
 
 var llmOutputSchema = json.RawMessage(`{
@@ -45,11 +45,15 @@ func (llm *OllamaInvocationClient) Configure(args map[string]interface{}) error
 	return nil
 }
 
-func (llm *OllamaInvocationClient) Prepare(args map[string]interface{}) error {
-	model, ok := args["model_name"]
-	if !ok {
-		log.Fatal("model_name must be a string")
-		return nil
+// requestOptions returns the model and the request options of the invocation in the context.
+func (llm *OllamaInvocationClient) requestOptions(ctx context.Context) (string, map[string]interface{}, error) {
+	return ollamaOptions(invocationOf(ctx).Args)
+}
+
+func ollamaOptions(args map[string]interface{}) (string, map[string]interface{}, error) {
+	model, ok := args["model_name"].(string)
+	if !ok || model == "" {
+		return "", nil, fmt.Errorf("model_name required")
 	}
 
 	nargs := make(map[string]interface{})
@@ -70,15 +74,12 @@ func (llm *OllamaInvocationClient) Prepare(args map[string]interface{}) error {
 	}
 	maps.Insert(nargs, maps.All(defaultParams))
 
-	llm.ModelName = model.(string)
-	llm.RequestOptions = nargs
-
-	return nil
+	return model, nargs, nil
 }
 
-func (llm *OllamaInvocationClient) logLLMResponse(args ...string) {
+func (llm *OllamaInvocationClient) logLLMResponse(ctx context.Context, args ...string) {
 	fhash := []byte(args[0])
-	fname := fmt.Sprintf("chatlogs/%s_%8x_%d.log", llm.ModelName, sha256.Sum256(fhash), time.Now().UnixMicro())
+	fname := fmt.Sprintf("chatlogs/%s_%8x_%d.log", invocationModel(ctx, ""), sha256.Sum256(fhash), time.Now().UnixMicro())
 	logf, err := os.OpenFile(fname,
 		os.O_CREATE|os.O_RDWR, 0644)
 	defer logf.Close()
@@ -102,32 +103,30 @@ func (llm *OllamaInvocationClient) InvokeLLM(runner context.Context, buf bytes.B
 		return "", metrics, fmt.Errorf("LLM client not initialized")
 	}
 
+	model, options, err := llm.requestOptions(runner)
+	if err != nil {
+		return "", metrics, err
+	}
 	steam := new(bool)
 	req := api.GenerateRequest{
-		Model:   llm.ModelName,
+		Model:   model,
 		Prompt:  buf.String(),
 		Stream:  steam,
-		Options: llm.RequestOptions,
+		Options: options,
 		Format:  llmOutputSchema,
 	}
 
-	callback := make(chan api.GenerateResponse)
-	//TODO: make configurable
-	deadline, cancel := context.WithDeadline(runner, time.Now().Add(time.Minute*5))
+	deadline, cancel := invocationContext(runner)
 	defer cancel()
-	go func() {
-		err := llm.client.Generate(deadline, &req, func(gr api.GenerateResponse) error {
-			callback <- gr
-			return nil
-		})
-		if err != nil {
-			callback <- api.GenerateResponse{
-				DoneReason: err.Error(),
-			}
-		}
-	}()
+	if observe := invocationOf(runner).observe; observe != nil {
+		return llm.stream(deadline, &req, observe)
+	}
 
-	response := <-callback
+	var response api.GenerateResponse
+	err = llm.client.Generate(deadline, &req, func(gr api.GenerateResponse) error {
+		response = gr
+		return nil
+	})
 
 	metrics.ConversionTime += response.TotalDuration
 	metrics.ConversionPromptTime += response.PromptEvalDuration
@@ -135,9 +134,60 @@ func (llm *OllamaInvocationClient) InvokeLLM(runner context.Context, buf bytes.B
 	metrics.ConversionPromptTokenCount += response.PromptEvalCount
 	metrics.ConversionEvalTokenCount += response.EvalCount
 
+	if err != nil {
+		return "", metrics, ollamaError(err)
+	}
 	if response.Response == "" {
-		return "", metrics, fmt.Errorf("response is empty - %s", response.DoneReason)
+		return "", metrics, llmContentError(fmt.Errorf("response is empty - %s", response.DoneReason))
 	}
 
 	return response.Response, metrics, nil
 }
+
+// stream generates the response chunk by chunk, an error of observe stops the generation. The metrics are reported
+// with the last chunk, an aborted generation counts the chunks it received as eval tokens.
+func (llm *OllamaInvocationClient) stream(ctx context.Context, req *api.GenerateRequest, observe func(string) error) (string, Metrics, error) {
+	var metrics = Metrics{}
+	streaming := true
+	req.Stream = &streaming
+
+	var response strings.Builder
+	var last api.GenerateResponse
+	chunks := 0
+	start := time.Now()
+	err := llm.client.Generate(ctx, req, func(gr api.GenerateResponse) error {
+		last = gr
+		if gr.Response == "" {
+			return nil
+		}
+		chunks++
+		response.WriteString(gr.Response)
+		return observe(gr.Response)
+	})
+	if !last.Done {
+		metrics.ConversionTime += time.Since(start)
+		metrics.ConversionEvalTokenCount += chunks
+	} else {
+		metrics.ConversionTime += last.TotalDuration
+		metrics.ConversionPromptTime += last.PromptEvalDuration
+		metrics.ConversionEvalTime += last.EvalDuration
+		metrics.ConversionPromptTokenCount += last.PromptEvalCount
+		metrics.ConversionEvalTokenCount += last.EvalCount
+	}
+	if err != nil {
+		return "", metrics, ollamaError(err)
+	}
+	if response.Len() == 0 {
+		return "", metrics, llmContentError(fmt.Errorf("response is empty - %s", last.DoneReason))
+	}
+	return response.String(), metrics, nil
+}
+
+// ollamaError classifies a failed generation, the ollama API reports failed HTTP responses as StatusError.
+func ollamaError(err error) error {
+	var status api.StatusError
+	if errors.As(err, &status) {
+		return llmStatusError(status.StatusCode, err)
+	}
+	return classifyLLMError(err)
+}
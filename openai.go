@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// OpenAIInvocationClient talks to servers with the OpenAI chat completions API, e.g., vLLM or the llama.cpp server.
+type OpenAIInvocationClient struct {
+	BaseURL string
+	apiKey  string
+	//model of OPENAI_MODEL, used if the pipeline does not set model_name
+	defaultModel string
+	client       *http.Client
+}
+
+// openAIRequestOptions are the pipeline options passed on to the chat completions request, other options are
+// dropped since most servers reject unknown fields. vLLM and llama.cpp also accept the sampling options of Ollama.
+var openAIRequestOptions = []string{
+	"temperature", "top_p", "top_k", "min_p", "seed", "stop", "max_tokens", "max_completion_tokens",
+	"presence_penalty", "frequency_penalty", "repeat_penalty", "repetition_penalty",
+}
+
+func (llm *OpenAIInvocationClient) Configure(args map[string]interface{}) error {
+	llm.BaseURL = "http://localhost:8000/v1"
+	if baseURL, ok := args["OPENAI_BASE_URL"].(string); ok && baseURL != "" {
+		llm.BaseURL = strings.TrimSuffix(baseURL, "/")
+	}
+	if key, ok := args["OPENAI_API_KEY"].(string); ok {
+		llm.apiKey = key
+	}
+	if model, ok := args["OPENAI_MODEL"].(string); ok {
+		llm.defaultModel = model
+	}
+	if llm.client == nil {
+		llm.client = &http.Client{}
+	}
+	return nil
+}
+
+// requestOptions returns the model and the request options of the invocation in the context.
+func (llm *OpenAIInvocationClient) requestOptions(ctx context.Context) (string, map[string]interface{}, error) {
+	return llm.options(invocationOf(ctx).Args)
+}
+
+func (llm *OpenAIInvocationClient) options(args map[string]interface{}) (string, map[string]interface{}, error) {
+	model := llm.defaultModel
+	if name, ok := args["model_name"].(string); ok {
+		model = name
+	}
+	if model == "" {
+		return "", nil, fmt.Errorf("model_name or OPENAI_MODEL required")
+	}
+
+	nargs := map[string]interface{}{
+		"max_tokens":      2 << 14,
+		"response_format": "json_object",
+	}
+	for _, key := range openAIRequestOptions {
+		if value, ok := args[key]; ok {
+			nargs[key] = value
+		}
+	}
+	if value, ok := args["num_predict"]; ok {
+		nargs["max_tokens"] = value
+	}
+	for _, key := range []string{"response_format", "system"} {
+		if value, ok := args[key]; ok {
+			nargs[key] = value
+		}
+	}
+	return model, nargs, nil
+}
+
+// responseFormat translates the response_format option: json_object, json_schema with the schema of the LLM output,
+// text, or an object that is sent as it is.
+func responseFormat(option interface{}) (interface{}, error) {
+	switch format := option.(type) {
+	case map[string]interface{}:
+		return format, nil
+	case string:
+		switch format {
+		case "json_object", "json", "":
+			return map[string]interface{}{"type": "json_object"}, nil
+		case "json_schema":
+			return map[string]interface{}{
+				"type": "json_schema",
+				"json_schema": map[string]interface{}{
+					"name":   "deployment_package",
+					"schema": llmOutputSchema,
+				},
+			}, nil
+		case "text":
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown response_format: %v", option)
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// openAIResponse is the chat completion, or a chunk of it if the response is streamed.
+type openAIResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+		//output of a chunk
+		Delta        openAIMessage `json:"delta"`
+		FinishReason string        `json:"finish_reason"`
+	} `json:"choices"`
+	Usage struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	//reported by the llama.cpp server
+	Timings *struct {
+		PromptMS    float64 `json:"prompt_ms"`
+		PredictedMS float64 `json:"predicted_ms"`
+	} `json:"timings,omitempty"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+func (llm *OpenAIInvocationClient) logLLMResponse(ctx context.Context, args ...string) {
+	fhash := []byte(args[0])
+	fname := fmt.Sprintf("chatlogs/%s_%8x_%d.log", strings.ReplaceAll(invocationModel(ctx, llm.defaultModel), "/", "_"), sha256.Sum256(fhash), time.Now().UnixMicro())
+	logf, err := os.OpenFile(fname,
+		os.O_CREATE|os.O_RDWR, 0644)
+	defer logf.Close()
+	written := 0
+	if err == nil {
+		_, _ = logf.WriteString("# Query\n\n")
+		wr, _ := logf.WriteString(args[1])
+		written += wr
+		_, _ = logf.WriteString("\n\n# Response\n\n```\n")
+		wr, _ = logf.WriteString(args[2])
+		written += wr
+		_, _ = logf.WriteString("\n```\n")
+	}
+	log.Debugf("logged llm response to: %s with %d bytes", fname, written)
+}
+
+func (llm *OpenAIInvocationClient) InvokeLLM(runner context.Context, buf bytes.Buffer) (string, Metrics, error) {
+	var metrics = Metrics{}
+	if llm.client == nil {
+		return "", metrics, fmt.Errorf("LLM client not initialized")
+	}
+
+	model, options, err := llm.requestOptions(runner)
+	if err != nil {
+		return "", metrics, err
+	}
+	body := make(map[string]interface{})
+	maps.Copy(body, options)
+	delete(body, "system")
+	messages := make([]openAIMessage, 0, 2)
+	if system, ok := options["system"].(string); ok && system != "" {
+		messages = append(messages, openAIMessage{Role: "system", Content: system})
+	}
+	messages = append(messages, openAIMessage{Role: "user", Content: buf.String()})
+	body["model"] = model
+	body["messages"] = messages
+	observe := invocationOf(runner).observe
+	body["stream"] = observe != nil
+	if observe != nil {
+		body["stream_options"] = map[string]interface{}{"include_usage": true}
+	}
+	format, err := responseFormat(options["response_format"])
+	if err != nil {
+		return "", metrics, err
+	}
+	if format != nil {
+		body["response_format"] = format
+	} else {
+		delete(body, "response_format")
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", metrics, err
+	}
+
+	deadline, cancel := invocationContext(runner)
+	defer cancel()
+	req, err := http.NewRequestWithContext(deadline, http.MethodPost, llm.BaseURL+"/chat/completions", bytes.NewReader(data))
+	if err != nil {
+		return "", metrics, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if llm.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+llm.apiKey)
+	}
+
+	start := time.Now()
+	resp, err := llm.client.Do(req)
+	if err != nil {
+		return "", metrics, llmTransportError(err)
+	}
+	defer resp.Body.Close()
+	if observe != nil && resp.StatusCode == http.StatusOK {
+		return llm.stream(resp.Body, start, observe)
+	}
+	raw, err := io.ReadAll(resp.Body)
+	metrics.ConversionTime += time.Since(start)
+	if err != nil {
+		return "", metrics, llmTransportError(err)
+	}
+
+	var response openAIResponse
+	decodeErr := json.Unmarshal(raw, &response)
+	if resp.StatusCode != http.StatusOK {
+		message := strings.TrimSpace(string(raw))
+		if decodeErr == nil && response.Error != nil {
+			message = response.Error.Message
+		}
+		return "", metrics, llmStatusError(resp.StatusCode, fmt.Errorf("chat completion failed with %s - %s", resp.Status, message))
+	}
+	if decodeErr != nil {
+		return "", metrics, llmContentError(fmt.Errorf("invalid chat completion response: %w", decodeErr))
+	}
+
+	response.addMetrics(&metrics)
+
+	if len(response.Choices) == 0 || response.Choices[0].Message.Content == "" {
+		reason := "no choices"
+		if len(response.Choices) > 0 {
+			reason = response.Choices[0].FinishReason
+		}
+		return "", metrics, llmContentError(fmt.Errorf("response is empty - %s", reason))
+	}
+
+	return response.Choices[0].Message.Content, metrics, nil
+}
+
+func (response *openAIResponse) addMetrics(metrics *Metrics) {
+	metrics.ConversionPromptTokenCount += response.Usage.PromptTokens
+	metrics.ConversionEvalTokenCount += response.Usage.CompletionTokens
+	if response.Timings != nil {
+		metrics.ConversionPromptTime += time.Duration(response.Timings.PromptMS * float64(time.Millisecond))
+		metrics.ConversionEvalTime += time.Duration(response.Timings.PredictedMS * float64(time.Millisecond))
+	}
+}
+
+// stream reads the server-sent events of a streamed chat completion, an error of observe stops reading and closes
+// the connection. The usage is reported with the last chunk, an aborted completion counts the chunks it received as
+// eval tokens.
+func (llm *OpenAIInvocationClient) stream(body io.Reader, start time.Time, observe func(string) error) (string, Metrics, error) {
+	var metrics = Metrics{}
+	var content strings.Builder
+	chunks := 0
+	reason := "no choices"
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1<<20)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var chunk openAIResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return "", metrics, llmContentError(fmt.Errorf("invalid chat completion chunk: %w", err))
+		}
+		if chunk.Error != nil {
+			return "", metrics, llmContentError(fmt.Errorf("chat completion failed - %s", chunk.Error.Message))
+		}
+		chunk.addMetrics(&metrics)
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		if chunk.Choices[0].FinishReason != "" {
+			reason = chunk.Choices[0].FinishReason
+		}
+		if delta := chunk.Choices[0].Delta.Content; delta != "" {
+			chunks++
+			content.WriteString(delta)
+			if err := observe(delta); err != nil {
+				metrics.ConversionTime += time.Since(start)
+				metrics.ConversionEvalTokenCount += chunks
+				return "", metrics, err
+			}
+		}
+	}
+	metrics.ConversionTime += time.Since(start)
+	if err := scanner.Err(); err != nil {
+		return "", metrics, classifyLLMError(err)
+	}
+	if content.Len() == 0 {
+		return "", metrics, llmContentError(fmt.Errorf("response is empty - %s", reason))
+	}
+	return content.String(), metrics, nil
+}
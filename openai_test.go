@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOpenAIClient(t *testing.T) {
+	var received map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		if received["model"] == "missing" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error": {"message": "model missing does not exist"}}`))
+			return
+		}
+		if received["model"] == "overloaded" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{
+  "choices": [{"message": {"role": "assistant", "content": "{\"main.go\": \"package main\"}"}, "finish_reason": "stop"}],
+  "usage": {"prompt_tokens": 120, "completion_tokens": 30},
+  "timings": {"prompt_ms": 250, "predicted_ms": 1500}
+}`))
+	}))
+	defer server.Close()
+
+	client, err := LLMClientFactories["openai"](map[string]interface{}{
+		"OPENAI_BASE_URL": server.URL + "/v1/",
+		"OPENAI_API_KEY":  "secret",
+	})
+	assert.NoError(t, err)
+	invoke := func(args map[string]interface{}) (string, Metrics, error) {
+		ctx := withInvocation(t.Context(), &llmInvocation{Args: args})
+		return client.InvokeLLM(ctx, *bytes.NewBufferString("convert this"))
+	}
+
+	response, metrics, err := invoke(map[string]interface{}{
+		"model_name":      "qwen2.5-coder",
+		"temperature":     0.2,
+		"num_ctx":         32768,
+		"num_predict":     512,
+		"response_format": "json_schema",
+		"system":          "Only answer with JSON.",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"main.go": "package main"}`, response)
+	assert.Equal(t, 120, metrics.ConversionPromptTokenCount)
+	assert.Equal(t, 30, metrics.ConversionEvalTokenCount)
+	assert.Equal(t, 1500*time.Millisecond, metrics.ConversionEvalTime)
+	assert.Equal(t, 250*time.Millisecond, metrics.ConversionPromptTime)
+
+	assert.Equal(t, "qwen2.5-coder", received["model"])
+	assert.Equal(t, 0.2, received["temperature"])
+	assert.Equal(t, 512.0, received["max_tokens"])
+	assert.NotContains(t, received, "num_ctx")
+	assert.NotContains(t, received, "system")
+	assert.Equal(t, "json_schema", received["response_format"].(map[string]interface{})["type"])
+	messages := received["messages"].([]interface{})
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "system", messages[0].(map[string]interface{})["role"])
+	assert.Equal(t, "convert this", messages[1].(map[string]interface{})["content"])
+
+	_, _, err = invoke(map[string]interface{}{"model_name": "qwen2.5-coder:32b", "temperature": 0.7})
+	assert.NoError(t, err)
+	assert.Equal(t, "qwen2.5-coder:32b", received["model"])
+	assert.Equal(t, 0.7, received["temperature"])
+	assert.NotContains(t, received, "system")
+
+	_, _, err = invoke(map[string]interface{}{"model_name": "missing"})
+	assert.ErrorContains(t, err, "model missing does not exist")
+	assert.True(t, LLMContentFailure.matches(err))
+	_, _, err = invoke(map[string]interface{}{"model_name": "overloaded"})
+	assert.True(t, LLMTransportFailure.matches(err))
+	assert.Equal(t, "json_object", received["response_format"].(map[string]interface{})["type"])
+
+	_, _, err = invoke(map[string]interface{}{})
+	assert.ErrorContains(t, err, "model_name or OPENAI_MODEL required")
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"runtime/debug"
@@ -13,15 +15,45 @@ func NewPipeline(firstTask *ConversionTask) *Pipeline {
 }
 
 // Execute runs the pipeline
-func (p *Pipeline) Execute(runner *PipelineRunner, req *ConversionRequest) (out error) {
-	err := p.reset()
-	if err != nil {
-		return err
+func (p *Pipeline) Execute(runner *PipelineRunner, req *ConversionRequest) error {
+	return p.run(runner, req, func() error {
+		req.path = nil
+		return p.executeNext(runner, req, p.FirstTask)
+	})
+}
+
+// run resets the pipeline and executes the given entry point within the job deadline
+func (p *Pipeline) run(runner *PipelineRunner, req *ConversionRequest, entry func() error) (out error) {
+	req.attempts = make(map[*ConversionTask]int)
+	req.retries = make(map[*ConversionTask]map[ErrorClass]int)
+	defer func() {
+		runner.emit(PipelineFinished{
+			EventHeader: eventHeader(req, nil),
+			Err:         out,
+			Metrics:     *req.Metrics,
+		})
+	}()
+	if req.Metrics.StartTime.IsZero() {
+		req.Metrics.StartTime = time.Now()
+	}
+	req.budget = newJobBudget(p, req.Metrics)
+	if req.progress == nil {
+		req.progress = newJobProgress(req.Metrics)
+	}
+	if req.Trace == nil {
+		req.Trace = newSpan(SpanJob, "")
+	}
+	req.span = req.Trace
+	if len(req.Revisions) == 0 {
+		req.recordRevision("", 0)
 	}
-	req.Metrics.StartTime = time.Now()
 	defer func() {
+		req.Metrics.ActiveTime = req.budget.elapsed()
+		req.budget = nil
 		req.Metrics.EndTime = time.Now()
 		req.Metrics.TotalTime = req.Metrics.EndTime.Sub(req.Metrics.StartTime)
+		req.Trace.end()
+		req.span = nil
 	}()
 	defer func() {
 		if err := recover(); err != nil {
@@ -29,99 +61,207 @@ func (p *Pipeline) Execute(runner *PipelineRunner, req *ConversionRequest) (out
 			out = fmt.Errorf("%v\n%s", err, string(debug.Stack()))
 		}
 	}()
-	out = p.executeTask(runner, req, p.FirstTask)
+	deadlineExceeded := false
+	out = runner.withTimeout(p.Deadline, "job", func() error {
+		err := entry()
+		deadlineExceeded = errors.Is(runner.Err(), context.DeadlineExceeded)
+		return err
+	})
+	if deadlineExceeded {
+		log.Errorf("job %s exceeded the deadline of %s", req.Id, p.Deadline)
+		req.Metrics.DeadlineExceeded = true
+	}
+	if jump, ok := asLoopJump(out); ok {
+		out = fmt.Errorf("loop target %s of task %s is not an ancestor of the task", jump.target, jump.from)
+	}
 	return out
 }
 
-func (p *Pipeline) reset() error {
-	return p.resetTask(p.FirstTask)
+// apply runs a converter of the task, limited by the task timeout
+func (p *Pipeline) apply(runner *PipelineRunner, req *ConversionRequest, task *ConversionTask, converter Converter) error {
+	err := runner.withTimeout(task.Timeout, fmt.Sprintf("task %s", task.ID), func() error {
+		return converter.Apply(runner, req)
+	})
+	var timeout TimeoutError
+	if errors.As(err, &timeout) {
+		log.Errorf("%v", err)
+		req.Metrics.Timeouts++
+	}
+	return err
 }
 
-func (p *Pipeline) resetTask(task *ConversionTask) error {
+// executeNext enters a task of the normal execution flow, the job is checkpointed before the task starts
+func (p *Pipeline) executeNext(runner *PipelineRunner, req *ConversionRequest, task *ConversionTask) error {
 	if task == nil {
 		return nil
 	}
+	req.path = append(req.path, task.ID)
+	defer func() {
+		req.path = req.path[:len(req.path)-1]
+	}()
+	p.checkpoint(runner, req)
+	return p.executeTask(runner, req, task)
+}
 
-	task.RetryCount = 0
-
-	if task.OnFailure != nil {
-		err := p.resetTask(task.OnFailure)
-		if err != nil {
-			return err
-		}
-	}
-
-	for _, next := range task.Next {
-		err := p.resetTask(next)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-
+// executeRecovery runs a recovery task, which is part of the attempt of the task it recovers
+func (p *Pipeline) executeRecovery(runner *PipelineRunner, req *ConversionRequest, task *ConversionTask, recovery *ConversionTask, cause error) error {
+	runner.emit(RecoveryStarted{
+		EventHeader: eventHeader(req, task),
+		Attempt:     req.attempt(task),
+		RecoveryID:  recovery.ID,
+		Err:         cause,
+	})
+	req.nested++
+	defer func() {
+		req.nested--
+	}()
+	return p.executeTask(runner, req, recovery)
 }
 
-// executeTask runs an individual task with retry logic and failure handling
+// executeTask runs an individual task and restarts it whenever a loop jumps back to it
 func (p *Pipeline) executeTask(runner *PipelineRunner, req *ConversionRequest, task *ConversionTask) error {
 	if task == nil {
 		log.Debugf("Task is nil. Skipping")
 		return nil
 	}
+	for {
+		err := p.runTask(runner, req, task)
+		if jump, ok := asLoopJump(err); ok && jump.target == task.ID {
+			log.Debugf("restarting task %s for loop of %s", task.ID, jump.from)
+			req.resetAttempts(task)
+			req.restartLoops(task, jump)
+			continue
+		}
+		return err
+	}
+}
+
+// runTask runs an individual task with retry logic and failure handling
+func (p *Pipeline) runTask(runner *PipelineRunner, req *ConversionRequest, task *ConversionTask) error {
+	if err := runner.Err(); err != nil {
+		log.Debugf("skipping task %s - %v", task.ID, err)
+		return err
+	}
+	if err := req.budget.check(task); err != nil {
+		return req.exceedBudget(err)
+	}
 	log.Debugf("starting %s", task.ID)
 	req.Metrics.Tasks += 1
+	started := time.Now()
+	runner.emit(TaskStarted{EventHeader: eventHeader(req, task), Attempt: req.attempt(task)})
+	span := req.openSpan(task)
+	defer func() {
+		req.closeSpan(span)
+	}()
 
 	if task.CanApply != nil {
-		if applyErr := task.CanApply.Apply(runner, req); applyErr != nil {
+		if applyErr := p.apply(runner, req, task, task.CanApply); applyErr != nil {
 			log.Errorf("failed to apply task %s: %s", task.ID, applyErr)
-			return fmt.Errorf("task %s precondition failed - %v", task.ID, applyErr)
+			err := PreconditionError{fmt.Errorf("task %s precondition failed - %v", task.ID, applyErr)}
+			runner.emit(AttemptFailed{EventHeader: eventHeader(req, task), Attempt: req.attempt(task), Err: err})
+			span.fail(err)
+			if recovery := task.route(err); recovery != nil && req.retryable(task, err) {
+				req.err = append(req.err, err)
+				log.Debugf("atempting to restore precondition of task %s with %s", task.ID, recovery.ID)
+				if recoveryErr := p.executeRecovery(runner, req, task, recovery, err); recoveryErr != nil {
+					return recoveryErr
+				}
+				req.failAttempt(task, err)
+				req.closeSpan(span)
+				return p.executeTask(runner, req, task)
+			}
+			return err
 		}
 	}
 
 	var err error
 	var workingPackage *DeploymentPackage = nil
+	var sampled *sampledValidation
 	if task.Execute != nil {
-		log.Debugf("Running task %s with (%d - %d) executions", task.ID, task.RetryCount, task.MaxRetryCount)
-		for ; task.RetryCount < task.MaxRetryCount; task.RetryCount++ {
+		log.Debugf("Running task %s with (%d - %d) executions", task.ID, req.spent(task), task.MaxRetryCount)
+		for tries := 0; req.spent(task) < task.MaxRetryCount; {
+			if tries > 0 {
+				if err = req.budget.check(task); err != nil {
+					err = req.exceedBudget(err)
+					break
+				}
+				req.closeSpan(span)
+				span = req.openSpan(task)
+			}
+			tries++
 			if req.WorkingPackage != nil {
 				workingPackage = req.WorkingPackage.copy()
 			}
-			err = task.Execute.Apply(runner, req)
+			req.progress.started(task.ID, req.attempt(task))
+			err = p.execute(runner, req, task)
+			sampled, req.sampled = req.sampled, nil
 			if err == nil {
 				log.Debugf("task %s executed successfully", task.ID)
 				break
 			}
-			log.Debugf("task %s retry (%d) failed - %s", task.ID, task.RetryCount, err)
-			if task.RetryCount+1 < task.MaxRetryCount {
+			if pause, ok := asReviewPause(err); ok {
+				pause.checkpoint = makeCheckpoint(p, runner, req)
+				runner.emit(ReviewRequested{EventHeader: eventHeader(req, task)})
+				return err
+			}
+			log.Debugf("task %s retry (%d) failed - %s", task.ID, req.attempt(task), err)
+			runner.emit(AttemptFailed{EventHeader: eventHeader(req, task), Attempt: req.attempt(task), Err: err})
+			span.fail(err)
+			if runner.Err() != nil {
+				log.Debugf("task %s was canceled", task.ID)
+				break
+			}
+			failure := err
+			retry := req.retryable(task, failure)
+			if retry {
 				log.Errorf("task %s retrying...", task.ID)
 
-				if task.OnFailure != nil {
+				if recovery := task.recoveryFor(err); recovery != nil {
 					req.err = append(req.err, err)
-					log.Debugf("atempting to recover task %s before retring", task.ID)
-					err = p.executeTask(runner, req, task.OnFailure)
+					log.Debugf("atempting to recover task %s with %s before retring", task.ID, recovery.ID)
+					err = p.executeRecovery(runner, req, task, recovery, err)
+					if _, ok := asLoopJump(err); ok {
+						return err
+					}
 					if err == nil {
 						// Continue to next retry attempt of TaskB without exceeding max retries
 						log.Debugf("Retrying failed task %s after recovery", task.ID)
+						req.failAttempt(task, failure)
+						runner.emit(RetryScheduled{EventHeader: eventHeader(req, task), Attempt: req.attempt(task)})
 						continue
 					} else {
 						log.Debugf("Recovery failed.")
 						break
 					}
 				}
-				time.Sleep(task.RetryDelay)
+				delay := req.retryDelay(task, failure)
+				runner.emit(RetryScheduled{EventHeader: eventHeader(req, task), Attempt: req.attempt(task) + 1, Delay: delay})
+				if !runner.dryRun {
+					select {
+					case <-runner.Done():
+					case <-time.After(delay):
+					}
+				}
 			}
 			//recover working package
 			if req.WorkingPackage != nil && task.CanApply != nil {
-				err := task.CanApply.Apply(runner, req)
+				err := p.apply(runner, req, task, task.CanApply)
 				if err != nil {
 					log.Errorf("the task coruppted the working package, recovering latest version.")
 					if workingPackage != nil {
 						req.WorkingPackage = workingPackage
+						runner.emit(WorkingPackageRolledBack{EventHeader: eventHeader(req, task), Attempt: req.attempt(task)})
 					}
 				}
 			} else if req.WorkingPackage == nil && workingPackage != nil {
 				log.Debugf("the task coruppted the working package, recovering latest version.")
 				req.WorkingPackage = workingPackage
+				runner.emit(WorkingPackageRolledBack{EventHeader: eventHeader(req, task), Attempt: req.attempt(task)})
+			}
+			req.failAttempt(task, failure)
+			if !retry {
+				log.Debugf("task %s has no retries left for %v", task.ID, failure)
+				break
 			}
 		}
 
@@ -135,13 +275,28 @@ func (p *Pipeline) executeTask(runner *PipelineRunner, req *ConversionRequest, t
 	}
 
 	if task.Validation != nil {
-		log.Debugf("performing validation task %s", task.ID)
-		err = task.Validation.Apply(runner, req)
+		if sampled != nil {
+			log.Debugf("task %s keeps the validation of its candidate", task.ID)
+			err = sampled.err
+		} else {
+			log.Debugf("performing validation task %s", task.ID)
+			err = p.apply(runner, req, task, task.Validation)
+		}
 		if err != nil {
 			log.Debugf("task validation for %s failed.", task.ID)
+			runner.emit(ValidationFailed{EventHeader: eventHeader(req, task), Attempt: req.attempt(task), Err: err})
+			span.fail(err)
 			req.err = append(req.err, err)
-			if task.RetryCount < task.MaxRetryCount {
-				task.RetryCount++
+			if req.retryable(task, err) {
+				if recovery := task.route(err); recovery != nil {
+					log.Debugf("atempting to recover validation of task %s with %s", task.ID, recovery.ID)
+					if recoveryErr := p.executeRecovery(runner, req, task, recovery, err); recoveryErr != nil {
+						req.failAttempt(task, err)
+						return recoveryErr
+					}
+				}
+				req.failAttempt(task, err)
+				req.closeSpan(span)
 				return p.executeTask(runner, req, task)
 			} else {
 				return err
@@ -149,9 +304,27 @@ func (p *Pipeline) executeTask(runner *PipelineRunner, req *ConversionRequest, t
 		}
 	}
 	log.Debugf("task %s executed successfully", task.ID)
+	p.cascadeSucceeded(req, task)
+	req.closeSpan(span)
+	runner.emit(TaskSucceeded{
+		EventHeader: eventHeader(req, task),
+		Attempts:    req.attempt(task) + 1,
+		Duration:    time.Since(started),
+	})
+	if task.Loop != nil {
+		if jump := p.loop(req, task); jump != nil {
+			return jump
+		}
+	}
 	// Execute next tasks
+	if task.Join != JoinSequential && len(task.Next) > 1 {
+		return p.executeBranches(runner, req, task)
+	}
 	for _, next := range task.Next {
-		if err := p.executeTask(runner, req, next); err != nil {
+		if err := p.executeNext(runner, req, next); err != nil {
+			if isControlFlow(err) {
+				return err
+			}
 			req.err = append(req.err, err)
 			return err
 		}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// JoinPolicy decides which outcome of concurrently executed next tasks is kept.
+type JoinPolicy string
+
+const (
+	// JoinSequential runs the next tasks one after another and stops at the first failure.
+	JoinSequential JoinPolicy = ""
+	// JoinFirst keeps the first branch that succeeds and cancels the others.
+	JoinFirst JoinPolicy = "first"
+	// JoinAll requires every branch to succeed, the first declared branch is kept.
+	JoinAll JoinPolicy = "all"
+	// JoinBest waits for every branch and keeps the one with the most passing tests.
+	JoinBest JoinPolicy = "best"
+)
+
+func parseJoinPolicy(key string) (JoinPolicy, error) {
+	switch policy := JoinPolicy(key); policy {
+	case JoinSequential, JoinFirst, JoinAll, JoinBest:
+		return policy, nil
+	}
+	return JoinSequential, fmt.Errorf("unknown join policy: %s", key)
+}
+
+type branchResult struct {
+	index  int
+	task   *ConversionTask
+	runner *PipelineRunner
+	req    *ConversionRequest
+	err    error
+}
+
+// score counts the test cases the branch passed.
+func (b *branchResult) score() int {
+	return b.req.testScore()
+}
+
+// betterThan prefers successful branches, then the higher test score, then the earlier declaration.
+func (b *branchResult) betterThan(other *branchResult) bool {
+	if other == nil {
+		return true
+	}
+	if (b.err == nil) != (other.err == nil) {
+		return b.err == nil
+	}
+	if b.score() != other.score() {
+		return b.score() > other.score()
+	}
+	return b.index < other.index
+}
+
+// executeBranches runs every next task of the given task concurrently. Each branch works on its own copy of the
+// request and its own build directory, the join policy of the task decides which branch is merged back.
+func (p *Pipeline) executeBranches(runner *PipelineRunner, req *ConversionRequest, task *ConversionTask) error {
+	ctx, cancel := context.WithCancel(runner.Context)
+	defer cancel()
+
+	log.Debugf("task %s forks into %d branches (join: %s)", task.ID, len(task.Next), task.Join)
+	results := make(chan *branchResult, len(task.Next))
+	for i, next := range task.Next {
+		branch := &branchResult{
+			index:  i,
+			task:   next,
+			runner: runner.fork(ctx),
+			req:    req.fork(),
+		}
+		branch.req.Trace = newSpan(SpanBranch, next.ID)
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("branch %s panic: %v", next.ID, r)
+					branch.err = fmt.Errorf("branch %s panic: %v", next.ID, r)
+				}
+				results <- branch
+			}()
+			branch.err = p.executeTask(branch.runner, branch.req, next)
+			if jump, ok := asLoopJump(branch.err); ok {
+				branch.err = fmt.Errorf("loop of task %s can not leave branch %s", jump.from, next.ID)
+			}
+		}()
+	}
+
+	branches := make([]*branchResult, len(task.Next))
+	var winner *branchResult
+	for range task.Next {
+		branch := <-results
+		branches[branch.index] = branch
+		log.Debugf("branch %s of task %s finished - %v", branch.task.ID, task.ID, branch.err)
+		if task.Join == JoinFirst && branch.err == nil && winner == nil {
+			winner = branch
+			cancel()
+		}
+	}
+
+	var failures []error
+	for _, branch := range branches {
+		if branch.err != nil {
+			failures = append(failures, fmt.Errorf("branch %s failed - %w", branch.task.ID, branch.err))
+		}
+	}
+
+	switch task.Join {
+	case JoinAll:
+		winner = branches[0]
+		for _, branch := range branches {
+			if branch.err != nil {
+				winner = branch
+				break
+			}
+		}
+	default:
+		if winner == nil {
+			for _, branch := range branches {
+				if branch.betterThan(winner) {
+					winner = branch
+				}
+			}
+		}
+	}
+	log.Debugf("task %s keeps branch %s", task.ID, winner.task.ID)
+
+	for _, branch := range branches {
+		req.Metrics.AddMetric(*branch.req.Metrics)
+		branch.req.Trace.end()
+		branch.req.Trace.fail(branch.err)
+		req.span.add(branch.req.Trace)
+		if branch != winner {
+			branch.runner.cleanup()
+		}
+	}
+	req.join(winner.req)
+	runner.join(winner.runner)
+
+	if task.Join == JoinAll && len(failures) > 0 {
+		return errors.Join(failures...)
+	}
+	return winner.err
+}
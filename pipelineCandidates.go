@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"maps"
+	"time"
+)
+
+// CandidateSampling lets a task generate several candidates per attempt and keep the best one.
+type CandidateSampling struct {
+	Count int `json:"count" yaml:"count"`
+	// Temperatures are assigned to the candidates round-robin
+	Temperatures []float64 `json:"temperatures,omitempty" yaml:"temperatures"`
+	// Seeds are assigned to the candidates round-robin, without seeds and temperatures each candidate gets its index
+	// as seed
+	Seeds []int `json:"seeds,omitempty" yaml:"seeds"`
+}
+
+// args returns the LLM invocation parameters of the i-th candidate.
+func (s CandidateSampling) args(i int) map[string]any {
+	args := make(map[string]any)
+	if len(s.Temperatures) > 0 {
+		args["temperature"] = s.Temperatures[i%len(s.Temperatures)]
+	}
+	if len(s.Seeds) > 0 {
+		args["seed"] = s.Seeds[i%len(s.Seeds)]
+	} else if len(s.Temperatures) == 0 {
+		args["seed"] = i
+	}
+	return args
+}
+
+// CandidateOutcome is the result of a single candidate, kept in the job metrics.
+type CandidateOutcome struct {
+	TaskID      string         `json:"task"`
+	Index       int            `json:"index"`
+	Args        map[string]any `json:"args"`
+	TestsPassed int            `json:"tests_passed"`
+	Tests       int            `json:"tests"`
+	Similarity  float64        `json:"similarity"`
+	Error       string         `json:"error,omitempty"`
+	Selected    bool           `json:"selected"`
+	Duration    time.Duration  `json:"duration"`
+}
+
+// CandidateSampler generates candidates with the execute converter of a task, builds each of them into its own build
+// directory with the build converter, if any, tests it with the validation converter and keeps the candidate that
+// passes the most tests. Ties are broken by the similarity of the test outputs to the expected outputs.
+type CandidateSampler struct {
+	TaskID     string
+	Sampling   CandidateSampling
+	Execute    Converter
+	Build      Converter
+	Validation Converter
+}
+
+// sampledValidation is the validation result of the candidate a sampler kept, the task does not validate it again.
+type sampledValidation struct {
+	err error
+}
+
+// candidateBuilder returns the converter that builds the candidates of a task before they are validated. Only the
+// goTester needs a built package, tasks that build the package themselves are not built again.
+func candidateBuilder(execute Converter, validation Converter, args map[string]interface{}) Converter {
+	if _, tested := validation.(*GoPackageTester); !tested {
+		return nil
+	}
+	if _, built := execute.(*GolangBuilder); built {
+		return nil
+	}
+	return makeGolangBuilder(args)
+}
+
+type candidate struct {
+	index    int
+	args     map[string]any
+	runner   *PipelineRunner
+	req      *ConversionRequest
+	err      error
+	tested   error
+	duration time.Duration
+}
+
+func (c *candidate) similarity() float64 {
+	similarities := c.req.Metrics.TestSimilarity
+	if len(similarities) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, similarity := range similarities {
+		sum += similarity
+	}
+	return sum / float64(len(similarities))
+}
+
+// betterThan prefers candidates that were generated, then the higher test score, then the more similar output, then
+// the lower index.
+func (c *candidate) betterThan(other *candidate) bool {
+	if other == nil {
+		return true
+	}
+	if (c.err == nil) != (other.err == nil) {
+		return c.err == nil
+	}
+	if c.req.testScore() != other.req.testScore() {
+		return c.req.testScore() > other.req.testScore()
+	}
+	if c.similarity() != other.similarity() {
+		return c.similarity() > other.similarity()
+	}
+	return c.index < other.index
+}
+
+func (c *candidate) outcome(taskID string) CandidateOutcome {
+	outcome := CandidateOutcome{
+		TaskID:      taskID,
+		Index:       c.index,
+		Args:        c.args,
+		TestsPassed: c.req.testScore(),
+		Tests:       len(c.req.Metrics.TestCases),
+		Similarity:  c.similarity(),
+		Duration:    c.duration,
+	}
+	if c.err != nil {
+		outcome.Error = c.err.Error()
+	} else if c.tested != nil {
+		outcome.Error = c.tested.Error()
+	}
+	return outcome
+}
+
+func (s *CandidateSampler) Apply(runner *PipelineRunner, req *ConversionRequest) error {
+	ctx, cancel := context.WithCancel(runner.Context)
+	defer cancel()
+
+	count := max(s.Sampling.Count, 1)
+	log.Debugf("task %s samples %d candidates", s.TaskID, count)
+	results := make(chan *candidate, count)
+	for i := 0; i < count; i++ {
+		c := &candidate{
+			index:  i,
+			args:   s.Sampling.args(i),
+			runner: runner.fork(ctx),
+			req:    req.fork(),
+		}
+		c.runner.llmArgs = make(map[string]any)
+		maps.Copy(c.runner.llmArgs, runner.llmArgs)
+		maps.Copy(c.runner.llmArgs, c.args)
+		c.req.Trace = newSpan(SpanCandidate, s.TaskID)
+		if req.span != nil {
+			c.req.Trace.Converter = req.span.Converter
+		}
+		c.req.Trace.Attempt = i
+		c.req.span = c.req.Trace
+		go func() {
+			start := time.Now()
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("candidate %d of task %s panic: %v", c.index, s.TaskID, r)
+					c.err = fmt.Errorf("candidate %d of task %s panic: %v", c.index, s.TaskID, r)
+				}
+				c.duration = time.Since(start)
+				results <- c
+			}()
+			c.err = s.Execute.Apply(c.runner, c.req)
+			if c.err == nil && s.Build != nil {
+				c.err = s.Build.Apply(c.runner, c.req)
+			}
+			if c.err == nil && s.Validation != nil {
+				c.tested = s.Validation.Apply(c.runner, c.req)
+			}
+		}()
+	}
+
+	candidates := make([]*candidate, count)
+	for range count {
+		c := <-results
+		candidates[c.index] = c
+	}
+
+	var best *candidate
+	for _, c := range candidates {
+		if c.betterThan(best) {
+			best = c
+		}
+	}
+	log.Debugf("task %s keeps candidate %d with %d passed tests", s.TaskID, best.index, best.req.testScore())
+
+	for _, c := range candidates {
+		outcome := c.outcome(s.TaskID)
+		outcome.Selected = c == best
+		req.Metrics.Candidates = append(req.Metrics.Candidates, outcome)
+		req.Metrics.AddMetric(*c.req.Metrics)
+		c.req.Trace.end()
+		c.req.Trace.fail(c.tested)
+		c.req.Trace.fail(c.err)
+		if req.span != nil {
+			req.span.add(c.req.Trace)
+		}
+		if c != best {
+			c.runner.cleanup()
+		}
+	}
+	req.join(best.req)
+	runner.join(best.runner)
+	if best.err == nil && s.Validation != nil {
+		req.sampled = &sampledValidation{err: best.tested}
+	}
+	return best.err
+}
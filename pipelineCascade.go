@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"maps"
+	"time"
+)
+
+// CascadeTier is a model of a cascade with the retries it gets before the task escalates to the next tier.
+type CascadeTier struct {
+	//name of the tier in traces and metrics, defaults to the model
+	Name          string `json:"name,omitempty" yaml:"name"`
+	MaxRetryCount int    `json:"maxRetryCount" yaml:"maxRetryCount"`
+	//LLM options of the tier, e.g., model_name, they replace the options of the task
+	Options map[string]interface{} `json:"options" yaml:"options"`
+}
+
+// ModelCascade lets an LLM task start with the cheapest model and escalate to the next tier once the attempts of a
+// tier are used up, regardless of whether the converter or the validation of the task failed them.
+type ModelCascade []CascadeTier
+
+// withNames returns the cascade with a name for every tier.
+func (c ModelCascade) withNames() ModelCascade {
+	named := make(ModelCascade, len(c))
+	for i, tier := range c {
+		if tier.Name == "" {
+			tier.Name = modelOf(tier.Options)
+		}
+		if tier.Name == "" {
+			tier.Name = fmt.Sprintf("tier%d", i)
+		}
+		named[i] = tier
+	}
+	return named
+}
+
+// maxRetryCount is the number of attempts of all tiers.
+func (c ModelCascade) maxRetryCount() int {
+	total := 0
+	for _, tier := range c {
+		total += tier.MaxRetryCount
+	}
+	return total
+}
+
+// tier returns the tier of the next attempt after the task spent the given number of attempts.
+func (c ModelCascade) tier(spent int) CascadeTier {
+	for _, tier := range c {
+		if spent < tier.MaxRetryCount {
+			return tier
+		}
+		spent -= tier.MaxRetryCount
+	}
+	return c[len(c)-1]
+}
+
+// TierUsage is what the attempts of a task spent at a tier of its cascade.
+type TierUsage struct {
+	Attempts       int           `json:"attempts"`
+	PromptTokens   int           `json:"prompt_tokens"`
+	EvalTokens     int           `json:"eval_tokens"`
+	ConversionTime time.Duration `json:"conversion_time"`
+	Duration       time.Duration `json:"duration"`
+	//the task succeeded with the output of the tier
+	Succeeded bool `json:"succeeded"`
+}
+
+func (u *TierUsage) add(other *TierUsage) {
+	u.Attempts += other.Attempts
+	u.PromptTokens += other.PromptTokens
+	u.EvalTokens += other.EvalTokens
+	u.ConversionTime += other.ConversionTime
+	u.Duration += other.Duration
+	u.Succeeded = u.Succeeded || other.Succeeded
+}
+
+// tierKey identifies the tier of a task in the tiers metric.
+func tierKey(task *ConversionTask, tier CascadeTier) string {
+	return task.ID + "/" + tier.Name
+}
+
+func (m *Metrics) tierUsage(key string) *TierUsage {
+	if m.Tiers == nil {
+		m.Tiers = make(map[string]*TierUsage)
+	}
+	usage, ok := m.Tiers[key]
+	if !ok {
+		usage = &TierUsage{}
+		m.Tiers[key] = usage
+	}
+	return usage
+}
+
+// execute runs the execute converter of the task, with the options of the tier of the cascade the attempt is at.
+func (p *Pipeline) execute(runner *PipelineRunner, req *ConversionRequest, task *ConversionTask) error {
+	if len(task.Cascade) == 0 {
+		return p.apply(runner, req, task, task.Execute)
+	}
+	tier := task.Cascade.tier(req.spent(task))
+	log.Debugf("task %s runs attempt %d with tier %s", task.ID, req.attempt(task), tier.Name)
+	if req.span != nil {
+		req.span.Tier = tier.Name
+	}
+
+	promptTokens, evalTokens := req.Metrics.ConversionPromptTokenCount, req.Metrics.ConversionEvalTokenCount
+	conversionTime := req.Metrics.ConversionTime
+	started := time.Now()
+	err := runner.withLLMArgs(tier.Options, func() error {
+		return p.apply(runner, req, task, task.Execute)
+	})
+	usage := req.Metrics.tierUsage(tierKey(task, tier))
+	usage.Attempts++
+	usage.PromptTokens += req.Metrics.ConversionPromptTokenCount - promptTokens
+	usage.EvalTokens += req.Metrics.ConversionEvalTokenCount - evalTokens
+	usage.ConversionTime += req.Metrics.ConversionTime - conversionTime
+	usage.Duration += time.Since(started)
+	return err
+}
+
+// cascadeSucceeded marks the tier that produced the output of a task that succeeded.
+func (p *Pipeline) cascadeSucceeded(req *ConversionRequest, task *ConversionTask) {
+	if len(task.Cascade) == 0 {
+		return
+	}
+	req.Metrics.tierUsage(tierKey(task, task.Cascade.tier(req.spent(task)))).Succeeded = true
+}
+
+// withLLMArgs runs fn with the arguments added to the LLM arguments of the runner.
+func (cc *PipelineRunner) withLLMArgs(args map[string]interface{}, fn func() error) error {
+	if len(args) == 0 {
+		return fn()
+	}
+	parent := cc.llmArgs
+	merged := make(map[string]any, len(parent)+len(args))
+	maps.Copy(merged, parent)
+	maps.Copy(merged, args)
+	cc.llmArgs = merged
+	defer func() {
+		cc.llmArgs = parent
+	}()
+	return fn()
+}
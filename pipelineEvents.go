@@ -0,0 +1,151 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// EventHeader identifies the job and task an event belongs to.
+type EventHeader struct {
+	RequestID uuid.UUID
+	TaskID    string
+	Time      time.Time
+}
+
+func (h EventHeader) Header() EventHeader {
+	return h
+}
+
+// PipelineEvent is emitted by the pipeline while a job runs, see the event types below.
+type PipelineEvent interface {
+	Header() EventHeader
+}
+
+// TaskStarted is emitted each time a task is entered, including restarts by loops and re-executions after a
+// failed validation.
+type TaskStarted struct {
+	EventHeader
+	Attempt int
+}
+
+// AttemptFailed is emitted when a single attempt of a task fails, before it is retried or recovered.
+type AttemptFailed struct {
+	EventHeader
+	Attempt int
+	Err     error
+}
+
+// RetryScheduled is emitted when a failed attempt is retried within the task, Delay is the backoff before the retry.
+type RetryScheduled struct {
+	EventHeader
+	Attempt int
+	Delay   time.Duration
+}
+
+// RecoveryStarted is emitted when a recovery task starts to repair a failure of the task.
+type RecoveryStarted struct {
+	EventHeader
+	Attempt    int
+	RecoveryID string
+	Err        error
+}
+
+// ValidationFailed is emitted when the validation of a task rejects its result.
+type ValidationFailed struct {
+	EventHeader
+	Attempt int
+	Err     error
+}
+
+// WorkingPackageRolledBack is emitted when a failed attempt corrupted the working package and the version from before
+// the attempt was restored.
+type WorkingPackageRolledBack struct {
+	EventHeader
+	Attempt int
+}
+
+// TaskSucceeded is emitted once a task and its validation succeeded, before its next tasks run.
+type TaskSucceeded struct {
+	EventHeader
+	Attempts int
+	Duration time.Duration
+}
+
+// ReviewRequested is emitted when a review task pauses the job until a reviewer decided.
+type ReviewRequested struct {
+	EventHeader
+}
+
+// PipelineFinished is emitted once per execution of the pipeline, Err is nil if the job succeeded.
+type PipelineFinished struct {
+	EventHeader
+	Err     error
+	Metrics Metrics
+}
+
+func eventHeader(req *ConversionRequest, task *ConversionTask) EventHeader {
+	header := EventHeader{
+		RequestID: req.Id,
+		Time:      time.Now(),
+	}
+	if task != nil {
+		header.TaskID = task.ID
+	}
+	return header
+}
+
+// PipelineObserver receives the events of all jobs run by a PipelineRunner.
+type PipelineObserver interface {
+	Notify(PipelineEvent)
+}
+
+// ObserverFunc adapts a function to the PipelineObserver interface.
+type ObserverFunc func(PipelineEvent)
+
+func (f ObserverFunc) Notify(event PipelineEvent) {
+	f(event)
+}
+
+// EventBus delivers pipeline events to its observers. Events are delivered synchronously in the goroutine running the
+// task, concurrent branches can emit events at the same time, so observers have to be safe for concurrent use and
+// should hand off slow work.
+type EventBus struct {
+	mutex     sync.RWMutex
+	nextID    int
+	observers map[int]PipelineObserver
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{observers: make(map[int]PipelineObserver)}
+}
+
+// Subscribe registers an observer and returns a function that removes it again.
+func (bus *EventBus) Subscribe(observer PipelineObserver) (unsubscribe func()) {
+	bus.mutex.Lock()
+	defer bus.mutex.Unlock()
+	id := bus.nextID
+	bus.nextID++
+	bus.observers[id] = observer
+	return func() {
+		bus.mutex.Lock()
+		defer bus.mutex.Unlock()
+		delete(bus.observers, id)
+	}
+}
+
+// Publish delivers the event to all observers, a nil bus drops the event. The observers are notified without holding
+// the lock, so they can subscribe and unsubscribe while they handle the event.
+func (bus *EventBus) Publish(event PipelineEvent) {
+	if bus == nil {
+		return
+	}
+	bus.mutex.RLock()
+	observers := slices.Collect(maps.Values(bus.observers))
+	bus.mutex.RUnlock()
+	for _, observer := range observers {
+		observer.Notify(event)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// SubpipelineTask is the task converter that runs a pipeline fragment as a single task.
+const SubpipelineTask = "subpipeline"
+
+// fragmentLibrary holds the shared fragments that pipeline files can include, e.g., `include: [fragments/build.yaml]`.
+//
+//go:embed fragments/*.yaml
+var fragmentLibrary embed.FS
+
+// SubPipelineConverter runs a fragment of the pipeline file as a single task. The fragment starts with a fresh
+// retry budget every time the task is applied, and its metrics are kept in their own scope.
+type SubPipelineConverter struct {
+	TaskID   string
+	Fragment string
+	Pipeline *Pipeline
+}
+
+func (s *SubPipelineConverter) Apply(runner *PipelineRunner, req *ConversionRequest) error {
+	outer := req.Metrics
+	scoped := &Metrics{
+		TestCases: make(map[string]bool),
+		Loops:     make(map[string]int),
+	}
+	req.Metrics = scoped
+	req.resetAttempts(s.Pipeline.FirstTask)
+	req.nested++
+	defer func() {
+		req.nested--
+		req.Metrics = outer
+		outer.AddMetric(*scoped)
+		if len(scoped.TestCases) > 0 {
+			outer.TestCases = scoped.TestCases
+			outer.TestTime = scoped.TestTime
+			outer.TestError = scoped.TestError
+			outer.TestSimilarity = scoped.TestSimilarity
+		}
+		if outer.Scopes == nil {
+			outer.Scopes = make(map[string]*Metrics)
+		}
+		if previous, ok := outer.Scopes[s.TaskID]; ok {
+			previous.AddMetric(*scoped)
+			previous.TestCases = scoped.TestCases
+		} else {
+			outer.Scopes[s.TaskID] = scoped
+		}
+	}()
+
+	err := s.Pipeline.executeTask(runner, req, s.Pipeline.FirstTask)
+	if jump, ok := asLoopJump(err); ok {
+		return fmt.Errorf("loop of task %s can not leave pipeline fragment %s", jump.from, s.Fragment)
+	}
+	return err
+}
+
+// compileSubpipeline compiles the fragment a subpipeline task runs. The fragment inherits the options and the
+// fragments of the file it is used in.
+func compileSubpipeline(file PipelineFile, task ConversionTaskStub) (Converter, error) {
+	name, _ := task.TaskArgs["pipeline"].(string)
+	fragment, ok := file.Fragments[name]
+	if !ok {
+		return nil, fmt.Errorf("task %s: unknown pipeline fragment '%s'", task.ID, name)
+	}
+	pipeline, err := compilePipeline(fragment.inherit(file))
+	if err != nil {
+		return nil, fmt.Errorf("task %s: pipeline fragment %s: %w", task.ID, name, err)
+	}
+	return &SubPipelineConverter{
+		TaskID:   task.ID,
+		Fragment: name,
+		Pipeline: pipeline,
+	}, nil
+}
+
+// inherit returns the fragment with the options and fragments of the parent file, the fragment's own win.
+func (fragment PipelineFile) inherit(parent PipelineFile) PipelineFile {
+	options := make(map[string]interface{})
+	maps.Copy(options, parent.DefaultOptions)
+	maps.Copy(options, fragment.DefaultOptions)
+	fragment.DefaultOptions = options
+
+	fragments := make(map[string]PipelineFile)
+	maps.Copy(fragments, parent.Fragments)
+	maps.Copy(fragments, fragment.Fragments)
+	fragment.Fragments = fragments
+
+	if len(parent.Prices) > 0 {
+		prices := make(PriceTable)
+		maps.Copy(prices, parent.Prices)
+		maps.Copy(prices, fragment.Prices)
+		fragment.Prices = prices
+	}
+	fragment.overrides = parent.overrides
+	return fragment
+}
+
+// LoadPipelineFile reads a pipeline file from disk. Includes are resolved relative to the file, and fall back to the
+// built-in fragment library.
+func LoadPipelineFile(fname string) (PipelineFile, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return PipelineFile{}, err
+	}
+	defer f.Close()
+	fileContent, err := readPipelineFile(f)
+	if err != nil {
+		return fileContent, err
+	}
+	err = fileContent.resolveIncludes(includeSource{dir: filepath.Dir(fname)}, []string{fname})
+	return fileContent, err
+}
+
+// includeSource is the directory includes are resolved in, either on disk or in the fragment library.
+type includeSource struct {
+	dir     string
+	library bool
+}
+
+func (src includeSource) read(include string) ([]byte, string, includeSource, error) {
+	if !src.library {
+		name := filepath.Join(src.dir, include)
+		data, err := os.ReadFile(name)
+		if err == nil {
+			return data, name, includeSource{dir: filepath.Dir(name)}, nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, name, src, err
+		}
+		src = includeSource{dir: ".", library: true}
+	}
+	name := path.Join(src.dir, include)
+	data, err := fs.ReadFile(fragmentLibrary, name)
+	if err != nil {
+		return nil, name, src, fmt.Errorf("include %s not found", include)
+	}
+	return data, name, includeSource{dir: path.Dir(name), library: true}, nil
+}
+
+// resolveIncludes merges the fragments of all included files into the file. An included file that has tasks becomes
+// a fragment itself, named after the file without extension.
+func (file *PipelineFile) resolveIncludes(src includeSource, stack []string) error {
+	includes := file.Include
+	file.Include = nil
+	for _, include := range includes {
+		data, name, includedSrc, err := src.read(include)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(stack, name) {
+			return fmt.Errorf("include cycle: %s -> %s", strings.Join(stack, " -> "), name)
+		}
+		included, err := readPipelineFile(strings.NewReader(string(data)))
+		if err != nil {
+			return fmt.Errorf("include %s: %w", name, err)
+		}
+		if err := included.resolveIncludes(includedSrc, append(slices.Clone(stack), name)); err != nil {
+			return err
+		}
+		included.source = name
+
+		fragments := included.Fragments
+		included.Fragments = nil
+		if len(included.Tasks) > 0 {
+			if fragments == nil {
+				fragments = make(map[string]PipelineFile)
+			}
+			fragments[strings.TrimSuffix(path.Base(filepath.ToSlash(name)), path.Ext(name))] = included
+		}
+		if file.Fragments == nil {
+			file.Fragments = make(map[string]PipelineFile)
+		}
+		for _, key := range slices.Sorted(maps.Keys(fragments)) {
+			if _, ok := file.Fragments[key]; ok {
+				return fmt.Errorf("include %s: duplicate pipeline fragment '%s'", name, key)
+			}
+			fragment := fragments[key]
+			if fragment.source == "" {
+				fragment.source = name
+			}
+			file.Fragments[key] = fragment
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"gopkg.in/yaml.v3"
 	"io"
@@ -9,8 +10,17 @@ import (
 )
 
 type PipelineFile struct {
-	DefaultOptions map[string]interface{} `json:"options" yaml:"options"`
-	Tasks          []ConversionTaskStub   `json:"tasks" yaml:"tasks"`
+	Include        []string                `json:"include,omitempty" yaml:"include"`
+	DefaultOptions map[string]interface{}  `json:"options" yaml:"options"`
+	Deadline       Duration                `json:"deadline" yaml:"deadline"`
+	Budget         *Budget                 `json:"budget,omitempty" yaml:"budget"`
+	Prices         PriceTable              `json:"prices,omitempty" yaml:"prices"`
+	Tasks          []ConversionTaskStub    `json:"tasks" yaml:"tasks"`
+	Fragments      map[string]PipelineFile `json:"fragments,omitempty" yaml:"fragments"`
+	//file the fragment was included from
+	source string
+	//per-request values that win over options and environment variables during interpolation
+	overrides map[string]any
 }
 
 type ConversionTaskStub struct {
@@ -22,12 +32,79 @@ type ConversionTaskStub struct {
 	canApply      Converter
 	Validation    string `json:"validation" yaml:"validation"`
 	validator     Converter
+	builder       Converter
 	Recovery      string `json:"recovery" yaml:"recovery"`
 	onFailure     *ConversionTask
-	MaxRetryCount int           `json:"maxRetryCount" yaml:"maxRetryCount"`
-	RetryDelay    time.Duration `json:"retryDelay" yaml:"retryDelay"`
-	Next          []string      `json:"next" yaml:"next"`
+	MaxRetryCount int      `json:"maxRetryCount" yaml:"maxRetryCount"`
+	RetryDelay    Duration `json:"retryDelay" yaml:"retryDelay"`
+	Timeout       Duration `json:"timeout" yaml:"timeout"`
+	Next          []string `json:"next" yaml:"next"`
 	next          []*ConversionTask
+	Join          string `json:"join" yaml:"join"`
+	join          JoinPolicy
+	On            map[string]string `json:"on" yaml:"on"`
+	onError       map[ErrorClass]*ConversionTask
+	Loop          *TaskLoop          `json:"loop" yaml:"loop"`
+	Retry         *RetryPolicy       `json:"retry,omitempty" yaml:"retry"`
+	Candidates    *CandidateSampling `json:"candidates" yaml:"candidates"`
+	Cascade       ModelCascade       `json:"cascade,omitempty" yaml:"cascade"`
+	Budget        *Budget            `json:"budget,omitempty" yaml:"budget"`
+	line          int
+}
+
+// Duration is a time.Duration in pipeline files, written as a string like "90s" or "1h30m". Numbers are read as
+// nanoseconds, the format of older JSON files.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case float64:
+		*d = Duration(value)
+	case string:
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(duration)
+	default:
+		return fmt.Errorf("invalid duration %s", data)
+	}
+	return nil
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	var duration time.Duration
+	if err := node.Decode(&duration); err != nil {
+		return fmt.Errorf("line %d: invalid duration %q", node.Line, node.Value)
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// UnmarshalYAML decodes the task and remembers its line for validation issues.
+func (c *ConversionTaskStub) UnmarshalYAML(node *yaml.Node) error {
+	type plain ConversionTaskStub
+	if err := node.Decode((*plain)(c)); err != nil {
+		return err
+	}
+	c.line = node.Line
+	return nil
 }
 
 func (c *ConversionTaskStub) canConvert() bool {
@@ -50,6 +127,10 @@ func (c *ConversionTaskStub) canConvert() bool {
 		return false
 	}
 
+	if len(c.On) != len(c.onError) {
+		return false
+	}
+
 	return true
 }
 
@@ -57,16 +138,39 @@ func (c *ConversionTaskStub) asConversionTask() ConversionTask {
 	if !c.canConvert() {
 		panic(fmt.Errorf("can not convert task '%s'", c.ID))
 	}
+	execute := c.task
+	if c.Candidates != nil {
+		execute = &CandidateSampler{
+			TaskID:     c.ID,
+			Sampling:   *c.Candidates,
+			Execute:    c.task,
+			Build:      c.builder,
+			Validation: c.validator,
+		}
+	}
+	maxRetryCount := c.MaxRetryCount
+	var cascade ModelCascade
+	if len(c.Cascade) > 0 {
+		cascade = c.Cascade.withNames()
+		maxRetryCount = cascade.maxRetryCount()
+	}
 	return ConversionTask{
 		ID:            c.ID,
-		Execute:       c.task,
+		Execute:       execute,
 		CanApply:      c.canApply,
 		Validation:    c.validator,
 		OnFailure:     c.onFailure,
-		RetryCount:    0,
-		MaxRetryCount: c.MaxRetryCount,
-		RetryDelay:    c.RetryDelay,
+		MaxRetryCount: maxRetryCount,
+		RetryDelay:    time.Duration(c.RetryDelay),
+		Timeout:       time.Duration(c.Timeout),
 		Next:          c.next,
+		Join:          c.join,
+		OnError:       c.onError,
+		Loop:          c.Loop,
+		Retry:         c.Retry,
+		Converter:     c.Task,
+		Cascade:       cascade,
+		Budget:        c.Budget,
 	}
 }
 
@@ -81,20 +185,46 @@ func MakeConverter(key string, args map[string]interface{}) (Converter, error) {
 }
 
 func PipelineReader(file io.Reader) (*Pipeline, error) {
-	var fileContent PipelineFile
-	data, err := io.ReadAll(file)
+	fileContent, err := ReadPipelineFile(file)
 	if err != nil {
 		return nil, err
 	}
-	err = yaml.Unmarshal(data, &fileContent)
+
+	return compilePipeline(fileContent)
+}
+
+// ReadPipelineFile parses a yaml or json pipeline file without compiling it. Includes are resolved against the
+// built-in fragment library.
+func ReadPipelineFile(file io.Reader) (PipelineFile, error) {
+	fileContent, err := readPipelineFile(file)
 	if err != nil {
-		return nil, err
+		return fileContent, err
 	}
+	err = fileContent.resolveIncludes(includeSource{dir: ".", library: true}, nil)
+	return fileContent, err
+}
 
-	return compilePipeline(fileContent)
+func readPipelineFile(file io.Reader) (PipelineFile, error) {
+	var fileContent PipelineFile
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return fileContent, err
+	}
+	err = yaml.Unmarshal(data, &fileContent)
+	return fileContent, err
 }
 
 func compilePipeline(fileContent PipelineFile) (*Pipeline, error) {
+	if err := ValidatePipeline(fileContent).Err(); err != nil {
+		return nil, err
+	}
+	source := fileContent
+	source.overrides = nil
+	fileContent, err := fileContent.interpolate()
+	if err != nil {
+		return nil, fmt.Errorf("failed to interpolate pipeline: %w", err)
+	}
+
 	pipelineMapping := make(map[string]ConversionTask)
 	uncompletedTasks := make([]ConversionTaskStub, 0)
 	for _, task := range fileContent.Tasks {
@@ -103,7 +233,13 @@ func compilePipeline(fileContent PipelineFile) (*Pipeline, error) {
 		if task.TaskArgs != nil {
 			maps.Copy(args, task.TaskArgs)
 		}
-		_task, err := MakeConverter(task.Task, args)
+		var _task Converter
+		var err error
+		if task.Task == SubpipelineTask {
+			_task, err = compileSubpipeline(fileContent, task)
+		} else {
+			_task, err = MakeConverter(task.Task, args)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -120,6 +256,22 @@ func compilePipeline(fileContent PipelineFile) (*Pipeline, error) {
 			return nil, err
 		}
 		task.validator = _validation
+		if task.Candidates != nil {
+			task.builder = candidateBuilder(_task, _validation, fileContent.DefaultOptions)
+		}
+
+		_join, err := parseJoinPolicy(task.Join)
+		if err != nil {
+			return nil, fmt.Errorf("task %s: %w", task.ID, err)
+		}
+		task.join = _join
+
+		task.onError = make(map[ErrorClass]*ConversionTask)
+		for key := range task.On {
+			if _, err := parseErrorClass(key); err != nil {
+				return nil, fmt.Errorf("task %s: %w", task.ID, err)
+			}
+		}
 
 		if task.canConvert() {
 			pipelineMapping[task.ID] = task.asConversionTask()
@@ -130,6 +282,7 @@ func compilePipeline(fileContent PipelineFile) (*Pipeline, error) {
 
 	for len(uncompletedTasks) > 0 {
 		remainingUncompletedTasks := make([]ConversionTaskStub, 0)
+		progress := len(uncompletedTasks)
 
 		for _, task := range uncompletedTasks {
 			remaining := make([]string, 0)
@@ -146,6 +299,11 @@ func compilePipeline(fileContent PipelineFile) (*Pipeline, error) {
 					task.onFailure = &onFailure
 				}
 			}
+			for key, target := range task.On {
+				if onError, ok := pipelineMapping[target]; ok {
+					task.onError[ErrorClass(key)] = &onError
+				}
+			}
 			task.Next = remaining
 			if task.canConvert() {
 				pipelineMapping[task.ID] = task.asConversionTask()
@@ -154,9 +312,17 @@ func compilePipeline(fileContent PipelineFile) (*Pipeline, error) {
 			}
 		}
 		uncompletedTasks = remainingUncompletedTasks
+		if len(uncompletedTasks) == progress {
+			return nil, fmt.Errorf("can not resolve task '%s'", uncompletedTasks[0].ID)
+		}
 	}
 	if root, ok := pipelineMapping["root"]; ok {
-		return NewPipeline(&root), nil
+		pipeline := NewPipeline(&root)
+		pipeline.Deadline = time.Duration(fileContent.Deadline)
+		pipeline.Budget = fileContent.Budget
+		pipeline.Prices = fileContent.Prices
+		pipeline.source = &source
+		return pipeline, nil
 	} else {
 		return nil, fmt.Errorf("no root converter found")
 	}
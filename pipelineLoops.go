@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+// LoopCondition decides when a loop stops jumping back before its iteration bound is reached.
+type LoopCondition string
+
+const (
+	// LoopUntilBound only stops once the maximum number of iterations is reached.
+	LoopUntilBound LoopCondition = ""
+	// LoopUntilTestsPass stops as soon as all test cases of the last test run passed.
+	LoopUntilTestsPass LoopCondition = "testsPass"
+	// LoopUntilNoImprovement stops if the last iteration did not pass more test cases than the one before.
+	LoopUntilNoImprovement LoopCondition = "noImprovement"
+)
+
+func parseLoopCondition(key string) (LoopCondition, error) {
+	switch condition := LoopCondition(key); condition {
+	case LoopUntilBound, LoopUntilTestsPass, LoopUntilNoImprovement:
+		return condition, nil
+	}
+	return LoopUntilBound, fmt.Errorf("unknown loop condition: %s", key)
+}
+
+// TaskLoop lets a task jump back to an earlier task once it succeeded.
+type TaskLoop struct {
+	Target        string        `json:"target" yaml:"target"`
+	MaxIterations int           `json:"maxIterations" yaml:"maxIterations"`
+	Until         LoopCondition `json:"until" yaml:"until"`
+}
+
+// loopJump unwinds the task execution until it reaches the loop target, which then restarts.
+type loopJump struct {
+	from   string
+	target string
+}
+
+func (j *loopJump) Error() string {
+	return fmt.Sprintf("loop of task %s jumps back to %s", j.from, j.target)
+}
+
+func asLoopJump(err error) (*loopJump, bool) {
+	var jump *loopJump
+	ok := errors.As(err, &jump)
+	return jump, ok
+}
+
+// isControlFlow reports whether the error only unwinds the task execution, i.e., a loop jump or a paused job, instead
+// of reporting a failure.
+func isControlFlow(err error) bool {
+	if _, ok := asLoopJump(err); ok {
+		return true
+	}
+	_, ok := asReviewPause(err)
+	return ok
+}
+
+// loop decides if the task jumps back to its loop target. It returns a loopJump or nil if the loop is done.
+func (p *Pipeline) loop(req *ConversionRequest, task *ConversionTask) error {
+	loop := task.Loop
+	if req.Metrics.Loops == nil {
+		req.Metrics.Loops = make(map[string]int)
+	}
+	if req.loopScores == nil {
+		req.loopScores = make(map[string]int)
+	}
+	if req.loopIterations == nil {
+		req.loopIterations = make(map[string]int)
+	}
+
+	iterations := req.loopIterations[task.ID]
+	score := req.testScore()
+	if iterations >= loop.MaxIterations {
+		log.Debugf("loop of task %s reached %d iterations", task.ID, iterations)
+		return nil
+	}
+	switch loop.Until {
+	case LoopUntilTestsPass:
+		if req.testsPass() {
+			log.Debugf("loop of task %s done, all tests pass", task.ID)
+			return nil
+		}
+	case LoopUntilNoImprovement:
+		if previous, ok := req.loopScores[task.ID]; ok && score <= previous {
+			log.Debugf("loop of task %s done, score did not improve (%d <= %d)", task.ID, score, previous)
+			return nil
+		}
+	}
+
+	req.loopScores[task.ID] = score
+	req.loopIterations[task.ID] = iterations + 1
+	req.Metrics.Loops[task.ID]++
+	log.Debugf("loop of task %s jumps back to %s (%d/%d)", task.ID, loop.Target, iterations+1, loop.MaxIterations)
+	return &loopJump{from: task.ID, target: loop.Target}
+}
+
+// restartLoops clears the iterations of the loops nested in the task a loop jumped back to, i.e., loops that follow
+// the task and jump back to it or a later task, except for the loop that jumped. A nested loop thus runs all its
+// iterations again in each iteration of the outer loop.
+func (req *ConversionRequest) restartLoops(task *ConversionTask, jump *loopJump) {
+	following := make(map[string]*ConversionTask)
+	var walk func(task *ConversionTask)
+	walk = func(task *ConversionTask) {
+		if task == nil {
+			return
+		}
+		following[task.ID] = task
+		walk(task.OnFailure)
+		for _, recovery := range task.OnError {
+			walk(recovery)
+		}
+		for _, next := range task.Next {
+			walk(next)
+		}
+	}
+	walk(task)
+	for id, task := range following {
+		if task.Loop == nil || id == jump.from {
+			continue
+		}
+		if _, nested := following[task.Loop.Target]; nested {
+			delete(req.loopIterations, id)
+			delete(req.loopScores, id)
+		}
+	}
+}
@@ -0,0 +1,560 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ollama/ollama/api"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+type IssueSeverity string
+
+const (
+	// SeverityError marks problems that prevent the pipeline from being compiled.
+	SeverityError IssueSeverity = "error"
+	// SeverityWarning marks problems that compile, but most likely do not do what the author intended.
+	SeverityWarning IssueSeverity = "warning"
+)
+
+// PipelineIssue is a single problem found while validating a PipelineFile.
+type PipelineIssue struct {
+	Severity IssueSeverity `json:"severity"`
+	File     string        `json:"file,omitempty"`
+	TaskID   string        `json:"task,omitempty"`
+	Line     int           `json:"line,omitempty"`
+	Message  string        `json:"message"`
+}
+
+func (i PipelineIssue) String() string {
+	var builder strings.Builder
+	if i.File != "" {
+		builder.WriteString(fmt.Sprintf("%s: ", i.File))
+	}
+	if i.Line > 0 {
+		builder.WriteString(fmt.Sprintf("line %d: ", i.Line))
+	}
+	builder.WriteString(string(i.Severity))
+	if i.TaskID != "" {
+		builder.WriteString(fmt.Sprintf(": task %s", i.TaskID))
+	}
+	builder.WriteString(": ")
+	builder.WriteString(i.Message)
+	return builder.String()
+}
+
+type PipelineIssues []PipelineIssue
+
+// Errors returns the issues that prevent the pipeline from being compiled.
+func (issues PipelineIssues) Errors() PipelineIssues {
+	errs := make(PipelineIssues, 0)
+	for _, issue := range issues {
+		if issue.Severity == SeverityError {
+			errs = append(errs, issue)
+		}
+	}
+	return errs
+}
+
+// Err returns a PipelineValidationError if any of the issues is an error.
+func (issues PipelineIssues) Err() error {
+	if errs := issues.Errors(); len(errs) > 0 {
+		return PipelineValidationError{Issues: errs}
+	}
+	return nil
+}
+
+type PipelineValidationError struct {
+	Issues PipelineIssues
+}
+
+func (e PipelineValidationError) Error() string {
+	lines := make([]string, 0, len(e.Issues))
+	for _, issue := range e.Issues {
+		lines = append(lines, issue.String())
+	}
+	return fmt.Sprintf("invalid pipeline:\n%s", strings.Join(lines, "\n"))
+}
+
+// checkConverters do not rewrite the working package and can be used in the validation and canApply slot.
+var checkConverters = []string{"goBuilder", "goTester", "canCompile", "noop"}
+
+// pipelineValidator collects all issues of a pipeline file in one pass.
+type pipelineValidator struct {
+	file   PipelineFile
+	tasks  map[string]*ConversionTaskStub
+	issues PipelineIssues
+	//fragments subpipeline tasks can run, including the fragments of enclosing files
+	fragments map[string]PipelineFile
+}
+
+// ValidatePipeline checks a pipeline file for unknown references, unknown converters, cycles, unreachable tasks and
+// unused options. All problems are reported at once, instead of failing on the first one.
+func ValidatePipeline(file PipelineFile) PipelineIssues {
+	v := validatePipeline(file, file.Fragments)
+	v.checkFragmentCycles()
+	return v.issues
+}
+
+func validatePipeline(file PipelineFile, fragments map[string]PipelineFile) *pipelineValidator {
+	v := &pipelineValidator{
+		file:      file,
+		tasks:     make(map[string]*ConversionTaskStub),
+		issues:    make(PipelineIssues, 0),
+		fragments: fragments,
+	}
+	for i := range file.Tasks {
+		task := &file.Tasks[i]
+		if task.ID == "" {
+			v.report(SeverityError, task, "task without id")
+			continue
+		}
+		if _, ok := v.tasks[task.ID]; ok {
+			v.report(SeverityError, task, "duplicate task id")
+			continue
+		}
+		v.tasks[task.ID] = task
+	}
+	if _, ok := v.tasks["root"]; !ok {
+		v.report(SeverityError, nil, "no task with id 'root' found")
+	}
+
+	for i := range file.Tasks {
+		task := &file.Tasks[i]
+		v.checkConverters(task)
+		v.checkReferences(task)
+		v.checkRetry(task)
+		v.checkCascade(task)
+		v.checkBudget(task, task.Budget)
+	}
+	v.checkBudget(nil, file.Budget)
+	for _, model := range slices.Sorted(maps.Keys(file.Prices)) {
+		if price := file.Prices[model]; price.Prompt < 0 || price.Eval < 0 {
+			v.report(SeverityError, nil, "price of %s must not be negative", model)
+		}
+	}
+	v.checkCycles()
+	v.checkReachability()
+	v.checkOptions()
+	v.checkFragments()
+	return v
+}
+
+func (v *pipelineValidator) report(severity IssueSeverity, task *ConversionTaskStub, format string, args ...any) {
+	issue := PipelineIssue{
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	if task != nil {
+		issue.TaskID = task.ID
+		issue.Line = task.line
+	}
+	v.issues = append(v.issues, issue)
+}
+
+func (v *pipelineValidator) checkConverters(task *ConversionTaskStub) {
+	if task.Task == "" {
+		v.report(SeverityError, task, "no task converter defined")
+	} else if task.Task == SubpipelineTask {
+		name, ok := task.TaskArgs["pipeline"].(string)
+		if !ok {
+			v.report(SeverityError, task, "subpipeline task requires the task_args key 'pipeline'")
+		} else if _, ok := v.fragments[name]; !ok {
+			v.report(SeverityError, task, "unknown pipeline fragment '%s'", name)
+		}
+	} else if _, ok := ConverterFactories[task.Task]; !ok {
+		v.report(SeverityError, task, "unknown task converter '%s'", task.Task)
+	} else if task.Task == ExecTask {
+		if _, ok := task.TaskArgs["command"]; !ok {
+			v.report(SeverityError, task, "exec task requires the task_args key 'command'")
+		}
+	}
+	for _, slot := range []struct{ name, key string }{{"validation", task.Validation}, {"canApply", task.CanApply}} {
+		key := slot.key
+		if key == "" {
+			continue
+		}
+		if _, ok := ConverterFactories[key]; !ok {
+			v.report(SeverityError, task, "unknown %s converter '%s'", slot.name, key)
+		} else if !slices.Contains(checkConverters, key) {
+			v.report(SeverityError, task, "converter '%s' rewrites the working package and can not be used as %s", key, slot.name)
+		}
+	}
+	if task.Candidates != nil {
+		if task.Candidates.Count < 1 {
+			v.report(SeverityError, task, "candidates count must be at least 1")
+		}
+		if task.Validation == "" {
+			v.report(SeverityWarning, task, "candidates without validation can not be compared, the first one is kept")
+		}
+	}
+	if _, err := parseJoinPolicy(task.Join); err != nil {
+		v.report(SeverityError, task, "%v", err)
+	}
+	if task.Join != "" && len(task.Next) < 2 {
+		v.report(SeverityWarning, task, "join '%s' has no effect with less than two next tasks", task.Join)
+	}
+	for _, key := range slices.Sorted(maps.Keys(task.On)) {
+		if _, err := parseErrorClass(key); err != nil {
+			v.report(SeverityError, task, "%v", err)
+		}
+	}
+}
+
+func (v *pipelineValidator) checkReferences(task *ConversionTaskStub) {
+	for _, ref := range v.references(task) {
+		target, ok := v.tasks[ref.target]
+		if !ok {
+			v.report(SeverityError, task, "unknown %s task '%s'", ref.kind, ref.target)
+		} else if target.Task == ReviewTask && ref.kind != "next" {
+			v.report(SeverityError, task, "review task '%s' can not be a %s task, only the main flow can pause", ref.target, ref.kind)
+		} else if target.Task == ReviewTask && task.Join != "" && len(task.Next) > 1 {
+			v.report(SeverityError, task, "review task '%s' can not pause a concurrent branch", ref.target)
+		}
+	}
+	if task.Loop != nil {
+		v.checkLoop(task)
+	}
+}
+
+func (v *pipelineValidator) checkLoop(task *ConversionTaskStub) {
+	loop := task.Loop
+	if loop.MaxIterations < 1 {
+		v.report(SeverityError, task, "loop maxIterations must be at least 1")
+	}
+	if _, err := parseLoopCondition(string(loop.Until)); err != nil {
+		v.report(SeverityError, task, "%v", err)
+	}
+	target, ok := v.tasks[loop.Target]
+	if !ok {
+		v.report(SeverityError, task, "unknown loop target '%s'", loop.Target)
+		return
+	}
+	if target.ID != task.ID && !v.reaches(target, task.ID) {
+		v.report(SeverityError, task, "loop target '%s' is not an earlier task", loop.Target)
+	}
+}
+
+func (v *pipelineValidator) checkRetry(task *ConversionTaskStub) {
+	policy := task.Retry
+	if policy == nil {
+		return
+	}
+	if policy.Backoff < 0 {
+		v.report(SeverityError, task, "retry backoff must not be negative")
+	} else if policy.Backoff > 1 && task.RetryDelay == 0 {
+		v.report(SeverityWarning, task, "retry backoff has no effect without retryDelay")
+	}
+	if policy.MaxDelay < 0 {
+		v.report(SeverityError, task, "retry maxDelay must not be negative")
+	}
+	if policy.Jitter < 0 || policy.Jitter > 1 {
+		v.report(SeverityError, task, "retry jitter must be between 0 and 1")
+	}
+	for _, class := range slices.Sorted(maps.Keys(policy.Budgets)) {
+		if _, err := parseErrorClass(string(class)); err != nil {
+			v.report(SeverityError, task, "retry budget: %v", err)
+		} else if policy.Budgets[class] < 0 {
+			v.report(SeverityError, task, "retry budget of %s must not be negative", class)
+		}
+	}
+	for _, class := range policy.NoRetry {
+		if _, err := parseErrorClass(string(class)); err != nil {
+			v.report(SeverityError, task, "retry noRetry: %v", err)
+		} else if _, ok := policy.Budgets[class]; ok {
+			v.report(SeverityWarning, task, "retry budget of %s has no effect, the class is not retried", class)
+		}
+	}
+}
+
+func (v *pipelineValidator) checkCascade(task *ConversionTaskStub) {
+	if len(task.Cascade) == 0 {
+		return
+	}
+	if !slices.Contains(ConverterArgs[task.Task], "model_name") {
+		v.report(SeverityError, task, "cascade requires an LLM task, not '%s'", task.Task)
+	}
+	if task.MaxRetryCount != 0 {
+		v.report(SeverityWarning, task, "maxRetryCount has no effect, the tiers of the cascade set the retries")
+	}
+	names := make(map[string]bool)
+	llmKeys := llmArgKeys()
+	for i, tier := range task.Cascade.withNames() {
+		if tier.MaxRetryCount < 1 {
+			v.report(SeverityError, task, "cascade tier %s needs a maxRetryCount of at least 1", tier.Name)
+		}
+		if names[tier.Name] {
+			v.report(SeverityError, task, "cascade tier name %s is used twice", tier.Name)
+		}
+		names[tier.Name] = true
+		if len(tier.Options) == 0 && i > 0 {
+			v.report(SeverityWarning, task, "cascade tier %s has no options, it escalates to the same model", tier.Name)
+		}
+		for _, key := range slices.Sorted(maps.Keys(tier.Options)) {
+			if !slices.Contains(llmKeys, key) {
+				v.report(SeverityWarning, task, "cascade tier %s option '%s' is not an LLM option", tier.Name, key)
+			}
+		}
+	}
+}
+
+func (v *pipelineValidator) checkBudget(task *ConversionTaskStub, budget *Budget) {
+	if budget == nil {
+		return
+	}
+	if budget.PromptTokens < 0 || budget.EvalTokens < 0 || budget.Time < 0 || budget.Cost < 0 {
+		v.report(SeverityError, task, "budget limits must not be negative")
+	}
+	if budget.Cost > 0 && len(v.file.Prices) == 0 {
+		v.report(SeverityWarning, task, "budget cost has no effect without prices")
+	}
+}
+
+// reaches reports whether the task with the given id can be executed after the task from.
+func (v *pipelineValidator) reaches(from *ConversionTaskStub, id string) bool {
+	seen := map[string]bool{from.ID: true}
+	queue := []*ConversionTaskStub{from}
+	for len(queue) > 0 {
+		task := queue[0]
+		queue = queue[1:]
+		for _, ref := range v.references(task) {
+			if ref.target == id {
+				return true
+			}
+			if next, ok := v.tasks[ref.target]; ok && !seen[next.ID] {
+				seen[next.ID] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return false
+}
+
+type taskReference struct {
+	kind   string
+	target string
+}
+
+// references lists the tasks a task can continue with, in a stable order.
+func (v *pipelineValidator) references(task *ConversionTaskStub) []taskReference {
+	refs := make([]taskReference, 0)
+	for _, next := range task.Next {
+		refs = append(refs, taskReference{"next", next})
+	}
+	if task.Recovery != "" {
+		refs = append(refs, taskReference{"recovery", task.Recovery})
+	}
+	for _, class := range errorClasses {
+		if target, ok := task.On[string(class)]; ok {
+			refs = append(refs, taskReference{fmt.Sprintf("on %s", class), target})
+		}
+	}
+	return refs
+}
+
+func (v *pipelineValidator) checkCycles() {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	path := make([]string, 0)
+
+	var visit func(task *ConversionTaskStub)
+	visit = func(task *ConversionTaskStub) {
+		state[task.ID] = visiting
+		path = append(path, task.ID)
+		for _, ref := range v.references(task) {
+			next, ok := v.tasks[ref.target]
+			if !ok {
+				continue
+			}
+			switch state[next.ID] {
+			case unvisited:
+				visit(next)
+			case visiting:
+				cycle := append(slices.Clone(path[slices.Index(path, next.ID):]), next.ID)
+				v.report(SeverityError, task, "cycle via %s: %s", ref.kind, strings.Join(cycle, " -> "))
+			}
+		}
+		path = path[:len(path)-1]
+		state[task.ID] = visited
+	}
+
+	for i := range v.file.Tasks {
+		task := &v.file.Tasks[i]
+		if v.tasks[task.ID] == task && state[task.ID] == unvisited {
+			visit(task)
+		}
+	}
+}
+
+func (v *pipelineValidator) checkReachability() {
+	root, ok := v.tasks["root"]
+	if !ok {
+		return
+	}
+	reached := map[string]bool{root.ID: true}
+	queue := []*ConversionTaskStub{root}
+	for len(queue) > 0 {
+		task := queue[0]
+		queue = queue[1:]
+		for _, ref := range v.references(task) {
+			if next, ok := v.tasks[ref.target]; ok && !reached[next.ID] {
+				reached[next.ID] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	for i := range v.file.Tasks {
+		task := &v.file.Tasks[i]
+		if task.ID != "" && !reached[task.ID] {
+			v.report(SeverityWarning, task, "task is not reachable from root")
+		}
+	}
+}
+
+func (v *pipelineValidator) checkOptions() {
+	consumed := make(map[string]bool)
+	for i := range v.file.Tasks {
+		task := &v.file.Tasks[i]
+		keys := converterArgKeys(task.Task, task.Validation, task.CanApply)
+		for _, key := range keys {
+			consumed[key] = true
+		}
+		for _, key := range slices.Sorted(maps.Keys(task.TaskArgs)) {
+			if !slices.Contains(keys, key) {
+				v.report(SeverityWarning, task, "task_args key '%s' is not used by converter '%s'", key, task.Task)
+			}
+		}
+	}
+	// fragments inherit the options of the file
+	for _, fragment := range v.fragments {
+		for _, task := range fragment.Tasks {
+			for _, key := range converterArgKeys(task.Task, task.Validation, task.CanApply) {
+				consumed[key] = true
+			}
+		}
+	}
+	// options that are referenced with ${options.x}
+	v.checkVariables(nil, v.file.DefaultOptions, consumed)
+	for i := range v.file.Tasks {
+		v.checkVariables(&v.file.Tasks[i], v.file.Tasks[i].TaskArgs, consumed)
+	}
+	for _, key := range slices.Sorted(maps.Keys(v.file.DefaultOptions)) {
+		if !consumed[key] {
+			v.report(SeverityWarning, nil, "option '%s' is not used by any task", key)
+		}
+	}
+}
+
+// checkVariables marks the options referenced in the value as consumed and reports references to options that do
+// not exist and have no default.
+func (v *pipelineValidator) checkVariables(task *ConversionTaskStub, value interface{}, consumed map[string]bool) {
+	variableReferences(value, func(name, operator string) {
+		key, ok := strings.CutPrefix(name, optionsPrefix)
+		if !ok {
+			return
+		}
+		consumed[key] = true
+		if _, ok := v.file.DefaultOptions[key]; !ok && operator == "" {
+			v.report(SeverityWarning, task, "reference to unknown option '%s'", key)
+		}
+	})
+}
+
+// checkFragments validates the fragments defined in the file, their issues are reported with the fragment name as
+// task prefix.
+func (v *pipelineValidator) checkFragments() {
+	for _, name := range slices.Sorted(maps.Keys(v.file.Fragments)) {
+		fragment := v.file.Fragments[name]
+		if len(fragment.Prices) == 0 {
+			//fragments are priced with the table of the file that uses them
+			fragment.Prices = v.file.Prices
+		}
+		visible := maps.Clone(v.fragments)
+		maps.Copy(visible, fragment.Fragments)
+		for _, issue := range validatePipeline(fragment, visible).issues {
+			issue.TaskID = strings.TrimSuffix(fmt.Sprintf("%s/%s", name, issue.TaskID), "/")
+			if issue.File == "" {
+				issue.File = fragment.source
+			}
+			v.issues = append(v.issues, issue)
+		}
+	}
+}
+
+// checkFragmentCycles reports fragments that run themselves through subpipeline tasks.
+func (v *pipelineValidator) checkFragmentCycles() {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	path := make([]string, 0)
+
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		path = append(path, name)
+		for _, task := range v.fragments[name].Tasks {
+			target, ok := task.TaskArgs["pipeline"].(string)
+			if task.Task != SubpipelineTask || !ok {
+				continue
+			}
+			if _, ok := v.fragments[target]; !ok {
+				continue
+			}
+			switch state[target] {
+			case unvisited:
+				visit(target)
+			case visiting:
+				cycle := append(slices.Clone(path[slices.Index(path, target):]), target)
+				v.report(SeverityError, nil, "pipeline fragment cycle: %s", strings.Join(cycle, " -> "))
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(v.fragments)) {
+		if state[name] == unvisited {
+			visit(name)
+		}
+	}
+}
+
+// converterArgKeys lists the argument keys consumed by the given converters.
+func converterArgKeys(converters ...string) []string {
+	keys := make([]string, 0)
+	for _, converter := range converters {
+		keys = append(keys, ConverterArgs[converter]...)
+	}
+	return keys
+}
+
+// llmArgKeys lists the arguments of LLM backed converters, i.e., the reader and the model parameters of the client.
+func llmArgKeys() []string {
+	keys := []string{"prompt", "reader", "model_name", "GEMINI_MODEL", "max_tokens", "response_format", "system",
+		"max_completion_tokens", "repetition_penalty", "cache", "stream", "stream_max_tokens"}
+	return append(keys, jsonFieldNames(reflect.TypeOf(api.Options{}))...)
+}
+
+func jsonFieldNames(t reflect.Type) []string {
+	names := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			names = append(names, jsonFieldNames(field.Type)...)
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// variablePattern matches `${VAR}`, `${options.x}`, `${VAR:-default}` and `${VAR:?message}`. A leading `$$` escapes
+// the reference, `$${VAR}` becomes the literal text `${VAR}`.
+var variablePattern = regexp.MustCompile(`\$(\$?)\{([A-Za-z_][A-Za-z0-9_.]*)(?:(:[-?])([^}]*))?}`)
+
+const optionsPrefix = "options."
+
+// variableScope resolves the references in the options and task arguments of a pipeline file. `${options.x}` refers
+// to the option x of the file, any other name to the process environment. Per-request overrides win over both.
+type variableScope struct {
+	options   map[string]interface{}
+	overrides map[string]any
+	lookupEnv func(string) (string, bool)
+	//options that were already interpolated
+	resolved map[string]interface{}
+	//options that are interpolated right now, to detect options that refer to themselves
+	resolving map[string]bool
+}
+
+func newVariableScope(options map[string]interface{}, overrides map[string]any) *variableScope {
+	return &variableScope{
+		options:   options,
+		overrides: overrides,
+		lookupEnv: os.LookupEnv,
+		resolved:  make(map[string]interface{}),
+		resolving: make(map[string]bool),
+	}
+}
+
+// interpolate returns a copy of the file with all references in the options and task arguments replaced. The
+// overrides of the file replace options of the same name. All references that are required but not set are reported
+// at once.
+func (file PipelineFile) interpolate() (PipelineFile, error) {
+	scope := newVariableScope(file.DefaultOptions, file.overrides)
+	errs := make([]error, 0)
+
+	options := make(map[string]interface{})
+	for _, key := range slices.Sorted(maps.Keys(file.DefaultOptions)) {
+		value, err := scope.option(key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("option %s: %w", key, err))
+		}
+		options[key] = value
+	}
+	maps.Copy(options, file.overrides)
+	file.DefaultOptions = options
+
+	tasks := make([]ConversionTaskStub, len(file.Tasks))
+	for i, task := range file.Tasks {
+		if task.TaskArgs != nil {
+			args, err := scope.interpolate(task.TaskArgs)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("task %s: %w", task.ID, err))
+			}
+			task.TaskArgs = args.(map[string]interface{})
+		}
+		if len(task.Cascade) > 0 {
+			cascade := make(ModelCascade, len(task.Cascade))
+			for j, tier := range task.Cascade {
+				options, err := scope.interpolate(tier.Options)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("task %s: cascade: %w", task.ID, err))
+				}
+				tier.Options, _ = options.(map[string]interface{})
+				cascade[j] = tier
+			}
+			task.Cascade = cascade
+		}
+		tasks[i] = task
+	}
+	file.Tasks = tasks
+	return file, errors.Join(errs...)
+}
+
+// option returns the interpolated value of an option, it is nil if the option does not exist.
+func (s *variableScope) option(key string) (interface{}, error) {
+	if value, ok := s.resolved[key]; ok {
+		return value, nil
+	}
+	raw, ok := s.options[key]
+	if !ok {
+		return nil, nil
+	}
+	if s.resolving[key] {
+		return nil, fmt.Errorf("option %s refers to itself", key)
+	}
+	s.resolving[key] = true
+	defer delete(s.resolving, key)
+
+	value, err := s.interpolate(raw)
+	if err == nil {
+		s.resolved[key] = value
+	}
+	return value, err
+}
+
+// interpolate replaces the references in all strings of the value, maps and lists are interpolated recursively.
+func (s *variableScope) interpolate(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return s.expand(v)
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		errs := make([]error, 0)
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			item, err := s.interpolate(v[key])
+			if err != nil {
+				errs = append(errs, err)
+			}
+			result[key] = item
+		}
+		return result, errors.Join(errs...)
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		errs := make([]error, 0)
+		for i, item := range v {
+			item, err := s.interpolate(item)
+			if err != nil {
+				errs = append(errs, err)
+			}
+			result[i] = item
+		}
+		return result, errors.Join(errs...)
+	}
+	return value, nil
+}
+
+// expand replaces the references in the text. A text that consists of a single reference takes the type of the
+// referenced value, e.g., `num_ctx: ${options.ctx}` stays a number.
+func (s *variableScope) expand(text string) (interface{}, error) {
+	matches := variablePattern.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text, nil
+	}
+	if m := matches[0]; len(matches) == 1 && m[0] == 0 && m[1] == len(text) && m[2] == m[3] {
+		return s.resolve(text[m[4]:m[5]], group(text, m, 3), group(text, m, 4))
+	}
+
+	var builder strings.Builder
+	errs := make([]error, 0)
+	last := 0
+	for _, m := range matches {
+		builder.WriteString(text[last:m[0]])
+		last = m[1]
+		if m[2] != m[3] {
+			//escaped reference, drop the leading $
+			builder.WriteString(text[m[0]+1 : m[1]])
+			continue
+		}
+		value, err := s.resolve(text[m[4]:m[5]], group(text, m, 3), group(text, m, 4))
+		if err != nil {
+			errs = append(errs, err)
+		}
+		if value != nil {
+			builder.WriteString(fmt.Sprint(value))
+		}
+	}
+	builder.WriteString(text[last:])
+	return builder.String(), errors.Join(errs...)
+}
+
+func group(text string, match []int, i int) string {
+	if match[2*i] < 0 {
+		return ""
+	}
+	return text[match[2*i]:match[2*i+1]]
+}
+
+// resolve looks up a single reference. Like in a shell, unset and empty values are replaced by the default of
+// `:-default`, and fail the interpolation for `:?message`.
+func (s *variableScope) resolve(name, operator, arg string) (interface{}, error) {
+	value, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if value != nil && value != "" {
+		return value, nil
+	}
+	switch operator {
+	case ":-":
+		return scalar(arg), nil
+	case ":?":
+		if arg == "" {
+			arg = "is required but not set"
+		}
+		return nil, fmt.Errorf("${%s}: %s", name, arg)
+	}
+	return "", nil
+}
+
+func (s *variableScope) lookup(name string) (interface{}, error) {
+	if key, ok := strings.CutPrefix(name, optionsPrefix); ok {
+		if value, ok := s.overrides[key]; ok {
+			return value, nil
+		}
+		return s.option(key)
+	}
+	if value, ok := s.overrides[name]; ok {
+		return value, nil
+	}
+	if value, ok := s.lookupEnv(name); ok {
+		return scalar(value), nil
+	}
+	return nil, nil
+}
+
+// scalar decodes numbers and booleans of environment values and defaults, any other text stays a string.
+func scalar(text string) interface{} {
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(text), &value); err != nil {
+		return text
+	}
+	switch value.(type) {
+	case int, float64, bool:
+		return value
+	}
+	return text
+}
+
+// forRequest returns the pipeline compiled with the overrides of the request. Pipelines that were not compiled from a
+// pipeline file can not be overridden and are returned as they are.
+func (p *Pipeline) forRequest(req *ConversionRequest) (*Pipeline, error) {
+	if len(req.Overrides) == 0 || p.source == nil {
+		return p, nil
+	}
+	file := *p.source
+	file.overrides = req.Overrides
+	return compilePipeline(file)
+}
+
+// variableReferences calls visit for every reference in the strings of the value, escaped references are skipped.
+func variableReferences(value interface{}, visit func(name, operator string)) {
+	switch v := value.(type) {
+	case string:
+		for _, m := range variablePattern.FindAllStringSubmatchIndex(v, -1) {
+			if m[2] == m[3] {
+				visit(v[m[4]:m[5]], group(v, m, 3))
+			}
+		}
+	case map[string]interface{}:
+		for _, key := range slices.Sorted(maps.Keys(v)) {
+			variableReferences(v[key], visit)
+		}
+	case []interface{}:
+		for _, item := range v {
+			variableReferences(item, visit)
+		}
+	}
+}
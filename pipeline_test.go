@@ -0,0 +1,1472 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// converterFunc adapts a function to the Converter interface for engine tests.
+type converterFunc func(*PipelineRunner, *ConversionRequest) error
+
+func (f converterFunc) Apply(runner *PipelineRunner, req *ConversionRequest) error {
+	return f(runner, req)
+}
+
+// rewrite replaces the working package root file and marks the given number of test cases as passed.
+func rewrite(root string, passed int, err error) converterFunc {
+	return func(runner *PipelineRunner, req *ConversionRequest) error {
+		req.WorkingPackage.RootFile = root
+		for i := 0; i < passed; i++ {
+			req.Metrics.TestCases[fmt.Sprintf("t%d", i)] = true
+		}
+		return err
+	}
+}
+
+func testRequest() *ConversionRequest {
+	req := MakeConversionRequest(&DeploymentPackage{
+		RootFile:   "source",
+		TestFiles:  make(map[string]string),
+		BuildFiles: make(map[string]string),
+	})
+	req.WorkingPackage = req.SourcePackage.copy()
+	return req
+}
+
+func testRunner() *PipelineRunner {
+	return &PipelineRunner{Context: context.Background()}
+}
+
+func branchPipeline(join JoinPolicy, branches ...*ConversionTask) *Pipeline {
+	return NewPipeline(&ConversionTask{
+		ID:            "root",
+		Execute:       &NoOpConverter{},
+		MaxRetryCount: 1,
+		Next:          branches,
+		Join:          join,
+	})
+}
+
+func branch(id string, execute Converter) *ConversionTask {
+	return &ConversionTask{ID: id, Execute: execute, MaxRetryCount: 1}
+}
+
+func TestJoinFirstKeepsSuccessfulBranch(t *testing.T) {
+	pipeline := branchPipeline(JoinFirst,
+		branch("a", rewrite("a", 0, fmt.Errorf("a failed"))),
+		branch("b", rewrite("b", 1, nil)),
+	)
+	req := testRequest()
+
+	err := pipeline.Execute(testRunner(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", req.WorkingPackage.RootFile)
+	assert.Equal(t, "source", req.SourcePackage.RootFile)
+}
+
+// funcClient answers invocations with the function, it gets the model of the invocation.
+type funcClient struct {
+	stubClient
+	invoke func(ctx context.Context, model string) (string, error)
+}
+
+func (f *funcClient) InvokeLLM(ctx context.Context, buf bytes.Buffer) (string, Metrics, error) {
+	model, _ := invocationOf(ctx).Args["model_name"].(string)
+	response, err := f.invoke(ctx, model)
+	return response, Metrics{}, err
+}
+
+func llmBranch(id, model string) *ConversionTask {
+	return branch(id, makeLLMConverter(map[string]interface{}{"prompt": "convert {{.code}}", "model_name": model}))
+}
+
+func TestJoinBranchesInvokeLLMConcurrently(t *testing.T) {
+	pipeline := branchPipeline(JoinAll, llmBranch("a", "qwen2.5-coder:7b"), llmBranch("b", "qwen2.5-coder:14b"))
+	req := testRequest()
+	//neither branch gets an answer before both invoke the LLM
+	err := pipeline.Execute(&PipelineRunner{Context: context.Background(), client: newBarrierClient(2)}, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "// qwen2.5-coder:7b", req.WorkingPackage.RootFile)
+
+	//the fast branch answers once the slow one is generating, so it is canceled while it invokes the LLM
+	generating, canceled := make(chan struct{}), make(chan struct{})
+	client := &funcClient{invoke: func(ctx context.Context, model string) (string, error) {
+		if model == "slow" {
+			close(generating)
+			<-ctx.Done()
+			close(canceled)
+			return "", ctx.Err()
+		}
+		<-generating
+		return `{"main.go": "// fast"}`, nil
+	}}
+	pipeline = branchPipeline(JoinFirst, llmBranch("slow", "slow"), llmBranch("fast", "fast"))
+	req = testRequest()
+	err = pipeline.Execute(&PipelineRunner{Context: context.Background(), client: client}, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "// fast", req.WorkingPackage.RootFile)
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the losing branch was not canceled")
+	}
+}
+
+func TestJoinAllFailsOnAnyBranch(t *testing.T) {
+	pipeline := branchPipeline(JoinAll,
+		branch("a", rewrite("a", 2, nil)),
+		branch("b", rewrite("b", 0, fmt.Errorf("b failed"))),
+	)
+	req := testRequest()
+
+	err := pipeline.Execute(testRunner(), req)
+	assert.ErrorContains(t, err, "b failed")
+	assert.Equal(t, "b", req.WorkingPackage.RootFile)
+}
+
+func TestJoinBestKeepsHighestScore(t *testing.T) {
+	pipeline := branchPipeline(JoinBest,
+		branch("a", rewrite("a", 1, nil)),
+		branch("b", rewrite("b", 3, nil)),
+		branch("c", rewrite("c", 2, nil)),
+	)
+	req := testRequest()
+
+	err := pipeline.Execute(testRunner(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", req.WorkingPackage.RootFile)
+	assert.Len(t, req.Metrics.TestCases, 3)
+	assert.Equal(t, 4, req.Metrics.Tasks)
+}
+
+func TestJoinPolicyFromPipelineFile(t *testing.T) {
+	pipeline, err := PipelineReader(bytes.NewReader([]byte(`
+tasks:
+  - id: "root"
+    task: "noop"
+    maxRetryCount: 1
+    join: "best"
+    next: ["a", "b"]
+  - id: "a"
+    task: "noop"
+    maxRetryCount: 1
+  - id: "b"
+    task: "noop"
+    maxRetryCount: 1
+`)))
+	assert.NoError(t, err)
+	assert.Equal(t, JoinBest, pipeline.FirstTask.Join)
+	assert.Len(t, pipeline.FirstTask.Next, 2)
+
+	_, err = PipelineReader(bytes.NewReader([]byte(`
+tasks:
+  - id: "root"
+    task: "noop"
+    join: "fastest"
+`)))
+	assert.ErrorContains(t, err, "unknown join policy")
+}
+
+// sequence returns the given errors on consecutive calls and succeeds afterwards.
+func sequence(errs ...error) converterFunc {
+	calls := 0
+	return func(runner *PipelineRunner, req *ConversionRequest) error {
+		calls++
+		if calls <= len(errs) {
+			return errs[calls-1]
+		}
+		return nil
+	}
+}
+
+// record appends the task id to the trail each time it is applied.
+func record(trail *[]string, id string) converterFunc {
+	return func(runner *PipelineRunner, req *ConversionRequest) error {
+		*trail = append(*trail, id)
+		return nil
+	}
+}
+
+func TestErrorRouting(t *testing.T) {
+	trail := make([]string, 0)
+	fallback := branch("fallback", record(&trail, "fallback"))
+	builder := &ConversionTask{
+		ID: "builder",
+		Execute: sequence(
+			CompilationError{fmt.Errorf("undefined: x")},
+			TestingError{fmt.Errorf("1 tests failed"), 1},
+			fmt.Errorf("unexpected"),
+		),
+		MaxRetryCount: 4,
+		OnFailure:     fallback,
+		OnError: map[ErrorClass]*ConversionTask{
+			CompilationFailure: branch("fixer", record(&trail, "fixer")),
+			TestingFailure:     branch("realign", record(&trail, "realign")),
+		},
+	}
+
+	err := NewPipeline(builder).Execute(testRunner(), testRequest())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"fixer", "realign", "fallback"}, trail)
+}
+
+func TestPreconditionRouting(t *testing.T) {
+	trail := make([]string, 0)
+	task := &ConversionTask{
+		ID:            "convert",
+		Execute:       record(&trail, "convert"),
+		CanApply:      sequence(fmt.Errorf("no working root file defined")),
+		MaxRetryCount: 2,
+		OnError: map[ErrorClass]*ConversionTask{
+			PreconditionFailure: branch("restore", record(&trail, "restore")),
+		},
+	}
+
+	err := NewPipeline(task).Execute(testRunner(), testRequest())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"restore", "convert"}, trail)
+}
+
+func TestErrorRoutesFromPipelineFile(t *testing.T) {
+	pipeline, err := PipelineReader(bytes.NewReader([]byte(`
+tasks:
+  - id: "root"
+    task: "noop"
+    maxRetryCount: 1
+    recovery: "fallback"
+    on:
+      CompilationError: "fixer"
+      LLMError: "fallback"
+  - id: "fixer"
+    task: "noop"
+    maxRetryCount: 1
+  - id: "fallback"
+    task: "noop"
+    maxRetryCount: 1
+`)))
+	assert.NoError(t, err)
+	assert.Equal(t, "fixer", pipeline.FirstTask.OnError[CompilationFailure].ID)
+	assert.Equal(t, "fallback", pipeline.FirstTask.OnError[LLMFailure].ID)
+	assert.Equal(t, "fallback", pipeline.FirstTask.OnFailure.ID)
+
+	_, err = PipelineReader(bytes.NewReader([]byte(`
+tasks:
+  - id: "root"
+    task: "noop"
+    on:
+      SyntaxError: "root"
+`)))
+	assert.ErrorContains(t, err, "unknown error class")
+}
+
+func TestRetryBudgetsPerErrorClass(t *testing.T) {
+	transport := LLMError{error: fmt.Errorf("connection refused"), Transport: true}
+	task := &ConversionTask{
+		ID: "convert",
+		Execute: sequence(
+			transport, transport, transport,
+			CompilationError{fmt.Errorf("undefined: x")},
+		),
+		MaxRetryCount: 2,
+		Retry:         &RetryPolicy{Budgets: map[ErrorClass]int{LLMTransportFailure: 3}},
+	}
+	req := testRequest()
+	err := NewPipeline(task).Execute(testRunner(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, req.attempt(task))
+	assert.Equal(t, 1, req.spent(task))
+
+	task.Execute = sequence(transport, transport, transport)
+	task.Retry.Budgets[LLMTransportFailure] = 2
+	err = NewPipeline(task).Execute(testRunner(), testRequest())
+	assert.ErrorContains(t, err, "connection refused")
+
+	trail := make([]string, 0)
+	task = &ConversionTask{
+		ID:            "convert",
+		Execute:       sequence(ReviewError{fmt.Errorf("rejected")}),
+		MaxRetryCount: 3,
+		OnFailure:     branch("fallback", record(&trail, "fallback")),
+		Retry:         &RetryPolicy{NoRetry: []ErrorClass{ReviewFailure}},
+	}
+	err = NewPipeline(task).Execute(testRunner(), testRequest())
+	assert.ErrorContains(t, err, "rejected")
+	assert.Empty(t, trail)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := &RetryPolicy{Backoff: 2, MaxDelay: Duration(5 * time.Second)}
+	assert.Equal(t, time.Second, policy.delay(time.Second, 0))
+	assert.Equal(t, 4*time.Second, policy.delay(time.Second, 2))
+	assert.Equal(t, 5*time.Second, policy.delay(time.Second, 3))
+	assert.Equal(t, time.Second, (*RetryPolicy)(nil).delay(time.Second, 3))
+
+	policy.Jitter = 0.5
+	for range 10 {
+		delay := policy.delay(time.Second, 1)
+		assert.GreaterOrEqual(t, delay, time.Second)
+		assert.LessOrEqual(t, delay, 3*time.Second)
+	}
+}
+
+func TestLLMErrorClasses(t *testing.T) {
+	transport := classifyLLMError(&net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")})
+	content := LLMError{error: fmt.Errorf("invalid json")}
+	assert.True(t, LLMTransportFailure.matches(transport))
+	assert.False(t, LLMContentFailure.matches(transport))
+	assert.True(t, LLMContentFailure.matches(content))
+	assert.True(t, LLMFailure.matches(transport))
+	assert.True(t, LLMFailure.matches(content))
+	assert.Equal(t, content, classifyLLMError(content))
+	assert.True(t, LLMTransportFailure.matches(classifyLLMError(fmt.Errorf("generate: %w", context.DeadlineExceeded))))
+	assert.True(t, LLMContentFailure.matches(classifyLLMError(fmt.Errorf("model_name required"))))
+	assert.True(t, LLMTransportFailure.matches(llmStatusError(502, fmt.Errorf("bad gateway"))))
+	assert.True(t, LLMContentFailure.matches(llmStatusError(400, fmt.Errorf("bad request"))))
+
+	file, err := ReadPipelineFile(bytes.NewReader([]byte(`
+tasks:
+  - id: "root"
+    task: "noop"
+    maxRetryCount: 2
+    retryDelay: 1s
+    retry:
+      backoff: 2
+      maxDelay: 1m
+      jitter: 1.5
+      budgets:
+        LLMTransportError: 5
+        SyntaxError: 1
+      noRetry: [ReviewError]
+`)))
+	assert.NoError(t, err)
+	issues := ValidatePipeline(file)
+	assert.Len(t, issues, 2)
+	assert.Contains(t, issues.Err().Error(), "retry jitter must be between 0 and 1")
+	assert.Contains(t, issues.Err().Error(), "unknown error class: SyntaxError")
+	assert.Equal(t, 5, file.Tasks[0].Retry.Budgets[LLMTransportFailure])
+}
+
+func TestMissingModelIsReported(t *testing.T) {
+	pipeline, err := PipelineReader(bytes.NewReader([]byte(`tasks:
+  - id: "root"
+    task: "llmTask"
+    maxRetryCount: 1
+    task_args:
+      prompt: "convert {{.code}}"
+`)))
+	assert.NoError(t, err)
+	for _, name := range []string{"ollama", "deepseek"} {
+		client, err := LLMClientFactories[name](map[string]interface{}{"OLLAMA_API_URL": "http://localhost:1"})
+		assert.NoError(t, err)
+		req := testRequest()
+		err = pipeline.Execute(&PipelineRunner{Context: context.Background(), client: client}, req)
+		assert.ErrorContains(t, err, "model_name required")
+		assert.True(t, LLMContentFailure.matches(err))
+	}
+}
+
+func TestValidatePipelineReportsAllIssues(t *testing.T) {
+	file, err := ReadPipelineFile(bytes.NewReader([]byte(`options:
+  model_name: "qwen2.5-coder:14b"
+  temprature: 0.1
+tasks:
+  - id: "start"
+    task: "cleaner"
+    maxRetryCount: 1
+    next: ["convrt"]
+  - id: "convert"
+    task: "coder"
+    validation: "fixer"
+    next: ["builder"]
+  - id: "builder"
+    task: "goBilder"
+    recovery: "convert"
+`)))
+	assert.NoError(t, err)
+
+	issues := ValidatePipeline(file)
+	messages := make([]string, 0)
+	for _, issue := range issues {
+		messages = append(messages, issue.String())
+	}
+	assert.Equal(t, []string{
+		"error: no task with id 'root' found",
+		"line 5: error: task start: unknown next task 'convrt'",
+		"line 9: error: task convert: converter 'fixer' rewrites the working package and can not be used as validation",
+		"line 13: error: task builder: unknown task converter 'goBilder'",
+		"line 13: error: task builder: cycle via recovery: convert -> builder -> convert",
+		"warning: option 'temprature' is not used by any task",
+	}, messages)
+
+	_, err = compilePipeline(file)
+	var validationErr PipelineValidationError
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Len(t, validationErr.Issues, 5)
+}
+
+func TestValidateDefaultPipeline(t *testing.T) {
+	file, err := ReadPipelineFile(bytes.NewReader([]byte(defaultPipelineFile)))
+	assert.NoError(t, err)
+	assert.Empty(t, ValidatePipeline(file))
+}
+
+// tests records a test run in the trail and passes the given number of the two test cases per run.
+func tests(trail *[]string, passed ...int) converterFunc {
+	run := 0
+	return func(runner *PipelineRunner, req *ConversionRequest) error {
+		*trail = append(*trail, "test")
+		score := passed[min(run, len(passed)-1)]
+		run++
+		req.Metrics.TestCases["t0"] = score > 0
+		req.Metrics.TestCases["t1"] = score > 1
+		if score < 2 {
+			return TestingError{fmt.Errorf("%d tests failed", 2-score), 2 - score}
+		}
+		return nil
+	}
+}
+
+func loopPipeline(trail *[]string, until LoopCondition, passed ...int) *Pipeline {
+	realign := &ConversionTask{
+		ID:            "realign",
+		Execute:       record(trail, "realign"),
+		MaxRetryCount: 1,
+		Loop:          &TaskLoop{Target: "builder", MaxIterations: 3, Until: until},
+	}
+	tester := &ConversionTask{
+		ID:            "tester",
+		Execute:       tests(trail, passed...),
+		MaxRetryCount: 2,
+		OnError:       map[ErrorClass]*ConversionTask{TestingFailure: realign},
+	}
+	return NewPipeline(&ConversionTask{
+		ID:            "builder",
+		Execute:       record(trail, "build"),
+		MaxRetryCount: 1,
+		Next:          []*ConversionTask{tester},
+	})
+}
+
+func TestLoopUntilTestsPass(t *testing.T) {
+	trail := make([]string, 0)
+	req := testRequest()
+
+	err := loopPipeline(&trail, LoopUntilTestsPass, 0, 1, 2).Execute(testRunner(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"build", "test", "realign",
+		"build", "test", "realign",
+		"build", "test",
+	}, trail)
+	assert.Equal(t, 2, req.Metrics.Loops["realign"])
+}
+
+func TestLoopUntilNoImprovement(t *testing.T) {
+	trail := make([]string, 0)
+	req := testRequest()
+
+	err := loopPipeline(&trail, LoopUntilNoImprovement, 1).Execute(testRunner(), req)
+	assert.ErrorAs(t, err, &TestingError{})
+	assert.Equal(t, []string{
+		"build", "test", "realign",
+		"build", "test", "realign", "test",
+	}, trail)
+	assert.Equal(t, 1, req.Metrics.Loops["realign"])
+}
+
+func TestNestedLoops(t *testing.T) {
+	trail := make([]string, 0)
+	outer := &ConversionTask{
+		ID:            "outer",
+		Execute:       record(&trail, "outer"),
+		MaxRetryCount: 1,
+		Loop:          &TaskLoop{Target: "root", MaxIterations: 2},
+	}
+	inner := &ConversionTask{
+		ID:            "inner",
+		Execute:       record(&trail, "inner"),
+		MaxRetryCount: 1,
+		Loop:          &TaskLoop{Target: "coder", MaxIterations: 1},
+		Next:          []*ConversionTask{outer},
+	}
+	coder := &ConversionTask{ID: "coder", Execute: record(&trail, "coder"), MaxRetryCount: 1, Next: []*ConversionTask{inner}}
+	root := &ConversionTask{ID: "root", Execute: record(&trail, "root"), MaxRetryCount: 1, Next: []*ConversionTask{coder}}
+	req := testRequest()
+
+	err := NewPipeline(root).Execute(testRunner(), req)
+	assert.NoError(t, err)
+	//the inner loop iterates again in each iteration of the outer loop
+	iteration := []string{"root", "coder", "inner", "coder", "inner", "outer"}
+	assert.Equal(t, slices.Concat(iteration, iteration, iteration), trail)
+	assert.Equal(t, map[string]int{"inner": 3, "outer": 2}, req.Metrics.Loops)
+}
+
+func TestLoopFromPipelineFile(t *testing.T) {
+	file, err := ReadPipelineFile(bytes.NewReader([]byte(`tasks:
+  - id: "root"
+    task: "goBuilder"
+    maxRetryCount: 1
+    next: ["tester"]
+  - id: "tester"
+    task: "goTester"
+    maxRetryCount: 2
+    on:
+      TestingError: "realign"
+  - id: "realign"
+    task: "noop"
+    maxRetryCount: 1
+    loop:
+      target: "root"
+      maxIterations: 3
+      until: "testsPass"
+  - id: "other"
+    task: "noop"
+    maxRetryCount: 1
+    loop:
+      target: "realign"
+`)))
+	assert.NoError(t, err)
+	assert.Equal(t, PipelineIssues{
+		{Severity: SeverityError, TaskID: "other", Line: 18, Message: "loop maxIterations must be at least 1"},
+		{Severity: SeverityError, TaskID: "other", Line: 18, Message: "loop target 'realign' is not an earlier task"},
+		{Severity: SeverityWarning, TaskID: "other", Line: 18, Message: "task is not reachable from root"},
+	}, ValidatePipeline(file))
+
+	file.Tasks = file.Tasks[:3]
+	pipeline, err := compilePipeline(file)
+	assert.NoError(t, err)
+	realign := pipeline.FirstTask.Next[0].OnError[TestingFailure]
+	assert.Equal(t, &TaskLoop{Target: "root", MaxIterations: 3, Until: LoopUntilTestsPass}, realign.Loop)
+}
+
+// stuck blocks until the runner context is done, like a model that never answers.
+func stuck(runner *PipelineRunner, req *ConversionRequest) error {
+	<-runner.Done()
+	return runner.Err()
+}
+
+func TestTaskTimeout(t *testing.T) {
+	trail := make([]string, 0)
+	task := &ConversionTask{
+		ID:            "coder",
+		Execute:       converterFunc(stuck),
+		MaxRetryCount: 2,
+		Timeout:       10 * time.Millisecond,
+		OnError: map[ErrorClass]*ConversionTask{
+			TimeoutFailure: branch("cheap", record(&trail, "cheap")),
+		},
+	}
+	req := testRequest()
+
+	err := NewPipeline(task).Execute(testRunner(), req)
+	assert.ErrorAs(t, err, &TimeoutError{})
+	assert.Equal(t, []string{"cheap"}, trail)
+	assert.Equal(t, 2, req.Metrics.Timeouts)
+	assert.False(t, req.Metrics.DeadlineExceeded)
+}
+
+func TestJobDeadline(t *testing.T) {
+	pipeline := NewPipeline(&ConversionTask{
+		ID:            "coder",
+		Execute:       converterFunc(stuck),
+		MaxRetryCount: 3,
+		RetryDelay:    time.Hour,
+	})
+	pipeline.Deadline = 10 * time.Millisecond
+	req := testRequest()
+
+	err := pipeline.Execute(testRunner(), req)
+	assert.ErrorAs(t, err, &TimeoutError{})
+	assert.True(t, req.Metrics.DeadlineExceeded)
+	assert.Equal(t, 0, req.Metrics.Timeouts)
+	assert.Less(t, req.Metrics.TotalTime, time.Minute)
+}
+
+func TestResumeFromCheckpoint(t *testing.T) {
+	store, err := OpenCheckpointStore(t.TempDir())
+	assert.NoError(t, err)
+	trail := make([]string, 0)
+	crashed := false
+	pipeline := NewPipeline(&ConversionTask{
+		ID:            "root",
+		Execute:       &NoOpConverter{},
+		MaxRetryCount: 1,
+		Next: []*ConversionTask{
+			branch("a", record(&trail, "a")),
+			branch("b", converterFunc(func(runner *PipelineRunner, req *ConversionRequest) error {
+				if !crashed {
+					crashed = true
+					panic("service stopped")
+				}
+				trail = append(trail, "b")
+				return nil
+			})),
+			branch("c", record(&trail, "c")),
+		},
+	})
+	runner := testRunner()
+	runner.pipeline = pipeline
+	runner.checkpoints = store
+	req := testRequest()
+
+	assert.Error(t, pipeline.Execute(runner, req))
+	assert.Equal(t, []string{"a"}, trail)
+
+	unfinished, err := store.Unfinished()
+	assert.NoError(t, err)
+	assert.Len(t, unfinished, 1)
+	assert.Equal(t, []string{"root", "b"}, unfinished[0].Path)
+
+	err = runner.Convert(unfinished[0].request())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, trail)
+}
+
+// eventNames records the type and task of each event the runner emits.
+func eventNames(runner *PipelineRunner) *[]string {
+	names := make([]string, 0)
+	var mutex sync.Mutex
+	runner.events = NewEventBus()
+	runner.Subscribe(ObserverFunc(func(event PipelineEvent) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		names = append(names, fmt.Sprintf("%T %s", event, event.Header().TaskID))
+	}))
+	return &names
+}
+
+func TestObserverUnsubscribesWhileNotified(t *testing.T) {
+	bus := NewEventBus()
+	notified := 0
+	var unsubscribe func()
+	unsubscribe = bus.Subscribe(ObserverFunc(func(event PipelineEvent) {
+		notified++
+		unsubscribe()
+	}))
+	done := make(chan struct{})
+	go func() {
+		bus.Publish(TaskStarted{})
+		bus.Publish(TaskStarted{})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish blocked on the observer that unsubscribed")
+	}
+	assert.Equal(t, 1, notified)
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	coder := &ConversionTask{
+		ID:            "coder",
+		Execute:       sequence(fmt.Errorf("bad code")),
+		MaxRetryCount: 3,
+		OnFailure:     branch("fixer", &NoOpConverter{}),
+		Validation:    sequence(TestingError{fmt.Errorf("tests failed"), 1}),
+	}
+	runner := testRunner()
+	events := eventNames(runner)
+
+	err := NewPipeline(coder).Execute(runner, testRequest())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"main.TaskStarted coder",
+		"main.AttemptFailed coder",
+		"main.RecoveryStarted coder",
+		"main.TaskStarted fixer",
+		"main.TaskSucceeded fixer",
+		"main.RetryScheduled coder",
+		"main.ValidationFailed coder",
+		"main.TaskStarted coder",
+		"main.TaskSucceeded coder",
+		"main.PipelineFinished ",
+	}, *events)
+}
+
+func TestWorkingPackageRolledBackEvent(t *testing.T) {
+	task := &ConversionTask{
+		ID: "coder",
+		Execute: converterFunc(func(runner *PipelineRunner, req *ConversionRequest) error {
+			req.WorkingPackage = nil
+			return fmt.Errorf("lost package")
+		}),
+		MaxRetryCount: 1,
+	}
+	runner := testRunner()
+	events := eventNames(runner)
+	req := testRequest()
+
+	err := NewPipeline(task).Execute(runner, req)
+	assert.Error(t, err)
+	assert.Contains(t, *events, "main.WorkingPackageRolledBack coder")
+	assert.NotNil(t, req.WorkingPackage)
+}
+
+func TestTracePerAttempt(t *testing.T) {
+	calls := 0
+	coder := &ConversionTask{
+		ID:        "coder",
+		Converter: "coder",
+		Execute: converterFunc(func(runner *PipelineRunner, req *ConversionRequest) error {
+			calls++
+			req.span.recordLLM(Metrics{ConversionPromptTokenCount: 10 * calls, ConversionEvalTokenCount: calls})
+			if calls == 1 {
+				return fmt.Errorf("bad code")
+			}
+			return nil
+		}),
+		MaxRetryCount: 2,
+		OnFailure:     branch("fixer", &NoOpConverter{}),
+		Next:          []*ConversionTask{branch("tester", rewrite("tested", 2, nil))},
+	}
+	req := testRequest()
+
+	err := NewPipeline(coder).Execute(testRunner(), req)
+	assert.NoError(t, err)
+
+	trace := req.Trace
+	assert.Equal(t, SpanJob, trace.Kind)
+	assert.Len(t, trace.Children, 3)
+	first, second, tester := trace.Children[0], trace.Children[1], trace.Children[2]
+	assert.Equal(t, "coder", first.Converter)
+	assert.Equal(t, 0, first.Attempt)
+	assert.Equal(t, 10, first.PromptTokens)
+	assert.Equal(t, "bad code", first.Error)
+	assert.Len(t, first.Children, 1)
+	assert.Equal(t, "fixer", first.Children[0].TaskID)
+	assert.Equal(t, 1, second.Attempt)
+	assert.Equal(t, 20, second.PromptTokens)
+	assert.Empty(t, second.Error)
+	assert.Equal(t, "tester", tester.TaskID)
+
+	data, err := json.Marshal(trace)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"task":"fixer"`)
+}
+
+func TestCandidateSamplingKeepsBest(t *testing.T) {
+	passed := []int{1, 2, 2}
+	similarity := []float64{0.1, 0.5, 0.9}
+	sampler := &CandidateSampler{
+		TaskID:   "coder",
+		Sampling: CandidateSampling{Count: 3},
+		Execute: converterFunc(func(runner *PipelineRunner, req *ConversionRequest) error {
+			req.WorkingPackage.RootFile = fmt.Sprintf("candidate %d", runner.llmArgs["seed"])
+			return nil
+		}),
+		Validation: converterFunc(func(runner *PipelineRunner, req *ConversionRequest) error {
+			var seed int
+			_, _ = fmt.Sscanf(req.WorkingPackage.RootFile, "candidate %d", &seed)
+			req.Metrics.TestCases["a"] = passed[seed] > 0
+			req.Metrics.TestCases["b"] = passed[seed] > 1
+			req.Metrics.TestSimilarity = map[string]float64{"a": similarity[seed], "b": similarity[seed]}
+			return nil
+		}),
+	}
+	req := testRequest()
+
+	err := NewPipeline(&ConversionTask{ID: "coder", Execute: sampler, MaxRetryCount: 1}).Execute(testRunner(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "candidate 2", req.WorkingPackage.RootFile)
+	assert.Equal(t, 2, req.testScore())
+	assert.Len(t, req.Metrics.Candidates, 3)
+	for i, outcome := range req.Metrics.Candidates {
+		assert.Equal(t, i, outcome.Index)
+		assert.Equal(t, passed[i], outcome.TestsPassed)
+		assert.Equal(t, i == 2, outcome.Selected)
+	}
+	assert.Len(t, req.Trace.Children[0].Children, 3)
+}
+
+func TestCandidatesFromPipelineFile(t *testing.T) {
+	pipeline, err := PipelineReader(bytes.NewReader([]byte(`
+tasks:
+  - id: "root"
+    task: "noop"
+    validation: "noop"
+    maxRetryCount: 1
+    candidates:
+      count: 4
+      temperatures: [0.2, 0.8]
+`)))
+	assert.NoError(t, err)
+	sampler, ok := pipeline.FirstTask.Execute.(*CandidateSampler)
+	assert.True(t, ok)
+	assert.Equal(t, 4, sampler.Sampling.Count)
+	assert.Equal(t, map[string]any{"temperature": 0.8}, sampler.Sampling.args(3))
+}
+
+func TestCandidatesAreBuiltBeforeTesting(t *testing.T) {
+	pipeline, err := PipelineReader(bytes.NewReader([]byte(`
+options:
+  strategy: "json"
+tasks:
+  - id: "root"
+    task: "llmTask"
+    task_args:
+      prompt: "convert {{.code}}"
+    validation: "goTester"
+    maxRetryCount: 1
+    candidates:
+      count: 2
+`)))
+	assert.NoError(t, err)
+	sampler := pipeline.FirstTask.Execute.(*CandidateSampler)
+	assert.IsType(t, &GolangBuilder{}, sampler.Build)
+
+	//the candidate with seed 1 answers correctly
+	client := &funcClient{invoke: func(ctx context.Context, model string) (string, error) {
+		seed, _ := invocationOf(ctx).Args["seed"].(int)
+		answer, err := json.Marshal(map[string]string{
+			"main.go": fmt.Sprintf("package main\n\nimport (\n\t\"context\"\n\t\"encoding/json\"\n)\n\n"+
+				"func handle(ctx context.Context, input json.RawMessage) (any, error) {\n"+
+				"\treturn map[string]int{\"answer\": %d}, nil\n}\n", 41+seed),
+			"go.mod": "module example.com/fn\n\ngo 1.24\n",
+		})
+		return string(answer), err
+	}}
+	runner := &PipelineRunner{Context: context.Background(), client: client}
+	defer runner.cleanup()
+	req := testRequest()
+	req.WorkingPackage.TestFiles["answer"] = `{"input": "{}", "output": "{\"answer\": 42}"}`
+
+	err = pipeline.Execute(runner, req)
+	assert.NoError(t, err)
+	assert.Contains(t, req.WorkingPackage.RootFile, `"answer": 42`)
+	assert.Equal(t, map[string]bool{"answer": true}, req.Metrics.TestCases)
+	assert.Equal(t, []bool{false, true}, []bool{req.Metrics.Candidates[0].Selected, req.Metrics.Candidates[1].Selected})
+	main, err := os.ReadFile(runner.WorkingDir + "/main.go")
+	assert.NoError(t, err)
+	assert.Equal(t, req.WorkingPackage.RootFile, string(main))
+
+	task := req.Trace.Children[0]
+	assert.Nil(t, task.TestCases, "the kept candidate is not tested again")
+	for _, candidate := range task.Children {
+		assert.NotZero(t, candidate.BuildTime)
+		assert.Len(t, candidate.TestCases, 1)
+	}
+}
+
+// scored marks the given number of test cases as passed and scores the revision of the working package.
+func scored(passed int) converterFunc {
+	return func(runner *PipelineRunner, req *ConversionRequest) error {
+		req.Metrics.TestCases = map[string]bool{"a": passed > 0, "b": passed > 1}
+		req.scoreRevision()
+		return nil
+	}
+}
+
+func TestRevisionHistory(t *testing.T) {
+	coder := &ConversionTask{
+		ID:            "coder",
+		Execute:       rewrite("a", 0, nil),
+		Validation:    scored(2),
+		MaxRetryCount: 1,
+		Next: []*ConversionTask{{
+			ID:            "realign",
+			Execute:       rewrite("b", 0, nil),
+			Validation:    scored(1),
+			MaxRetryCount: 1,
+		}},
+	}
+	req := testRequest()
+
+	err := NewPipeline(coder).Execute(testRunner(), req)
+	assert.NoError(t, err)
+	assert.Len(t, req.Revisions, 3)
+	source, first, second := req.Revisions[0], req.Revisions[1], req.Revisions[2]
+	assert.False(t, source.Tested)
+	assert.Equal(t, "coder", first.TaskID)
+	assert.Equal(t, 2, first.Score)
+	assert.Contains(t, first.Diff, "-source\n+a\n")
+	assert.Equal(t, "realign", second.TaskID)
+	assert.Equal(t, 1, second.Score)
+	assert.Equal(t, "b", req.WorkingPackage.RootFile)
+
+	best := req.bestRevision()
+	assert.Equal(t, 1, best.Number)
+	assert.Equal(t, "a", best.Package.RootFile)
+}
+
+func TestConcurrentConversions(t *testing.T) {
+	// fails the first attempt of every request, succeeds once the request was retried
+	flaky := converterFunc(func(runner *PipelineRunner, req *ConversionRequest) error {
+		if req.WorkingPackage.RootFile != "retried" {
+			req.WorkingPackage.RootFile = "retried"
+			return fmt.Errorf("first attempt")
+		}
+		dir, err := os.MkdirTemp("", "fn_lmm")
+		if err != nil {
+			return err
+		}
+		runner.cleanup()
+		runner.WorkingDir = dir
+		return nil
+	})
+	runner := testRunner()
+	runner.pipeline = NewPipeline(&ConversionTask{ID: "coder", Execute: flaky, MaxRetryCount: 2})
+
+	requests := make([]*ConversionRequest, 8)
+	var wg sync.WaitGroup
+	for i := range requests {
+		requests[i] = testRequest()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, runner.Convert(requests[i]))
+		}()
+	}
+	wg.Wait()
+
+	for _, req := range requests {
+		assert.Len(t, req.Trace.Children, 2)
+		assert.Equal(t, 1, req.Trace.Children[1].Attempt)
+	}
+	assert.Empty(t, runner.WorkingDir)
+}
+
+func TestSubpipelineFromPipelineFile(t *testing.T) {
+	file, err := ReadPipelineFile(bytes.NewReader([]byte(`include: ["fragments/build.yaml"]
+options:
+  model_name: "qwen2.5-coder:14b"
+fragments:
+  polish:
+    tasks:
+      - id: "root"
+        task: "noop"
+        maxRetryCount: 1
+        next: ["build"]
+      - id: "build"
+        task: "subpipeline"
+        task_args:
+          pipeline: "build"
+tasks:
+  - id: "root"
+    task: "subpipeline"
+    maxRetryCount: 1
+    task_args:
+      pipeline: "polish"
+`)))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"build", "polish"}, slices.Collect(maps.Keys(file.Fragments)))
+	assert.Equal(t, "fragments/build.yaml", file.Fragments["build"].source)
+	assert.Empty(t, ValidatePipeline(file))
+
+	pipeline, err := compilePipeline(file)
+	assert.NoError(t, err)
+	polish := pipeline.FirstTask.Execute.(*SubPipelineConverter)
+	assert.Equal(t, "polish", polish.Fragment)
+	build := polish.Pipeline.FirstTask.Next[0].Execute.(*SubPipelineConverter)
+	assert.Equal(t, "fixer", build.Pipeline.FirstTask.OnFailure.ID)
+
+	file.Fragments["build"].Tasks[0].Task = "goBilder"
+	file.Fragments["polish"].Tasks[1].TaskArgs["pipeline"] = "polish"
+	messages := make([]string, 0)
+	for _, issue := range ValidatePipeline(file) {
+		messages = append(messages, issue.String())
+	}
+	assert.Equal(t, []string{
+		"fragments/build.yaml: line 4: error: task build/root: unknown task converter 'goBilder'",
+		"error: pipeline fragment cycle: polish -> polish",
+	}, messages)
+}
+
+func TestSubpipelineRetryBudgetAndMetrics(t *testing.T) {
+	failures := 0
+	fragment := NewPipeline(&ConversionTask{
+		ID: "root",
+		Execute: converterFunc(func(runner *PipelineRunner, req *ConversionRequest) error {
+			req.Metrics.ConversionPromptTokenCount += 10
+			if failures++; failures%2 == 1 {
+				return fmt.Errorf("fragment attempt failed")
+			}
+			return nil
+		}),
+		MaxRetryCount: 2,
+	})
+	sub := &SubPipelineConverter{TaskID: "build", Fragment: "build", Pipeline: fragment}
+	pipeline := NewPipeline(&ConversionTask{
+		ID:            "build",
+		Execute:       sub,
+		MaxRetryCount: 1,
+		Next: []*ConversionTask{{
+			ID:            "again",
+			Execute:       &SubPipelineConverter{TaskID: "again", Fragment: "build", Pipeline: fragment},
+			MaxRetryCount: 1,
+		}},
+	})
+	req := testRequest()
+
+	err := pipeline.Execute(testRunner(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, failures)
+	assert.Equal(t, 40, req.Metrics.ConversionPromptTokenCount)
+	assert.Equal(t, 20, req.Metrics.Scopes["build"].ConversionPromptTokenCount)
+	assert.Equal(t, 20, req.Metrics.Scopes["again"].ConversionPromptTokenCount)
+}
+
+func TestPipelineVariables(t *testing.T) {
+	t.Setenv("FAASLLM_MODEL", "qwen2.5-coder:32b")
+	t.Setenv("FAASLLM_CTX", "8192")
+	file, err := ReadPipelineFile(bytes.NewReader([]byte(`options:
+  model_name: "${FAASLLM_MODEL:-qwen2.5-coder:14b}"
+  num_ctx: "${FAASLLM_CTX}"
+  temperature: "${FAASLLM_TEMPERATURE:-0.2}"
+tasks:
+  - id: "root"
+    task: "llmTask"
+    maxRetryCount: 1
+    task_args:
+      prompt: "use ${options.model_name} with $${options.num_ctx} tokens"
+      top_p: "${options.top_p:-0.9}"
+`)))
+	assert.NoError(t, err)
+	assert.Empty(t, ValidatePipeline(file))
+
+	pipeline, err := compilePipeline(file)
+	assert.NoError(t, err)
+	converter := pipeline.FirstTask.Execute.(*LLMConverter)
+	args := converter.args
+	assert.Equal(t, "qwen2.5-coder:32b", args["model_name"])
+	assert.Equal(t, 8192, args["num_ctx"])
+	assert.Equal(t, 0.2, args["temperature"])
+	assert.Equal(t, 0.9, args["top_p"])
+	assert.Equal(t, "use qwen2.5-coder:32b with ${options.num_ctx} tokens", converter.template.Tree.Root.String())
+
+	req := testRequest()
+	req.Overrides = map[string]any{"model_name": "gemma3:27b"}
+	overridden, err := pipeline.forRequest(req)
+	assert.NoError(t, err)
+	converter = overridden.FirstTask.Execute.(*LLMConverter)
+	assert.Equal(t, "gemma3:27b", converter.args["model_name"])
+	assert.Equal(t, "use gemma3:27b with ${options.num_ctx} tokens", converter.template.Tree.Root.String())
+
+	file.DefaultOptions["api_key"] = "${FAASLLM_API_KEY:?set the API key of the model}"
+	file.Tasks[0].TaskArgs["reader"] = "${FAASLLM_READER:?}"
+	_, err = compilePipeline(file)
+	assert.ErrorContains(t, err, "option api_key: ${FAASLLM_API_KEY}: set the API key of the model")
+	assert.ErrorContains(t, err, "task root: ${FAASLLM_READER}: is required but not set")
+}
+
+func TestExecConverter(t *testing.T) {
+	pipeline, err := PipelineReader(bytes.NewReader([]byte(`tasks:
+  - id: "root"
+    task: "exec"
+    maxRetryCount: 1
+    task_args:
+      command: ["sh", "-c", "grep -q '\"RootFile\":\"source\"' && echo '{\"workingPackage\": {\"RootFile\": \"linted\"}, \"metrics\": {\"conversion_prompt_token_count\": 5, \"test_cases\": {\"a\": true}}}'"]
+`)))
+	assert.NoError(t, err)
+	req := testRequest()
+	err = pipeline.Execute(testRunner(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, "linted", req.WorkingPackage.RootFile)
+	assert.NotNil(t, req.WorkingPackage.BuildFiles)
+	assert.Equal(t, 5, req.Metrics.ConversionPromptTokenCount)
+	assert.Equal(t, 1, req.testScore())
+
+	failing := &ExecConverter{Command: []string{"sh", "-c", `echo '{"error": "vet failed", "errorClass": "CompilationError"}'`}}
+	err = failing.Apply(testRunner(), testRequest())
+	assert.EqualError(t, err, "vet failed")
+	assert.True(t, CompilationFailure.matches(err))
+
+	crashing := &ExecConverter{Command: []string{"sh", "-c", "echo broken >&2; exit 3"}}
+	err = crashing.Apply(testRunner(), testRequest())
+	assert.ErrorContains(t, err, "exit status 3 broken")
+}
+
+func TestReviewPausesAndResumes(t *testing.T) {
+	trail := make([]string, 0)
+	issues := make([]string, 0)
+	fixer := converterFunc(func(runner *PipelineRunner, req *ConversionRequest) error {
+		issues = append(issues, req.err[len(req.err)-1].Error())
+		return nil
+	})
+	review := &ConversionTask{
+		ID:            "review",
+		Execute:       &ReviewConverter{},
+		MaxRetryCount: 2,
+		OnError:       map[ErrorClass]*ConversionTask{ReviewFailure: {ID: "fixer", Execute: fixer, MaxRetryCount: 1}},
+		Next:          []*ConversionTask{{ID: "deploy", Execute: record(&trail, "deploy"), MaxRetryCount: 1}},
+	}
+	runner := testRunner()
+	runner.pipeline = NewPipeline(&ConversionTask{
+		ID:            "root",
+		Execute:       rewrite("generated", 0, nil),
+		MaxRetryCount: 1,
+		Next:          []*ConversionTask{review},
+	})
+	req := testRequest()
+
+	err := runner.Convert(req)
+	pause, ok := asReviewPause(err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"root", "review"}, pause.checkpoint.Path)
+	assert.Empty(t, trail)
+	assert.Empty(t, req.err)
+
+	req.pause(pause)
+	assert.Equal(t, "review", req.awaitingReview())
+	req.review = &ReviewDecision{TaskID: "review", Verdict: ReviewReject, Comment: "keep the handler signature"}
+	err = runner.Convert(req)
+	pause, ok = asReviewPause(err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"the reviewer rejected the package: keep the handler signature"}, issues)
+	assert.Equal(t, 1, pause.checkpoint.RetryCounts["review"])
+
+	req.pause(pause)
+	edited := req.WorkingPackage.copy()
+	edited.RootFile = "edited"
+	req.review = &ReviewDecision{TaskID: "review", Verdict: ReviewEdit, Package: edited}
+	err = runner.Convert(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"deploy"}, trail)
+	assert.Equal(t, "edited", req.WorkingPackage.RootFile)
+}
+
+func TestReenterFinishedJob(t *testing.T) {
+	trail := make([]string, 0)
+	tester := sequence(fmt.Errorf("tests failed"))
+	runner := testRunner()
+	runner.pipeline = NewPipeline(&ConversionTask{
+		ID:            "root",
+		Execute:       record(&trail, "root"),
+		MaxRetryCount: 1,
+		Next: []*ConversionTask{{
+			ID: "tester",
+			Execute: converterFunc(func(runner *PipelineRunner, req *ConversionRequest) error {
+				trail = append(trail, "tester")
+				return tester(runner, req)
+			}),
+			MaxRetryCount: 1,
+		}},
+	})
+	req := testRequest()
+
+	err := runner.Convert(req)
+	assert.EqualError(t, err, "tests failed")
+	assert.Equal(t, []string{"root", "tester"}, trail)
+
+	assert.ErrorContains(t, req.reenter(runner.pipeline, "fixer", ResumeRecord{}), "not part of the main flow")
+	err = req.reenter(runner.pipeline, "tester", ResumeRecord{EditedPackage: true})
+	assert.NoError(t, err)
+	err = runner.Convert(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"root", "tester", "tester"}, trail)
+	assert.Len(t, req.Metrics.Resumes, 1)
+	assert.Equal(t, "tester", req.Metrics.Resumes[0].TaskID)
+	assert.Len(t, req.Trace.Children, 3)
+	assert.EqualError(t, req.err[0], "tests failed")
+}
+
+func TestPipelineFileRoundTrip(t *testing.T) {
+	file, err := ReadPipelineFile(bytes.NewReader([]byte(defaultPipelineFile)))
+	assert.NoError(t, err)
+	data, err := yaml.Marshal(file)
+	assert.NoError(t, err)
+	parsed, err := ReadPipelineFile(bytes.NewReader(data))
+	assert.NoError(t, err)
+	assert.Equal(t, file.Tasks[0].RetryDelay, parsed.Tasks[0].RetryDelay)
+	assert.Empty(t, ValidatePipeline(parsed).Errors())
+}
+
+func TestDurationsFromJSON(t *testing.T) {
+	var options ConverterOptions
+	err := json.Unmarshal([]byte(`{"pipeline": {
+  "deadline": "5m",
+  "budget": {"time": "1h30m"},
+  "tasks": [{"id": "root", "task": "noop", "timeout": "2m", "retryDelay": 3000000000, "retry": {"maxDelay": "10s"}}]
+}}`), &options)
+	assert.NoError(t, err)
+	file := options.Pipeline
+	assert.Equal(t, Duration(5*time.Minute), file.Deadline)
+	assert.Equal(t, Duration(90*time.Minute), file.Budget.Time)
+	assert.Equal(t, Duration(2*time.Minute), file.Tasks[0].Timeout)
+	assert.Equal(t, Duration(3*time.Second), file.Tasks[0].RetryDelay)
+	assert.Equal(t, Duration(10*time.Second), file.Tasks[0].Retry.MaxDelay)
+
+	data, err := json.Marshal(file)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"timeout":"2m0s"`)
+	var parsed PipelineFile
+	assert.NoError(t, json.Unmarshal(data, &parsed))
+	assert.Equal(t, file.Tasks[0].Timeout, parsed.Tasks[0].Timeout)
+
+	err = json.Unmarshal([]byte(`{"pipeline": {"tasks": [{"id": "root", "timeout": "2 minutes"}]}}`), &options)
+	assert.ErrorContains(t, err, `unknown unit " minutes"`)
+}
+
+func TestDryRun(t *testing.T) {
+	pipeline, err := PipelineReader(bytes.NewReader([]byte(`
+tasks:
+  - id: "root"
+    task: "coder"
+    task_args:
+      prompt: "convert {{.code}}"
+    maxRetryCount: 1
+    next: ["builder"]
+  - id: "builder"
+    task: "goBuilder"
+    validation: "goTester"
+    maxRetryCount: 3
+    retryDelay: 1h
+    recovery: "fixer"
+    retry:
+      budgets:
+        LLMTransportError: 1
+  - id: "fixer"
+    task: "exec"
+    task_args:
+      command: "false"
+    maxRetryCount: 1
+`)))
+	assert.NoError(t, err)
+	scenario, err := ReadScenario(strings.NewReader(`
+tasks:
+  builder: [CompilationError, LLMTransportError, ok]
+validation:
+  builder: tests 2/2
+expect:
+  tasks: [root, builder, fixer, builder, fixer, builder]
+  result: ok
+`))
+	assert.NoError(t, err)
+
+	report, err := pipeline.DryRun(scenario)
+	assert.NoError(t, err)
+	assert.NoError(t, report.Err)
+	assert.NoError(t, report.Check(scenario.Expect))
+	assert.Contains(t, report.Steps, DryRunStep{TaskID: "builder", Event: "fail", Attempt: 1, Detail: "LLMTransportError: scripted LLMTransportError"})
+
+	scenario.Tasks["builder"] = OutcomeScript{"CompilationError"}
+	report, err = pipeline.DryRun(scenario)
+	assert.NoError(t, err)
+	assert.Equal(t, "CompilationError", report.Result())
+	assert.ErrorContains(t, report.Check(scenario.Expect), "expected result ok, got CompilationError")
+
+	_, err = pipeline.DryRun(&Scenario{Tasks: map[string]OutcomeScript{"tester": {"ok"}}})
+	assert.ErrorContains(t, err, "unknown task tester")
+	_, err = ReadScenario(strings.NewReader(`tasks: {builder: [SyntaxError]}`))
+	assert.ErrorContains(t, err, "unknown error class: SyntaxError")
+}
+
+func TestModelCascade(t *testing.T) {
+	stub := &stubClient{}
+	pipeline, err := PipelineReader(bytes.NewReader([]byte(`options:
+  model_name: "qwen2.5-coder:14b"
+tasks:
+  - id: "root"
+    task: "llmTask"
+    task_args:
+      prompt: "convert {{.code}}"
+    cascade:
+      - maxRetryCount: 2
+        options: {model_name: "qwen2.5-coder:7b"}
+      - name: "large"
+        maxRetryCount: 2
+        options: {model_name: "qwen2.5-coder:32b"}
+`)))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, pipeline.FirstTask.MaxRetryCount)
+	pipeline.FirstTask.Validation = converterFunc(func(runner *PipelineRunner, req *ConversionRequest) error {
+		if !strings.Contains(req.WorkingPackage.RootFile, "32b") {
+			return TestingError{fmt.Errorf("1 tests failed"), 1}
+		}
+		return nil
+	})
+
+	req := testRequest()
+	err = pipeline.Execute(&PipelineRunner{Context: context.Background(), client: stub}, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, stub.calls)
+	assert.Equal(t, "// qwen2.5-coder:32b 3", req.WorkingPackage.RootFile)
+
+	small, large := req.Metrics.Tiers["root/qwen2.5-coder:7b"], req.Metrics.Tiers["root/large"]
+	assert.Equal(t, 2, small.Attempts)
+	assert.False(t, small.Succeeded)
+	assert.Equal(t, 1, large.Attempts)
+	assert.True(t, large.Succeeded)
+	assert.Equal(t, 30, large.EvalTokens)
+	assert.Equal(t, req.Metrics.ConversionEvalTokenCount, small.EvalTokens+large.EvalTokens)
+	tiers := make([]string, 0)
+	for _, span := range req.Trace.Children {
+		tiers = append(tiers, span.Tier)
+	}
+	assert.Equal(t, []string{"qwen2.5-coder:7b", "qwen2.5-coder:7b", "large"}, tiers)
+
+	issues := ValidatePipeline(PipelineFile{Tasks: []ConversionTaskStub{{
+		ID:      "root",
+		Task:    "goBuilder",
+		Cascade: ModelCascade{{MaxRetryCount: 0, Options: map[string]interface{}{"model_name": "a"}}},
+	}}})
+	assert.ErrorContains(t, issues.Err(), "cascade requires an LLM task")
+	assert.ErrorContains(t, issues.Err(), "cascade tier a needs a maxRetryCount of at least 1")
+}
+
+func TestBudgets(t *testing.T) {
+	failing := converterFunc(func(runner *PipelineRunner, req *ConversionRequest) error {
+		return TestingError{fmt.Errorf("1 tests failed"), 1}
+	})
+	budgetPipeline := func(budgets string) *Pipeline {
+		pipeline, err := PipelineReader(strings.NewReader(`options:
+  model_name: "qwen2.5-coder:14b"
+prices:
+  default: {prompt: 0.5, eval: 1000}
+` + budgets + `
+tasks:
+  - id: "root"
+    task: "llmTask"
+    maxRetryCount: 5
+    task_args:
+      prompt: "convert {{.code}}"
+`))
+		assert.NoError(t, err)
+		pipeline.FirstTask.Validation = failing
+		return pipeline
+	}
+
+	stub := &stubClient{}
+	req := testRequest()
+	err := budgetPipeline("budget: {evalTokens: 25}").Execute(&PipelineRunner{Context: context.Background(), client: stub}, req)
+	assert.ErrorAs(t, err, &BudgetError{})
+	assert.Equal(t, 2, stub.calls)
+	assert.Equal(t, "budget exceeded: job used 30 of 25 eval tokens", req.Metrics.BudgetExceeded)
+
+	stub = &stubClient{}
+	req = testRequest()
+	pipeline := budgetPipeline("")
+	pipeline.FirstTask.Budget = &Budget{Cost: 0.05}
+	err = pipeline.Execute(&PipelineRunner{Context: context.Background(), client: stub}, req)
+	assert.ErrorContains(t, err, "budget exceeded: task root used a cost of")
+	assert.Equal(t, 3, stub.calls)
+	assert.InDelta(t, 0.06+0.5*float64(req.Metrics.ConversionPromptTokenCount)/1e6, req.Metrics.Cost, 1e-9)
+
+	issues := ValidatePipeline(PipelineFile{
+		Budget: &Budget{Cost: 1},
+		Tasks:  []ConversionTaskStub{{ID: "root", Task: "noop", Budget: &Budget{EvalTokens: -1}}},
+	})
+	assert.ErrorContains(t, issues.Err(), "budget limits must not be negative")
+	messages := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		messages = append(messages, issue.Message)
+	}
+	assert.Contains(t, messages, "budget cost has no effect without prices")
+}
+
+func TestTimeBudgetCountsActiveTime(t *testing.T) {
+	pipeline := NewPipeline(&ConversionTask{ID: "root", Execute: &NoOpConverter{}, MaxRetryCount: 1})
+	pipeline.Budget = &Budget{Time: Duration(time.Minute)}
+
+	//a job that started long ago but was paused most of the time
+	req := testRequest()
+	req.Metrics.StartTime = time.Now().Add(-time.Hour)
+	req.Metrics.ActiveTime = 30 * time.Second
+	assert.NoError(t, pipeline.Execute(testRunner(), req))
+	assert.GreaterOrEqual(t, req.Metrics.ActiveTime, 30*time.Second)
+	assert.Less(t, req.Metrics.ActiveTime, time.Minute)
+
+	//the checkpoint keeps the time the job ran, it is resumed with it
+	cp := makeCheckpoint(pipeline, nil, req)
+	cp.ActiveTime = 2 * time.Minute
+	err := pipeline.Execute(testRunner(), cp.request())
+	assert.ErrorContains(t, err, "budget exceeded: job used 2m0s of 1m0s")
+}
+
+// barrierClient holds every invocation until the given number of invocations run at the same time, it answers with
+// the model of the invocation.
+type barrierClient struct {
+	stubClient
+	mutex    sync.Mutex
+	inFlight int
+	parties  int
+	ready    chan struct{}
+}
+
+func newBarrierClient(parties int) *barrierClient {
+	return &barrierClient{parties: parties, ready: make(chan struct{})}
+}
+
+func (b *barrierClient) InvokeLLM(ctx context.Context, buf bytes.Buffer) (string, Metrics, error) {
+	b.mutex.Lock()
+	b.inFlight++
+	if b.inFlight == b.parties {
+		close(b.ready)
+	}
+	b.mutex.Unlock()
+	select {
+	case <-b.ready:
+	case <-ctx.Done():
+		return "", Metrics{}, ctx.Err()
+	case <-time.After(5 * time.Second):
+		return "", Metrics{}, fmt.Errorf("invocations did not run concurrently")
+	}
+	model, _ := invocationOf(ctx).Args["model_name"].(string)
+	return fmt.Sprintf(`{"main.go": "// %s"}`, model), Metrics{}, nil
+}
+
+func TestConcurrentInvocations(t *testing.T) {
+	runner := &PipelineRunner{Context: context.Background(), client: newBarrierClient(2), pipeline: llmPipeline(t), events: NewEventBus()}
+	models := []string{"qwen2.5-coder:7b", "qwen2.5-coder:32b"}
+	requests := make([]*ConversionRequest, len(models))
+	errs := make([]error, len(models))
+	var wg sync.WaitGroup
+	for i, model := range models {
+		requests[i] = testRequest()
+		requests[i].Overrides = map[string]any{"model_name": model}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = runner.Convert(requests[i])
+		}()
+	}
+	wg.Wait()
+	//both jobs invoked the shared client at the same time, each with its own options
+	for i, model := range models {
+		assert.NoError(t, errs[i])
+		assert.Equal(t, "// "+model, requests[i].WorkingPackage.RootFile)
+	}
+}
+
+func TestBranchesKeepOverridesAndRevisions(t *testing.T) {
+	var overrides map[string]any
+	fix := converterFunc(func(runner *PipelineRunner, req *ConversionRequest) error {
+		overrides = req.Overrides
+		req.WorkingPackage.RootFile = "fixed"
+		return nil
+	})
+	root := &ConversionTask{
+		ID:            "root",
+		Execute:       &NoOpConverter{},
+		Validation:    scored(1),
+		MaxRetryCount: 1,
+		Next:          []*ConversionTask{{ID: "fix", Execute: fix, Validation: scored(2), MaxRetryCount: 1}},
+		Join:          JoinFirst,
+	}
+	req := testRequest()
+	req.Overrides = map[string]any{"model_name": "gemma3:27b"}
+
+	err := NewPipeline(root).Execute(testRunner(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, req.Overrides, overrides)
+	assert.Len(t, req.Revisions, 2)
+	source, fixed := req.Revisions[0], req.Revisions[1]
+	assert.True(t, source.Tested)
+	assert.Equal(t, 1, source.Score)
+	assert.Equal(t, 1, fixed.Number)
+	assert.Equal(t, "fix", fixed.TaskID)
+	assert.Equal(t, 2, fixed.Score)
+	assert.Contains(t, fixed.Diff, "-source\n+fixed\n")
+}
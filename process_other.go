@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import (
+	"os/exec"
+)
+
+// killOnCancel only kills the started process, child processes keep running until they exit on their own.
+func killOnCancel(cmd *exec.Cmd) {
+	cmd.WaitDelay = processWaitDelay
+}
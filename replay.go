@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReplayMode decides whether the replay client records the invocations of its backend or serves recorded ones.
+type ReplayMode string
+
+const (
+	// ReplayRecord invokes the backend and adds each prompt and response to the cassette.
+	ReplayRecord ReplayMode = "record"
+	// ReplayServe answers from the cassette without a backend and fails on prompts that were not recorded.
+	ReplayServe ReplayMode = "replay"
+)
+
+// Cassette is the file the replay client records to, interactions are keyed by the hash of the model, the request
+// options and the normalized prompt.
+type Cassette struct {
+	Interactions map[string]*Interaction `json:"interactions"`
+}
+
+// Interaction is a recorded invocation of the LLM.
+type Interaction struct {
+	Model    string                 `json:"model"`
+	Options  map[string]interface{} `json:"options,omitempty"`
+	Prompt   string                 `json:"prompt"`
+	Response string                 `json:"response"`
+	Metrics  CallMetrics            `json:"metrics"`
+	Recorded time.Time              `json:"recorded"`
+}
+
+// CallMetrics are the metrics of a single LLM invocation.
+type CallMetrics struct {
+	ConversionTime             time.Duration `json:"conversion_time"`
+	ConversionPromptTime       time.Duration `json:"conversion_prompt_time"`
+	ConversionEvalTime         time.Duration `json:"conversion_eval_time"`
+	ConversionPromptTokenCount int           `json:"conversion_prompt_token_count"`
+	ConversionEvalTokenCount   int           `json:"conversion_eval_token_count"`
+}
+
+func callMetrics(metrics Metrics) CallMetrics {
+	return CallMetrics{
+		ConversionTime:             metrics.ConversionTime,
+		ConversionPromptTime:       metrics.ConversionPromptTime,
+		ConversionEvalTime:         metrics.ConversionEvalTime,
+		ConversionPromptTokenCount: metrics.ConversionPromptTokenCount,
+		ConversionEvalTokenCount:   metrics.ConversionEvalTokenCount,
+	}
+}
+
+func (m CallMetrics) metrics() Metrics {
+	return Metrics{
+		ConversionTime:             m.ConversionTime,
+		ConversionPromptTime:       m.ConversionPromptTime,
+		ConversionEvalTime:         m.ConversionEvalTime,
+		ConversionPromptTokenCount: m.ConversionPromptTokenCount,
+		ConversionEvalTokenCount:   m.ConversionEvalTokenCount,
+	}
+}
+
+// buildDirPattern matches the temporary build directories of the builder, which differ between runs and can appear in
+// build errors of the prompt.
+var buildDirPattern = regexp.MustCompile(regexp.QuoteMeta(filepath.Join(os.TempDir(), "fn_lmm")) + `[0-9]+`)
+
+// normalizePrompt removes differences of a prompt that do not change its meaning, i.e., line endings, trailing
+// whitespace and build directories.
+func normalizePrompt(prompt string) string {
+	prompt = buildDirPattern.ReplaceAllString(prompt, "$$BUILD_DIR")
+	lines := strings.Split(strings.ReplaceAll(prompt, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// promptKey hashes the model, the request options and the normalized prompt like the entries of the cache.
+func promptKey(args map[string]interface{}, prompt string) (string, error) {
+	options, err := optionsKey(args)
+	if err != nil {
+		return "", err
+	}
+	return entryKey(options, prompt), nil
+}
+
+// ReplayInvocationClient wraps another client to record its invocations in a cassette, or replays the cassette
+// without any backend, e.g., to run whole pipelines offline and in CI.
+type ReplayInvocationClient struct {
+	Mode         ReplayMode
+	CassetteFile string
+	//backend of the recording, nil in replay mode
+	client   LLMInvocationClient
+	mutex    sync.Mutex
+	cassette *Cassette
+}
+
+func makeReplayClient(args map[string]interface{}) (LLMInvocationClient, error) {
+	rc := &ReplayInvocationClient{}
+	err := rc.Configure(args)
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func init() {
+	// registered here, the replay client creates its backend from the factories
+	LLMClientFactories["replay"] = makeReplayClient
+}
+
+func (rc *ReplayInvocationClient) Configure(args map[string]interface{}) error {
+	cassette, ok := args["REPLAY_CASSETTE"].(string)
+	if !ok || cassette == "" {
+		return fmt.Errorf("REPLAY_CASSETTE required")
+	}
+	rc.CassetteFile = cassette
+	rc.Mode = ReplayServe
+	if mode, ok := args["REPLAY_MODE"].(string); ok && mode != "" {
+		rc.Mode = ReplayMode(mode)
+	}
+	if err := rc.load(); err != nil {
+		return err
+	}
+
+	switch rc.Mode {
+	case ReplayServe:
+		return nil
+	case ReplayRecord:
+		backend, _ := args["REPLAY_CLIENT"].(string)
+		if backend == "" || backend == "replay" {
+			return fmt.Errorf("REPLAY_CLIENT must name the client to record, e.g., ollama")
+		}
+		client, err := newLLMClient(backend, args)
+		if err != nil {
+			return err
+		}
+		rc.client = client
+		return nil
+	}
+	return fmt.Errorf("unknown REPLAY_MODE: %s, expected record or replay", rc.Mode)
+}
+
+// load reads the cassette, a missing cassette is only allowed while recording.
+func (rc *ReplayInvocationClient) load() error {
+	rc.cassette = &Cassette{Interactions: make(map[string]*Interaction)}
+	data, err := os.ReadFile(rc.CassetteFile)
+	if errors.Is(err, os.ErrNotExist) && rc.Mode == ReplayRecord {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cassette: %w", err)
+	}
+	if err := json.Unmarshal(data, rc.cassette); err != nil {
+		return fmt.Errorf("failed to read cassette %s: %w", rc.CassetteFile, err)
+	}
+	if rc.cassette.Interactions == nil {
+		rc.cassette.Interactions = make(map[string]*Interaction)
+	}
+	return nil
+}
+
+// save writes the cassette, replacing the file only once it is complete.
+func (rc *ReplayInvocationClient) save() error {
+	data, err := json.MarshalIndent(rc.cassette, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(rc.CassetteFile); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	tmp := rc.CassetteFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rc.CassetteFile)
+}
+
+func (rc *ReplayInvocationClient) InvokeLLM(ctx context.Context, buf bytes.Buffer) (string, Metrics, error) {
+	prompt := buf.String()
+	args := invocationOf(ctx).Args
+	model := modelOf(args)
+	key, err := promptKey(args, prompt)
+	if err != nil {
+		return "", Metrics{}, llmContentError(err)
+	}
+	if rc.Mode == ReplayServe {
+		rc.mutex.Lock()
+		interaction, ok := rc.cassette.Interactions[key]
+		rc.mutex.Unlock()
+		if !ok {
+			log.Errorf("prompt %s for model %s is not recorded in cassette %s", key, model, rc.CassetteFile)
+			return "", Metrics{}, llmContentError(fmt.Errorf("prompt %s for model %s is not recorded in cassette %s", key, model, rc.CassetteFile))
+		}
+		return interaction.Response, interaction.Metrics.metrics(), nil
+	}
+
+	response, metrics, err := rc.client.InvokeLLM(ctx, buf)
+	if err != nil {
+		return response, metrics, err
+	}
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.cassette.Interactions[key] = &Interaction{
+		Model:    model,
+		Options:  args,
+		Prompt:   prompt,
+		Response: response,
+		Metrics:  callMetrics(metrics),
+		Recorded: time.Now(),
+	}
+	if err := rc.save(); err != nil {
+		log.Errorf("failed to record prompt %s in cassette %s: %v", key, rc.CassetteFile, err)
+	}
+	return response, metrics, nil
+}
+
+func (rc *ReplayInvocationClient) logLLMResponse(ctx context.Context, args ...string) {
+	if rc.client != nil {
+		rc.client.logLLMResponse(ctx, args...)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// stubClient answers every prompt with the main file named after the model and the number of the invocation.
+type stubClient struct {
+	mutex sync.Mutex
+	calls int
+	err   error
+	//responses logged with the client
+	logged int
+}
+
+func (s *stubClient) Configure(args map[string]interface{}) error {
+	return nil
+}
+
+func (s *stubClient) InvokeLLM(ctx context.Context, buf bytes.Buffer) (string, Metrics, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls++
+	if s.err != nil {
+		return "", Metrics{}, s.err
+	}
+	model, _ := invocationOf(ctx).Args["model_name"].(string)
+	metrics := Metrics{ConversionPromptTokenCount: buf.Len(), ConversionEvalTokenCount: 10 * s.calls}
+	return fmt.Sprintf(`{"main.go": "// %s %d"}`, model, s.calls), metrics, nil
+}
+
+func (s *stubClient) logLLMResponse(ctx context.Context, args ...string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.logged++
+}
+
+// registerStub makes the client available as LLM client "stub" for the duration of the test.
+func registerStub(t *testing.T, client *stubClient) {
+	LLMClientFactories["stub"] = func(args map[string]interface{}) (LLMInvocationClient, error) {
+		return client, nil
+	}
+	t.Cleanup(func() {
+		delete(LLMClientFactories, "stub")
+	})
+}
+
+func llmPipeline(t *testing.T) *Pipeline {
+	pipeline, err := PipelineReader(bytes.NewReader([]byte(`options:
+  model_name: "qwen2.5-coder:14b"
+tasks:
+  - id: "root"
+    task: "llmTask"
+    maxRetryCount: 1
+    task_args:
+      prompt: "convert {{.code}}"
+`)))
+	assert.NoError(t, err)
+	return pipeline
+}
+
+func TestReplayClient(t *testing.T) {
+	registerStub(t, &stubClient{})
+	cassette := filepath.Join(t.TempDir(), "cassettes", "convert.json")
+
+	recorder, err := LLMClientFactories["replay"](map[string]interface{}{
+		"REPLAY_MODE":     "record",
+		"REPLAY_CASSETTE": cassette,
+		"REPLAY_CLIENT":   "stub",
+	})
+	assert.NoError(t, err)
+	recorded := testRequest()
+	err = llmPipeline(t).Execute(&PipelineRunner{Context: context.Background(), client: recorder}, recorded)
+	assert.NoError(t, err)
+	assert.Equal(t, "// qwen2.5-coder:14b 1", recorded.WorkingPackage.RootFile)
+	assert.FileExists(t, cassette)
+
+	delete(LLMClientFactories, "stub")
+	player, err := LLMClientFactories["replay"](map[string]interface{}{"REPLAY_CASSETTE": cassette})
+	assert.NoError(t, err)
+	replayed := testRequest()
+	err = llmPipeline(t).Execute(&PipelineRunner{Context: context.Background(), client: player}, replayed)
+	assert.NoError(t, err)
+	assert.Equal(t, recorded.WorkingPackage.RootFile, replayed.WorkingPackage.RootFile)
+	assert.Equal(t, recorded.Metrics.ConversionPromptTokenCount, replayed.Metrics.ConversionPromptTokenCount)
+	assert.Equal(t, recorded.Metrics.ConversionEvalTokenCount, replayed.Metrics.ConversionEvalTokenCount)
+
+	req := testRequest()
+	req.SourcePackage.RootFile = "changed"
+	req.WorkingPackage = req.SourcePackage.copy()
+	err = llmPipeline(t).Execute(&PipelineRunner{Context: context.Background(), client: player}, req)
+	assert.ErrorContains(t, err, "is not recorded in cassette")
+
+	_, err = LLMClientFactories["replay"](map[string]interface{}{"REPLAY_CASSETTE": filepath.Join(t.TempDir(), "missing.json")})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestPromptKeyNormalization(t *testing.T) {
+	buildDir := filepath.Join(os.TempDir(), "fn_lmm123456")
+	key := func(model, prompt string) string {
+		key, err := promptKey(map[string]interface{}{"model_name": model}, prompt)
+		assert.NoError(t, err)
+		return key
+	}
+	assert.Equal(t, key("model", "fix main.go\nundefined: x"), key("model", "fix main.go  \r\nundefined: x\n"))
+	assert.NotEqual(t, key("model", "fix main.go\nundefined: x"), key("other", "fix main.go\nundefined: x"))
+	assert.Equal(t,
+		key("model", buildDir+"/main.go:3: undefined: x"),
+		key("model", filepath.Join(os.TempDir(), "fn_lmm987")+"/main.go:3: undefined: x"))
+}
+
+func TestReplayKeepsOptionsApart(t *testing.T) {
+	registerStub(t, &stubClient{})
+	cassette := filepath.Join(t.TempDir(), "convert.json")
+	recorder, err := LLMClientFactories["replay"](map[string]interface{}{
+		"REPLAY_MODE":     "record",
+		"REPLAY_CASSETTE": cassette,
+		"REPLAY_CLIENT":   "stub",
+	})
+	assert.NoError(t, err)
+	invoke := func(client LLMInvocationClient, temperature float64) (string, error) {
+		ctx := withInvocation(context.Background(), &llmInvocation{
+			Args: map[string]interface{}{"model_name": "model", "temperature": temperature},
+		})
+		response, _, err := client.InvokeLLM(ctx, *bytes.NewBufferString("convert main.go"))
+		return response, err
+	}
+	cold, err := invoke(recorder, 0.1)
+	assert.NoError(t, err)
+	hot, err := invoke(recorder, 0.9)
+	assert.NoError(t, err)
+	assert.NotEqual(t, cold, hot)
+
+	player, err := LLMClientFactories["replay"](map[string]interface{}{"REPLAY_CASSETTE": cassette})
+	assert.NoError(t, err)
+	response, err := invoke(player, 0.1)
+	assert.NoError(t, err)
+	assert.Equal(t, cold, response)
+	response, err = invoke(player, 0.9)
+	assert.NoError(t, err)
+	assert.Equal(t, hot, response)
+	_, err = invoke(player, 0.5)
+	assert.ErrorContains(t, err, "is not recorded in cassette")
+}
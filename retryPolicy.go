@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// RetryPolicy refines how a task retries failed attempts. Without a policy, every failure counts against
+// maxRetryCount and the task waits retryDelay before each retry.
+type RetryPolicy struct {
+	//multiplies the delay after each retry of the same budget, values up to 1 keep retryDelay fixed
+	Backoff float64 `json:"backoff,omitempty" yaml:"backoff"`
+	//upper bound of the delay, zero means no bound
+	MaxDelay Duration `json:"maxDelay,omitempty" yaml:"maxDelay"`
+	//randomizes each delay by up to the fraction, e.g., 0.2 waits between 80% and 120% of the delay
+	Jitter float64 `json:"jitter,omitempty" yaml:"jitter"`
+	//number of retries for failures of a class, these failures do not count against maxRetryCount
+	Budgets map[ErrorClass]int `json:"budgets,omitempty" yaml:"budgets"`
+	//classes that fail the task on their first failure, without recovery
+	NoRetry []ErrorClass `json:"noRetry,omitempty" yaml:"noRetry"`
+}
+
+// budget returns the class whose budget the failure is charged to, if the policy has one for the error.
+func (policy *RetryPolicy) budget(err error) (ErrorClass, bool) {
+	if policy == nil {
+		return "", false
+	}
+	for _, class := range errorClasses {
+		if _, ok := policy.Budgets[class]; ok && class.matches(err) {
+			return class, true
+		}
+	}
+	return "", false
+}
+
+// retries reports whether the error may be retried at all.
+func (policy *RetryPolicy) retries(err error) bool {
+	if policy == nil {
+		return true
+	}
+	return !slices.ContainsFunc(policy.NoRetry, func(class ErrorClass) bool {
+		return class.matches(err)
+	})
+}
+
+// delay returns how long to wait before the given retry, counted from zero, of a budget.
+func (policy *RetryPolicy) delay(base time.Duration, retry int) time.Duration {
+	if policy == nil {
+		return base
+	}
+	delay := float64(base)
+	for i := 0; i < retry && policy.Backoff > 1; i++ {
+		delay *= policy.Backoff
+		if policy.MaxDelay > 0 && delay >= float64(policy.MaxDelay) {
+			break
+		}
+	}
+	if policy.MaxDelay > 0 {
+		delay = min(delay, float64(policy.MaxDelay))
+	}
+	if policy.Jitter > 0 {
+		delay *= 1 + policy.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(delay)
+}
+
+// charged counts the failed attempts of the task that were charged to the budget of an error class.
+func (req *ConversionRequest) charged(task *ConversionTask) int {
+	total := 0
+	for _, retries := range req.retries[task] {
+		total += retries
+	}
+	return total
+}
+
+// spent counts the failed attempts of the task that count against its maxRetryCount.
+func (req *ConversionRequest) spent(task *ConversionTask) int {
+	return req.attempt(task) - req.charged(task)
+}
+
+// retryable reports whether the task may be attempted again after the failure, before the failure is booked.
+func (req *ConversionRequest) retryable(task *ConversionTask, err error) bool {
+	if !task.Retry.retries(err) || isBudgetError(err) {
+		return false
+	}
+	if class, ok := task.Retry.budget(err); ok {
+		return req.retries[task][class] < task.Retry.Budgets[class]
+	}
+	return req.spent(task)+1 < task.MaxRetryCount
+}
+
+// retryDelay returns how long the task waits before retrying the failure.
+func (req *ConversionRequest) retryDelay(task *ConversionTask, err error) time.Duration {
+	retry := req.spent(task)
+	if class, ok := task.Retry.budget(err); ok {
+		retry = req.retries[task][class]
+	}
+	return task.Retry.delay(task.RetryDelay, retry)
+}
+
+// failAttempt books a failed attempt of the task, against the budget of its error class if the policy has one.
+func (req *ConversionRequest) failAttempt(task *ConversionTask, err error) {
+	req.nextAttempt(task)
+	class, ok := task.Retry.budget(err)
+	if !ok {
+		return
+	}
+	if req.retries == nil {
+		req.retries = make(map[*ConversionTask]map[ErrorClass]int)
+	}
+	if req.retries[task] == nil {
+		req.retries[task] = make(map[ErrorClass]int)
+	}
+	req.retries[task][class]++
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// ReviewTask is the task converter that pauses the job until a reviewer decided about the working package.
+const ReviewTask = "review"
+
+// ReviewVerdict is the answer of a reviewer to a paused job.
+type ReviewVerdict string
+
+const (
+	// ReviewApprove accepts the working package, the pipeline continues with the next tasks.
+	ReviewApprove ReviewVerdict = "approve"
+	// ReviewReject fails the attempt of the review task with the comment of the reviewer as issue.
+	ReviewReject ReviewVerdict = "reject"
+	// ReviewEdit replaces the working package with the package of the reviewer and continues like an approval.
+	ReviewEdit ReviewVerdict = "edit"
+)
+
+func parseReviewVerdict(key string) (ReviewVerdict, error) {
+	switch verdict := ReviewVerdict(key); verdict {
+	case ReviewApprove, ReviewReject, ReviewEdit:
+		return verdict, nil
+	}
+	return "", fmt.Errorf("unknown review verdict: %s", key)
+}
+
+// ReviewDecision is handed to the review task once the paused job is resumed.
+type ReviewDecision struct {
+	TaskID  string
+	Verdict ReviewVerdict
+	Comment string
+	//package of the reviewer, only used by ReviewEdit
+	Package *DeploymentPackage
+}
+
+// ReviewConverter pauses the job the first time it is applied. When the job is resumed with a decision, it applies
+// the decision instead. A review can only pause the main flow, recovery tasks, branches and fragments can not be
+// resumed on their own.
+type ReviewConverter struct{}
+
+func makeReviewConverter(args map[string]interface{}) Converter {
+	return &ReviewConverter{}
+}
+
+func (ReviewConverter) Apply(runner *PipelineRunner, req *ConversionRequest) error {
+	taskID := ""
+	if req.span != nil {
+		taskID = req.span.TaskID
+	}
+	if req.nested > 0 {
+		return fmt.Errorf("review task %s can not pause a recovery task, branch or pipeline fragment", taskID)
+	}
+	decision := req.review
+	req.review = nil
+	if decision == nil || decision.TaskID != taskID {
+		log.Infof("job %s awaits review of task %s", req.Id, taskID)
+		return &reviewPause{taskID: taskID}
+	}
+
+	log.Infof("job %s was reviewed at task %s: %s", req.Id, taskID, decision.Verdict)
+	switch decision.Verdict {
+	case ReviewApprove:
+		return nil
+	case ReviewEdit:
+		if decision.Package == nil {
+			return fmt.Errorf("review of task %s has no edited package", taskID)
+		}
+		req.WorkingPackage = decision.Package.copy()
+		return nil
+	case ReviewReject:
+		return ReviewError{fmt.Errorf("the reviewer rejected the package: %s", decision.Comment)}
+	}
+	return fmt.Errorf("unknown review verdict: %s", decision.Verdict)
+}
+
+// reviewPause unwinds the task execution when a review task waits for a decision. It carries the checkpoint the job
+// resumes from.
+type reviewPause struct {
+	taskID     string
+	checkpoint *Checkpoint
+}
+
+func (r *reviewPause) Error() string {
+	return fmt.Sprintf("awaiting review of task %s", r.taskID)
+}
+
+func asReviewPause(err error) (*reviewPause, bool) {
+	var pause *reviewPause
+	ok := errors.As(err, &pause)
+	return pause, ok
+}
+
+// ReviewRequest describes a job that awaits review.
+type ReviewRequest struct {
+	Id     string    `json:"id"`
+	TaskID string    `json:"task"`
+	Since  time.Time `json:"since"`
+}
+
+// pause records where the job stopped, the request resumes at the review task once it has a decision.
+func (req *ConversionRequest) pause(pause *reviewPause) {
+	req.checkpoint = pause.checkpoint
+	req.checkpoint.AwaitingReview = pause.taskID
+}
+
+// awaitingReview returns the review task the job is paused at, or an empty string.
+func (req *ConversionRequest) awaitingReview() string {
+	if req.checkpoint == nil {
+		return ""
+	}
+	return req.checkpoint.AwaitingReview
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"github.com/pmezard/go-difflib/difflib"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Revision is a version of the working package, recorded whenever a task attempt changed it.
+type Revision struct {
+	Number  int       `json:"number"`
+	TaskID  string    `json:"task,omitempty"`
+	Attempt int       `json:"attempt"`
+	Time    time.Time `json:"time"`
+	Digest  string    `json:"digest"`
+	//unified diff against the previous revision
+	Diff string `json:"diff,omitempty"`
+	//set once tests ran against this revision
+	Tested  bool               `json:"tested"`
+	Score   int                `json:"score"`
+	Tests   int                `json:"tests"`
+	Package *DeploymentPackage `json:"package,omitempty"`
+}
+
+// files lists the content of the package by file name.
+func (dp *DeploymentPackage) files() map[string]string {
+	files := make(map[string]string)
+	if dp == nil {
+		return files
+	}
+	files[fmt.Sprintf("main.%s", dp.Suffix)] = dp.RootFile
+	maps.Copy(files, dp.BuildFiles)
+	for name, test := range dp.TestFiles {
+		files[fmt.Sprintf("tests/%s", name)] = test
+	}
+	return files
+}
+
+func (dp *DeploymentPackage) digest() string {
+	files := dp.files()
+	hash := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		_, _ = fmt.Fprintf(hash, "%s\x00%s\x00", name, files[name])
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// diffPackages creates a unified diff of all files that differ between the packages.
+func diffPackages(from, to *DeploymentPackage) string {
+	fromFiles, toFiles := from.files(), to.files()
+	names := slices.Sorted(maps.Keys(fromFiles))
+	for name := range toFiles {
+		if _, ok := fromFiles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var diff strings.Builder
+	for _, name := range names {
+		a, b := fromFiles[name], toFiles[name]
+		if a == b {
+			continue
+		}
+		text, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        splitLines(a),
+			B:        splitLines(b),
+			FromFile: "a/" + name,
+			ToFile:   "b/" + name,
+			Context:  3,
+		})
+		if err != nil {
+			text = fmt.Sprintf("failed to diff %s: %v\n", name, err)
+		}
+		diff.WriteString(text)
+	}
+	return diff.String()
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	return difflib.SplitLines(text)
+}
+
+// addRevision appends a revision, numbered and diffed against the latest revision of the request.
+func (req *ConversionRequest) addRevision(rev *Revision) *Revision {
+	var previous *DeploymentPackage
+	if len(req.Revisions) > 0 {
+		previous = req.Revisions[len(req.Revisions)-1].Package
+	}
+	rev.Number = len(req.Revisions)
+	rev.Diff = diffPackages(previous, rev.Package)
+	req.Revisions = append(req.Revisions, rev)
+	return rev
+}
+
+// recordRevision records the working package if it differs from the latest revision and returns the revision
+// matching the working package.
+func (req *ConversionRequest) recordRevision(taskID string, attempt int) *Revision {
+	if req.WorkingPackage == nil {
+		return nil
+	}
+	digest := req.WorkingPackage.digest()
+	if len(req.Revisions) > 0 {
+		if latest := req.Revisions[len(req.Revisions)-1]; latest.Digest == digest {
+			return latest
+		}
+	}
+	return req.addRevision(&Revision{
+		TaskID:  taskID,
+		Attempt: attempt,
+		Time:    time.Now(),
+		Digest:  digest,
+		Package: req.WorkingPackage.copy(),
+	})
+}
+
+// scoreRevision assigns the result of the last test run to the revision of the working package.
+func (req *ConversionRequest) scoreRevision() {
+	taskID, attempt := "", 0
+	if req.span != nil {
+		taskID, attempt = req.span.TaskID, req.span.Attempt
+	}
+	rev := req.recordRevision(taskID, attempt)
+	if rev == nil {
+		return
+	}
+	rev.Tested = true
+	rev.Score = req.testScore()
+	rev.Tests = len(req.Metrics.TestCases)
+}
+
+// forkRevisions copies the revisions for a branch, branches score and extend their own copies.
+func (req *ConversionRequest) forkRevisions() []*Revision {
+	revisions := make([]*Revision, len(req.Revisions))
+	for i, rev := range req.Revisions {
+		forked := *rev
+		revisions[i] = &forked
+	}
+	return revisions
+}
+
+// joinRevisions takes over the test results of the revisions a branch was forked with and the revisions it recorded
+// after it was forked.
+func (req *ConversionRequest) joinRevisions(branch *ConversionRequest) {
+	forked := min(len(req.Revisions), len(branch.Revisions))
+	for i, rev := range branch.Revisions[:forked] {
+		if rev.Tested {
+			joined := req.Revisions[i]
+			joined.Tested, joined.Score, joined.Tests = true, rev.Score, rev.Tests
+		}
+	}
+	req.Revisions = append(req.Revisions, branch.Revisions[forked:]...)
+}
+
+// bestRevision returns the tested revision with the highest score, the later revision wins a tie. It returns nil if
+// no revision was tested.
+func (req *ConversionRequest) bestRevision() *Revision {
+	var best *Revision
+	for _, rev := range req.Revisions {
+		if rev.Tested && (best == nil || rev.Score >= best.Score) {
+			best = rev
+		}
+	}
+	return best
+}
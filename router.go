@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// defaultHealthInterval is the time a failed backend is skipped before it is checked or tried again.
+const defaultHealthInterval = 30 * time.Second
+
+// RouterConfig is the yaml file of the router client.
+type RouterConfig struct {
+	Backends []*RouterBackend `yaml:"backends"`
+	//backends tried in order for tasks without a route, all backends in the order of the file if empty
+	Default []string `yaml:"default"`
+	//routes by task id or converter, e.g., cleaner, the task id wins
+	Tasks map[string][]string `yaml:"tasks"`
+	//time a failed backend is skipped and the interval of its health check
+	HealthInterval time.Duration `yaml:"healthInterval"`
+}
+
+// RouterBackend is an LLM client the router can send invocations to.
+type RouterBackend struct {
+	Name string `yaml:"name"`
+	//name of the LLM client, e.g., ollama
+	Client string `yaml:"client"`
+	//configuration of the client, e.g., OLLAMA_API_URL, added to the configuration of the service
+	Args map[string]interface{} `yaml:"args"`
+	//request options that replace the options of the task, e.g., model_name
+	Options map[string]interface{} `yaml:"options"`
+	//limits each invocation, the next backend is tried once it passed
+	Timeout time.Duration `yaml:"timeout"`
+	//url that answers with a 2xx status while the backend is available
+	HealthCheck string `yaml:"healthCheck"`
+
+	client LLMInvocationClient
+	mutex  sync.Mutex
+	down   bool
+	//time of the last failure or health check
+	checked time.Time
+}
+
+// ReadRouterConfig parses the router yaml, `${VAR}` references in args and options refer to the environment.
+func ReadRouterConfig(file io.Reader) (*RouterConfig, error) {
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	config := &RouterConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if config.HealthInterval <= 0 {
+		config.HealthInterval = defaultHealthInterval
+	}
+
+	errs := make([]error, 0)
+	known := make(map[string]bool)
+	scope := newVariableScope(nil, nil)
+	for _, backend := range config.Backends {
+		if backend.Name == "" || backend.Client == "" {
+			errs = append(errs, fmt.Errorf("backend requires a name and a client"))
+			continue
+		}
+		if known[backend.Name] {
+			errs = append(errs, fmt.Errorf("backend %s is defined twice", backend.Name))
+		}
+		known[backend.Name] = true
+		if backend.Client == "router" {
+			errs = append(errs, fmt.Errorf("backend %s can not be a router", backend.Name))
+		}
+		if _, ok := LLMClientFactories[backend.Client]; !ok {
+			errs = append(errs, fmt.Errorf("backend %s uses unknown LLM client: %s", backend.Name, backend.Client))
+		}
+		for _, values := range []*map[string]interface{}{&backend.Args, &backend.Options} {
+			interpolated, err := scope.interpolate(*values)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("backend %s: %w", backend.Name, err))
+				continue
+			}
+			*values, _ = interpolated.(map[string]interface{})
+		}
+	}
+	if len(config.Backends) == 0 {
+		errs = append(errs, fmt.Errorf("router requires at least one backend"))
+	}
+	if len(config.Default) == 0 {
+		for _, backend := range config.Backends {
+			config.Default = append(config.Default, backend.Name)
+		}
+	}
+	routes := map[string][]string{"default": config.Default}
+	maps.Copy(routes, config.Tasks)
+	for task, route := range routes {
+		for _, name := range route {
+			if !known[name] {
+				errs = append(errs, fmt.Errorf("route of %s uses unknown backend %s", task, name))
+			}
+		}
+	}
+	return config, errors.Join(errs...)
+}
+
+// RouterInvocationClient sends each invocation to the backends of the route of its task, in order, until one answers.
+// Backends that could not be reached, timed out or failed their health check are skipped for a while. The backend
+// that answered is reported on the invocation.
+type RouterInvocationClient struct {
+	Config   *RouterConfig
+	backends map[string]*RouterBackend
+}
+
+func makeRouterClient(args map[string]interface{}) (LLMInvocationClient, error) {
+	rc := &RouterInvocationClient{}
+	err := rc.Configure(args)
+	if err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+func init() {
+	// registered here, the router creates its backends from the factories
+	LLMClientFactories["router"] = makeRouterClient
+}
+
+func (rc *RouterInvocationClient) Configure(args map[string]interface{}) error {
+	fname, ok := args["ROUTER_CONFIG"].(string)
+	if !ok || fname == "" {
+		return fmt.Errorf("ROUTER_CONFIG required")
+	}
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	config, err := ReadRouterConfig(f)
+	if err != nil {
+		return fmt.Errorf("invalid router config %s: %w", fname, err)
+	}
+
+	rc.Config = config
+	rc.backends = make(map[string]*RouterBackend, len(config.Backends))
+	for _, backend := range config.Backends {
+		backendArgs := maps.Clone(args)
+		maps.Copy(backendArgs, backend.Args)
+		client, err := newLLMClient(backend.Client, backendArgs)
+		if err != nil {
+			return fmt.Errorf("backend %s: %w", backend.Name, err)
+		}
+		backend.client = client
+		rc.backends[backend.Name] = backend
+	}
+	return nil
+}
+
+// route returns the backends for the task, the ones that are available first.
+func (rc *RouterInvocationClient) route(ctx context.Context, inv *llmInvocation) []*RouterBackend {
+	names, ok := rc.Config.Tasks[inv.TaskID]
+	if !ok {
+		names, ok = rc.Config.Tasks[inv.Converter]
+	}
+	if !ok {
+		names = rc.Config.Default
+	}
+	available := make([]*RouterBackend, 0, len(names))
+	unavailable := make([]*RouterBackend, 0)
+	for _, name := range names {
+		backend := rc.backends[name]
+		if backend.available(ctx, rc.Config.HealthInterval) {
+			available = append(available, backend)
+		} else {
+			unavailable = append(unavailable, backend)
+		}
+	}
+	//if all backends failed, trying them again beats failing right away
+	return append(available, unavailable...)
+}
+
+func (rc *RouterInvocationClient) InvokeLLM(ctx context.Context, buf bytes.Buffer) (string, Metrics, error) {
+	inv := invocationOf(ctx)
+	total := Metrics{}
+	errs := make([]error, 0)
+	for _, backend := range rc.route(ctx, inv) {
+		response, metrics, err := backend.invoke(ctx, inv, inv.Args, buf)
+		total.AddMetric(metrics)
+		if err == nil {
+			inv.Backend = backend.Name
+			if model := modelOf(backend.Options); model != "" {
+				inv.Model = model
+			}
+			backend.report(true)
+			return response, total, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", backend.Name, err))
+		if ctx.Err() != nil || !failover(err) {
+			inv.Backend = backend.Name
+			return "", total, errors.Join(errs...)
+		}
+		log.Warnf("LLM backend %s failed, trying the next backend: %v", backend.Name, err)
+		backend.report(false)
+	}
+	return "", total, classifyLLMError(errors.Join(errs...))
+}
+
+// failover is true for failures the next backend might not have, i.e., connection errors, timeouts and 5xx
+// responses. A rejected request, e.g., a bad request or an unknown model, fails on the next backend as well.
+func failover(err error) bool {
+	return LLMTransportFailure.matches(classifyLLMError(err))
+}
+
+// invoke sends the invocation to the client of the backend, with the options of the task and the backend.
+func (b *RouterBackend) invoke(ctx context.Context, inv *llmInvocation, args map[string]interface{}, buf bytes.Buffer) (string, Metrics, error) {
+	if len(b.Options) > 0 {
+		args = maps.Clone(args)
+		maps.Copy(args, b.Options)
+	}
+	call := *inv
+	call.Args = args
+	ctx = withInvocation(ctx, &call)
+	if b.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+	return b.client.InvokeLLM(ctx, buf)
+}
+
+// available is false while a failed backend waits for its next check, the health check runs at most once per
+// interval.
+func (b *RouterBackend) available(ctx context.Context, interval time.Duration) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if time.Since(b.checked) < interval {
+		return !b.down
+	}
+	if b.HealthCheck == "" {
+		//give a failed backend another try
+		return true
+	}
+	b.checked = time.Now()
+	b.down = !b.healthy(ctx)
+	if b.down {
+		log.Warnf("LLM backend %s failed its health check", b.Name)
+	}
+	return !b.down
+}
+
+func (b *RouterBackend) healthy(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.HealthCheck, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+// report records the outcome of an invocation, a failed backend is skipped until the next interval.
+func (b *RouterBackend) report(ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if ok {
+		b.down = false
+		return
+	}
+	b.down = true
+	b.checked = time.Now()
+}
+
+// logLLMResponse logs with the backend that answered the invocation.
+func (rc *RouterInvocationClient) logLLMResponse(ctx context.Context, args ...string) {
+	if backend, ok := rc.backends[invocationOf(ctx).Backend]; ok {
+		backend.client.logLLMResponse(ctx, args...)
+	}
+}
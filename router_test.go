@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRouterClient(t *testing.T) {
+	stubs := map[string]*stubClient{
+		"stub-broken": {err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}},
+		"stub-local":  {},
+		"stub-remote": {},
+	}
+	for name, stub := range stubs {
+		LLMClientFactories[name] = func(args map[string]interface{}) (LLMInvocationClient, error) {
+			return stub, nil
+		}
+	}
+	t.Cleanup(func() {
+		for name := range stubs {
+			delete(LLMClientFactories, name)
+		}
+	})
+
+	config := filepath.Join(t.TempDir(), "router.yaml")
+	assert.NoError(t, os.WriteFile(config, []byte(`healthInterval: 1h
+backends:
+  - name: broken
+    client: stub-broken
+  - name: local
+    client: stub-local
+    options:
+      model_name: "qwen2.5-coder:7b"
+  - name: remote
+    client: stub-remote
+    timeout: 2m
+default: [broken, local]
+tasks:
+  fixer: [remote, local]
+`), 0644))
+	router, err := LLMClientFactories["router"](map[string]interface{}{"ROUTER_CONFIG": config})
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		req := testRequest()
+		err = llmPipeline(t).Execute(&PipelineRunner{Context: context.Background(), client: router}, req)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"local"}, req.Trace.Children[0].Backends)
+		assert.True(t, strings.HasPrefix(req.WorkingPackage.RootFile, "// qwen2.5-coder:7b"))
+	}
+	//the failed backend is skipped until the next health interval
+	assert.Equal(t, 1, stubs["stub-broken"].calls)
+	//responses are logged by the backend that answered
+	assert.Equal(t, 2, stubs["stub-local"].logged)
+	assert.Equal(t, 0, stubs["stub-broken"].logged)
+
+	inv := &llmInvocation{TaskID: "fix", Converter: "fixer", Args: map[string]interface{}{"model_name": "gemini-2.0-flash"}}
+	response, _, err := router.InvokeLLM(withInvocation(t.Context(), inv), *bytes.NewBufferString("fix"))
+	assert.NoError(t, err)
+	assert.Equal(t, "remote", inv.Backend)
+	assert.Equal(t, `{"main.go": "// gemini-2.0-flash 1"}`, response)
+
+	stubs["stub-remote"].err = LLMError{error: errors.New("invalid request"), Transport: false}
+	_, _, err = router.InvokeLLM(withInvocation(t.Context(), inv), *bytes.NewBufferString("fix"))
+	assert.ErrorContains(t, err, "remote: invalid request")
+	assert.Equal(t, 2, stubs["stub-local"].calls)
+
+	_, err = ReadRouterConfig(strings.NewReader(`backends:
+  - name: local
+    client: stub-local
+tasks:
+  fixer: [gemini]
+`))
+	assert.ErrorContains(t, err, "route of fixer uses unknown backend gemini")
+}
+
+func TestRouterDoesNotFailOverOnRejectedRequests(t *testing.T) {
+	calls := map[string]int{}
+	var mutex sync.Mutex
+	backend := func(name string, status int) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			calls[name]++
+			mutex.Unlock()
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(`{"error": {"message": "` + http.StatusText(status) + `"}}`))
+		}))
+	}
+	primary, secondary := backend("primary", http.StatusBadRequest), backend("secondary", http.StatusOK)
+	defer primary.Close()
+	defer secondary.Close()
+
+	config := filepath.Join(t.TempDir(), "router.yaml")
+	assert.NoError(t, os.WriteFile(config, []byte(fmt.Sprintf(`healthInterval: 1h
+backends:
+  - name: primary
+    client: openai
+    args: {OPENAI_BASE_URL: "%s"}
+  - name: secondary
+    client: openai
+    args: {OPENAI_BASE_URL: "%s"}
+`, primary.URL, secondary.URL)), 0644))
+	router, err := LLMClientFactories["router"](map[string]interface{}{"ROUTER_CONFIG": config})
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		inv := &llmInvocation{Args: map[string]interface{}{"model_name": "unknown"}}
+		_, _, err = router.InvokeLLM(withInvocation(t.Context(), inv), *bytes.NewBufferString("convert"))
+		assert.ErrorContains(t, err, "primary: chat completion failed with 400 Bad Request")
+		assert.True(t, LLMContentFailure.matches(err))
+	}
+	//the primary is still used, it did not fail
+	assert.Equal(t, map[string]int{"primary": 2}, calls)
+}
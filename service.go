@@ -4,13 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"io"
+	"maps"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -20,7 +25,32 @@ type ConverterService struct {
 	requestQueue chan *ConversionRequest
 	results      map[uuid.UUID]*ConversionRequest
 	metrics      map[uuid.UUID]Metrics
-	mutex        sync.RWMutex
+	traces       map[uuid.UUID]*Span
+	revisions    map[uuid.UUID][]*Revision
+	//paused jobs that wait for a reviewer, they do not occupy a worker
+	reviews map[uuid.UUID]*ConversionRequest
+	//finished jobs that can be resumed from one of their tasks, the oldest are dropped beyond resumable
+	finished map[uuid.UUID]*ConversionRequest
+	//ids of the finished jobs, oldest first
+	finishedOrder []uuid.UUID
+	resumable     int
+	//jobs that are queued or run on a worker
+	active map[uuid.UUID]*activeJob
+	mutex  sync.RWMutex
+}
+
+type activeJob struct {
+	request *ConversionRequest
+	running bool
+}
+
+// JobStatus is the state of a job with the progress of its LLM invocations.
+type JobStatus struct {
+	Id uuid.UUID `json:"id"`
+	//queued, running, review or finished
+	State     string       `json:"state"`
+	Completed bool         `json:"completed,omitempty"`
+	Progress  *JobProgress `json:"progress,omitempty"`
 }
 
 func setOrDefault(key, defaultvalue string) string {
@@ -51,19 +81,48 @@ func setFileFromEnv(key, defaultvalue string) string {
 
 func MakeConverterService() error {
 	options := DefaultOptions
+	options.LLMClient = setOrDefault("LLM_CLIENT", DefaultOptions.LLMClient)
 	options.Args["OLLAMA_API_URL"] = setOrDefault("OLLAMA_API_URL", OLLAMA_API_URL)
 	options.Args["GEMINI_API_KEY"] = setOrDefault("GEMINI_API_KEY", "NOT+SET")
+	options.Args["OPENAI_BASE_URL"] = setOrDefault("OPENAI_BASE_URL", "http://localhost:8000/v1")
+	options.Args["OPENAI_API_KEY"] = setOrDefault("OPENAI_API_KEY", "")
+	options.Args["OPENAI_MODEL"] = setOrDefault("OPENAI_MODEL", "")
+	options.Args["REPLAY_MODE"] = setOrDefault("REPLAY_MODE", string(ReplayServe))
+	options.Args["REPLAY_CASSETTE"] = setOrDefault("REPLAY_CASSETTE", "")
+	options.Args["REPLAY_CLIENT"] = setOrDefault("REPLAY_CLIENT", "ollama")
+	options.Args["ROUTER_CONFIG"] = setOrDefault("ROUTER_CONFIG", "")
+	options.Args["LLM_CACHE_DIR"] = setOrDefault("LLM_CACHE_DIR", "")
+	options.Args["LLM_CACHE_MAX_MB"] = setOrDefault("LLM_CACHE_MAX_MB", "")
+	options.Args["LLM_CACHE_MAX_AGE"] = setOrDefault("LLM_CACHE_MAX_AGE", "")
 
 	converter, err := MakeCodeConverter(&options)
 	if err != nil {
 		return err
 	}
+	converter.checkpoints, err = OpenCheckpointStore(setOrDefault("CHECKPOINT_DIR", "checkpoints"))
+	if err != nil {
+		return err
+	}
+	workers, err := strconv.Atoi(setOrDefault("WORKERS", "1"))
+	if err != nil || workers < 1 {
+		return fmt.Errorf("WORKERS must be a positive number: %s", os.Getenv("WORKERS"))
+	}
+	resumable, err := strconv.Atoi(setOrDefault("RESUMABLE_JOBS", "100"))
+	if err != nil || resumable < 0 {
+		return fmt.Errorf("RESUMABLE_JOBS must be a number: %s", os.Getenv("RESUMABLE_JOBS"))
+	}
 
 	sv := ConverterService{
 		converter:    converter,
 		requestQueue: make(chan *ConversionRequest, 100),
 		results:      make(map[uuid.UUID]*ConversionRequest),
 		metrics:      make(map[uuid.UUID]Metrics),
+		traces:       make(map[uuid.UUID]*Span),
+		revisions:    make(map[uuid.UUID][]*Revision),
+		reviews:      make(map[uuid.UUID]*ConversionRequest),
+		finished:     make(map[uuid.UUID]*ConversionRequest),
+		resumable:    resumable,
+		active:       make(map[uuid.UUID]*activeJob),
 	}
 
 	log.Infof("Starting converter service with options: %+v", options)
@@ -72,42 +131,146 @@ func MakeConverterService() error {
 	r.Path("/").Methods(http.MethodPost).HandlerFunc(sv.uploadHandler)
 	r.Path("/metrics").Methods(http.MethodGet).HandlerFunc(sv.metricsHandler)
 	r.Path("/reconfigure").Methods(http.MethodPost).HandlerFunc(sv.reconfigure)
+	r.Path("/reviews").Methods(http.MethodGet).HandlerFunc(sv.reviewsHandler)
+	r.Path("/{uuid}/review").Methods(http.MethodGet).HandlerFunc(sv.reviewPackageHandler)
+	r.Path("/{uuid}/review").Methods(http.MethodPost).HandlerFunc(sv.reviewHandler)
+	r.Path("/{uuid}/resume").Methods(http.MethodPost).HandlerFunc(sv.resumeHandler)
+	r.Path("/{uuid}/status").Methods(http.MethodGet).HandlerFunc(sv.statusHandler)
+	r.Path("/{uuid}/trace").Methods(http.MethodGet).HandlerFunc(sv.traceHandler)
+	r.Path("/{uuid}/revisions").Methods(http.MethodGet).HandlerFunc(sv.revisionsHandler)
+	r.Path("/{uuid}/revisions/{revision:[0-9]+}").Methods(http.MethodGet).HandlerFunc(sv.revisionHandler)
 	r.Path("/{uuid}").Methods(http.MethodHead, http.MethodGet).HandlerFunc(sv.pollHandler)
 
 	ctx := context.Background()
-	go sv.Start(ctx)
+	for range workers {
+		go sv.Start(ctx)
+	}
+	go sv.resumeUnfinished()
 
 	return http.ListenAndServe("0.0.0.0:8080", r)
 }
 
+// Start processes queued requests until the queue is closed, several workers can share the queue.
 func (service *ConverterService) Start(ctx context.Context) {
 	for request := range service.requestQueue {
 		log.Infof("starting request for %s", request.Id)
-		startTime := time.Now()
+		service.mutex.Lock()
+		if job, ok := service.active[request.Id]; ok {
+			job.running = true
+		}
+		service.mutex.Unlock()
+		runStart := time.Now()
+		//paused and resumed jobs keep their start time and the time they already ran
+		startTime := request.Metrics.StartTime
+		if startTime.IsZero() {
+			startTime = runStart
+		}
+		previousTime := request.Metrics.TotalTime
 		err := service.converter.Convert(request)
+		if pause, ok := asReviewPause(err); ok {
+			service.pause(request, pause)
+			continue
+		}
 		endTime := time.Now()
+		if best := request.bestRevision(); best != nil {
+			log.Debugf("returning revision %d of %s with %d/%d passed tests", best.Number, request.Id, best.Score, best.Tests)
+			request.WorkingPackage = best.Package.copy()
+			request.Metrics.Revision = best.Number
+		} else if len(request.Revisions) > 0 {
+			request.Metrics.Revision = request.Revisions[len(request.Revisions)-1].Number
+		}
 		if err != nil {
 			request.Completed = false
 			log.Debugf("error converting best n for %s: %v", request.Id, err)
 		} else {
 			request.Completed = true
-			log.Debugf("converting best n for %s took %v", request.Id, endTime.Sub(startTime))
+			log.Debugf("converting best n for %s took %v", request.Id, endTime.Sub(runStart))
 		}
 
 		request.Metrics.StartTime = startTime
 		request.Metrics.EndTime = endTime
-		request.Metrics.TotalTime = endTime.Sub(startTime)
+		request.Metrics.TotalTime = previousTime + endTime.Sub(runStart)
 		issues := make([]string, 0)
 		for _, err := range request.err {
 			issues = append(issues, fmt.Sprintf("%v", err))
 		}
 		request.Metrics.Issues = issues
+		if service.converter.checkpoints != nil {
+			if err := service.converter.checkpoints.Remove(request.Id); err != nil {
+				log.Errorf("failed to remove checkpoint of %s: %v", request.Id, err)
+			}
+		}
 		service.mutex.Lock()
 		service.metrics[request.Id] = *request.Metrics
+		service.traces[request.Id] = request.Trace
+		service.revisions[request.Id] = request.Revisions
 		service.results[request.Id] = request
+		service.keepFinished(request)
+		delete(service.active, request.Id)
 		service.mutex.Unlock()
 	}
 }
+
+// keepFinished keeps a finished job for resumes and drops the oldest finished jobs beyond the resumable limit. The
+// caller holds the mutex.
+func (service *ConverterService) keepFinished(request *ConversionRequest) {
+	service.finishedOrder = slices.DeleteFunc(service.finishedOrder, func(id uuid.UUID) bool {
+		return id == request.Id
+	})
+	service.finished[request.Id] = request
+	service.finishedOrder = append(service.finishedOrder, request.Id)
+	for len(service.finishedOrder) > service.resumable {
+		delete(service.finished, service.finishedOrder[0])
+		service.finishedOrder = service.finishedOrder[1:]
+	}
+}
+
+// takeFinished removes a finished job to resume it, it is kept again once it finished.
+func (service *ConverterService) takeFinished(id uuid.UUID) (*ConversionRequest, bool) {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	request, ok := service.finished[id]
+	if ok {
+		delete(service.finished, id)
+		service.finishedOrder = slices.DeleteFunc(service.finishedOrder, func(finished uuid.UUID) bool {
+			return finished == id
+		})
+	}
+	return request, ok
+}
+
+// enqueue queues the request for the next free worker.
+func (service *ConverterService) enqueue(request *ConversionRequest) {
+	service.mutex.Lock()
+	service.active[request.Id] = &activeJob{request: request}
+	service.mutex.Unlock()
+	service.requestQueue <- request
+}
+
+// resumeUnfinished queues the jobs that were still running or waiting when the service stopped.
+func (service *ConverterService) resumeUnfinished() {
+	if service.converter.checkpoints == nil {
+		return
+	}
+	checkpoints, err := service.converter.checkpoints.Unfinished()
+	if err != nil {
+		log.Errorf("failed to load checkpoints: %v", err)
+		return
+	}
+	for _, cp := range checkpoints {
+		if cp.AwaitingReview != "" {
+			log.Infof("request %s awaits review of task '%s'", cp.Id, cp.AwaitingReview)
+			request := cp.request()
+			service.mutex.Lock()
+			service.reviews[cp.Id] = request
+			service.mutex.Unlock()
+			continue
+		}
+		log.Infof("queueing unfinished request %s at task '%s'", cp.Id, cp.TaskID())
+		service.enqueue(cp.request())
+	}
+}
+
 func (service *ConverterService) metricsHandler(w http.ResponseWriter, r *http.Request) {
 	service.mutex.RLock()
 	metrics_data, err := json.Marshal(service.metrics)
@@ -118,6 +281,131 @@ func (service *ConverterService) metricsHandler(w http.ResponseWriter, r *http.R
 	w.Header().Set("Content-Type", "application/json")
 	_, _ = w.Write(metrics_data)
 }
+func (service *ConverterService) traceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobUUID, err := uuid.Parse(vars["uuid"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("uuid error:%+v %+v", vars, err), http.StatusBadRequest)
+		return
+	}
+	service.mutex.RLock()
+	trace, ok := service.traces[jobUUID]
+	service.mutex.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	trace_data, err := json.Marshal(trace)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(trace_data)
+}
+
+// revisionsHandler lists the revisions of a finished job without their packages.
+func (service *ConverterService) revisionsHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobUUID, err := uuid.Parse(vars["uuid"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("uuid error:%+v %+v", vars, err), http.StatusBadRequest)
+		return
+	}
+	service.mutex.RLock()
+	revisions, ok := service.revisions[jobUUID]
+	service.mutex.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	listing := make([]Revision, 0, len(revisions))
+	for _, rev := range revisions {
+		summary := *rev
+		summary.Package = nil
+		listing = append(listing, summary)
+	}
+	revisions_data, err := json.Marshal(listing)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(revisions_data)
+}
+
+// revisionHandler downloads the package of a single revision.
+func (service *ConverterService) revisionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobUUID, err := uuid.Parse(vars["uuid"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("uuid error:%+v %+v", vars, err), http.StatusBadRequest)
+		return
+	}
+	number, err := strconv.Atoi(vars["revision"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("revision error:%+v %+v", vars, err), http.StatusBadRequest)
+		return
+	}
+	service.mutex.RLock()
+	revisions, ok := service.revisions[jobUUID]
+	service.mutex.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if number >= len(revisions) {
+		http.NotFound(w, r)
+		return
+	}
+	var buf bytes.Buffer
+	err = service.converter.WriteDeploymentPackage(&buf, revisions[number].Package)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// statusHandler reports the state of a job and its progress in tokens, it also answers while the job runs.
+func (service *ConverterService) statusHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobUUID, err := uuid.Parse(vars["uuid"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("uuid error:%+v %+v", vars, err), http.StatusBadRequest)
+		return
+	}
+	status := JobStatus{Id: jobUUID}
+	var request *ConversionRequest
+	service.mutex.RLock()
+	if job, ok := service.active[jobUUID]; ok {
+		request, status.State = job.request, "queued"
+		if job.running {
+			status.State = "running"
+		}
+	} else if paused, ok := service.reviews[jobUUID]; ok {
+		request, status.State = paused, "review"
+	} else if finished, ok := service.finished[jobUUID]; ok {
+		request, status.State = finished, "finished"
+		status.Completed = finished.Completed
+	}
+	service.mutex.RUnlock()
+	if request == nil {
+		http.NotFound(w, r)
+		return
+	}
+	status.Progress = request.progress.snapshot()
+
+	status_data, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(status_data)
+}
+
 func (service *ConverterService) pollHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	jobUUID, err := uuid.Parse(vars["uuid"])
@@ -126,8 +414,17 @@ func (service *ConverterService) pollHandler(w http.ResponseWriter, r *http.Requ
 	}
 	service.mutex.RLock()
 	resp, ok := service.results[jobUUID]
+	paused, awaitingReview := service.reviews[jobUUID]
 	service.mutex.RUnlock()
 
+	if ok && resp != nil && resp.Metrics != nil && resp.Metrics.BudgetExceeded != "" {
+		w.Header().Set("X-Budget-Exceeded", resp.Metrics.BudgetExceeded)
+	}
+	if awaitingReview {
+		w.Header().Set("X-Review-Task", paused.awaitingReview())
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
 	if r.Method == http.MethodHead {
 		if ok {
 			w.WriteHeader(http.StatusOK)
@@ -223,8 +520,27 @@ func (service *ConverterService) uploadHandler(w http.ResponseWriter, r *http.Re
 	}
 
 	request := MakeConversionRequest(dp)
+	// Optional overrides of the pipeline options, e.g., options={"model_name": "qwen2.5-coder:32b"}
+	if overrides := r.FormValue("options"); overrides != "" {
+		if err := json.Unmarshal([]byte(overrides), &request.Overrides); err != nil {
+			http.Error(w, fmt.Sprintf("Error decoding options: %v", err), http.StatusBadRequest)
+			return
+		}
+		if pipeline := service.converter.currentPipeline(); pipeline != nil {
+			if _, err := pipeline.forRequest(request); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if service.converter.checkpoints != nil {
+		err = service.converter.checkpoints.Save(makeCheckpoint(service.converter.currentPipeline(), nil, request))
+		if err != nil {
+			log.Errorf("failed to checkpoint request %s: %v", request.Id, err)
+		}
+	}
 
-	service.requestQueue <- request
+	service.enqueue(request)
 	log.Infof("got new conversion request for %s", request.Id)
 	http.Redirect(w, r, fmt.Sprintf("/%s", request.Id.String()), http.StatusCreated)
 }
@@ -247,12 +563,31 @@ func (service *ConverterService) reconfigure(w http.ResponseWriter, r *http.Requ
 
 	if err := json.NewDecoder(r.Body).Decode(&options); err != nil {
 		sendError(w, fmt.Errorf("error decoding options: %v", err))
+		return
+	}
+
+	if options.Pipeline != nil {
+		err := options.Pipeline.resolveIncludes(includeSource{dir: ".", library: true}, nil)
+		if err != nil {
+			sendIssues(w, PipelineIssues{{Severity: SeverityError, Message: err.Error()}})
+			return
+		}
+		if errs := ValidatePipeline(*options.Pipeline).Errors(); len(errs) > 0 {
+			sendIssues(w, errs)
+			return
+		}
 	}
 
 	service.mutex.Lock()
 	err := service.converter.Reconfigure(&options)
-	service.metrics = make(map[uuid.UUID]Metrics)
-	service.results = make(map[uuid.UUID]*ConversionRequest)
+	if err == nil {
+		service.metrics = make(map[uuid.UUID]Metrics)
+		service.traces = make(map[uuid.UUID]*Span)
+		service.revisions = make(map[uuid.UUID][]*Revision)
+		service.results = make(map[uuid.UUID]*ConversionRequest)
+		service.finished = make(map[uuid.UUID]*ConversionRequest)
+		service.finishedOrder = nil
+	}
 	service.mutex.Unlock()
 
 	if err != nil {
@@ -261,3 +596,257 @@ func (service *ConverterService) reconfigure(w http.ResponseWriter, r *http.Requ
 		w.WriteHeader(http.StatusCreated)
 	}
 }
+
+// sendIssues rejects a pipeline with the list of problems found during validation.
+func sendIssues(w http.ResponseWriter, issues PipelineIssues) {
+	issuesDat, err := json.Marshal(map[string]PipelineIssues{"errors": issues})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = w.Write(issuesDat)
+}
+
+// pause parks a job that awaits review, the worker continues with the next job. The job is queued again once a
+// reviewer decided.
+func (service *ConverterService) pause(request *ConversionRequest, pause *reviewPause) {
+	request.pause(pause)
+	if service.converter.checkpoints != nil {
+		if err := service.converter.checkpoints.Save(request.checkpoint); err != nil {
+			log.Errorf("failed to checkpoint paused request %s: %v", request.Id, err)
+		}
+	}
+	service.mutex.Lock()
+	service.reviews[request.Id] = request
+	delete(service.active, request.Id)
+	service.mutex.Unlock()
+}
+
+// reviewsHandler lists the jobs that await review, oldest first.
+func (service *ConverterService) reviewsHandler(w http.ResponseWriter, r *http.Request) {
+	service.mutex.RLock()
+	listing := make([]ReviewRequest, 0, len(service.reviews))
+	for id, request := range service.reviews {
+		listing = append(listing, ReviewRequest{
+			Id:     id.String(),
+			TaskID: request.awaitingReview(),
+			Since:  request.checkpoint.Time,
+		})
+	}
+	service.mutex.RUnlock()
+	slices.SortFunc(listing, func(a, b ReviewRequest) int {
+		return a.Since.Compare(b.Since)
+	})
+	reviews_data, err := json.Marshal(listing)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(reviews_data)
+}
+
+// reviewPackageHandler downloads the working package of a job that awaits review.
+func (service *ConverterService) reviewPackageHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobUUID, err := uuid.Parse(vars["uuid"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("uuid error:%+v %+v", vars, err), http.StatusBadRequest)
+		return
+	}
+	service.mutex.RLock()
+	request, ok := service.reviews[jobUUID]
+	service.mutex.RUnlock()
+	if !ok || request.WorkingPackage == nil {
+		http.NotFound(w, r)
+		return
+	}
+	var buf bytes.Buffer
+	err = service.converter.WriteDeploymentPackage(&buf, request.WorkingPackage)
+	if err != nil {
+		sendError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("X-Review-Task", request.awaitingReview())
+	_, _ = w.Write(buf.Bytes())
+}
+
+// reviewHandler resumes a paused job with the decision of the reviewer: the form field `verdict` (approve or reject),
+// an optional `comment` and an optional `.zip` in the field `file` whose main file replaces the one of the working
+// package.
+func (service *ConverterService) reviewHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobUUID, err := uuid.Parse(vars["uuid"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("uuid error:%+v %+v", vars, err), http.StatusBadRequest)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 50<<20)
+	if err := r.ParseMultipartForm(10 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+
+	decision := &ReviewDecision{Comment: r.FormValue("comment")}
+	decision.Package, err = service.uploadedPackage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if decision.Package != nil {
+		decision.Verdict = ReviewEdit
+	} else {
+		decision.Verdict, err = parseReviewVerdict(r.FormValue("verdict"))
+		if err != nil || decision.Verdict == ReviewEdit {
+			http.Error(w, "verdict must be approve or reject, or upload the edited package as file", http.StatusBadRequest)
+			return
+		}
+	}
+
+	service.mutex.Lock()
+	request, ok := service.reviews[jobUUID]
+	delete(service.reviews, jobUUID)
+	service.mutex.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	decision.TaskID = request.awaitingReview()
+	decision.Package = request.WorkingPackage.edit(decision.Package)
+	request.review = decision
+
+	service.enqueue(request)
+	log.Infof("resuming request %s after review: %s", request.Id, decision.Verdict)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// uploadedPackage reads the optional `.zip` in the form field `file`, it returns nil if no file was uploaded.
+func (service *ConverterService) uploadedPackage(r *http.Request) (*DeploymentPackage, error) {
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		return nil, nil
+	}
+	defer file.Close()
+	fileData, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading file: %v", err)
+	}
+	dp, err := service.converter.ReadDeploymentPackageFromReader(&inMemoryReader{data: fileData}, int64(len(fileData)))
+	if err != nil {
+		return nil, fmt.Errorf("Error reading file: %v", err)
+	}
+	return dp, nil
+}
+
+// resumeHandler runs a finished job again from the task in the form field `task`. The optional fields are a
+// `pipeline` (yaml or json) that replaces the pipeline of the service for this job, a `.zip` in `file` whose main file
+// replaces the one of the working package, a `model` and `options` (JSON object) that override the pipeline options.
+func (service *ConverterService) resumeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	jobUUID, err := uuid.Parse(vars["uuid"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("uuid error:%+v %+v", vars, err), http.StatusBadRequest)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 50<<20)
+	if err := r.ParseMultipartForm(10 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, "Error parsing form", http.StatusBadRequest)
+		return
+	}
+	taskID := r.FormValue("task")
+	if taskID == "" {
+		http.Error(w, "task is required", http.StatusBadRequest)
+		return
+	}
+
+	record := ResumeRecord{}
+	pipeline := service.converter.currentPipeline()
+	if text := r.FormValue("pipeline"); text != "" {
+		file, err := ReadPipelineFile(strings.NewReader(text))
+		if err != nil {
+			sendIssues(w, PipelineIssues{{Severity: SeverityError, Message: err.Error()}})
+			return
+		}
+		if errs := ValidatePipeline(file).Errors(); len(errs) > 0 {
+			sendIssues(w, errs)
+			return
+		}
+		if pipeline, err = compilePipeline(file); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		record.Pipeline = true
+	}
+	if pipeline == nil {
+		http.Error(w, "no pipeline configured", http.StatusBadRequest)
+		return
+	}
+
+	overrides := make(map[string]any)
+	if options := r.FormValue("options"); options != "" {
+		if err := json.Unmarshal([]byte(options), &overrides); err != nil {
+			http.Error(w, fmt.Sprintf("Error decoding options: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if model := r.FormValue("model"); model != "" {
+		overrides["model_name"] = model
+	}
+	edited, err := service.uploadedPackage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	request, ok := service.takeFinished(jobUUID)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	previous := request.Overrides
+	if len(overrides) > 0 {
+		request.Overrides = maps.Clone(previous)
+		if request.Overrides == nil {
+			request.Overrides = make(map[string]any)
+		}
+		maps.Copy(request.Overrides, overrides)
+	}
+	if _, err := pipeline.forRequest(request); err != nil {
+		request.Overrides = previous
+		service.mutex.Lock()
+		service.keepFinished(request)
+		service.mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	workingPackage := request.WorkingPackage
+	if edited != nil {
+		request.WorkingPackage = request.WorkingPackage.edit(edited)
+		record.EditedPackage = true
+	}
+	//reenter checks that the task is part of the main flow
+	if err := request.reenter(pipeline, taskID, record); err != nil {
+		request.Overrides = previous
+		request.WorkingPackage = workingPackage
+		service.mutex.Lock()
+		service.keepFinished(request)
+		service.mutex.Unlock()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	service.mutex.Lock()
+	delete(service.results, jobUUID)
+	service.mutex.Unlock()
+	if service.converter.checkpoints != nil {
+		if err := service.converter.checkpoints.Save(request.checkpoint); err != nil {
+			log.Errorf("failed to checkpoint request %s: %v", request.Id, err)
+		}
+	}
+
+	service.enqueue(request)
+	log.Infof("resuming request %s at task '%s'", request.Id, taskID)
+	http.Redirect(w, r, fmt.Sprintf("/%s", request.Id.String()), http.StatusAccepted)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"maps"
+	"time"
+)
+
+type SpanKind string
+
+const (
+	// SpanJob is the root span of a job.
+	SpanJob SpanKind = "job"
+	// SpanAttempt covers one attempt of a task, including its precondition, validation and the recovery tasks run
+	// for it.
+	SpanAttempt SpanKind = "attempt"
+	// SpanBranch covers a concurrently executed next task of a join.
+	SpanBranch SpanKind = "branch"
+	// SpanCandidate covers the generation, build and test of a sampled candidate.
+	SpanCandidate SpanKind = "candidate"
+)
+
+// Span is a node of the execution trace of a job. Next tasks are siblings of the task they follow, recovery tasks
+// are children of the attempt they recover.
+type Span struct {
+	Kind      SpanKind `json:"kind"`
+	TaskID    string   `json:"task,omitempty"`
+	Converter string   `json:"converter,omitempty"`
+	Attempt   int      `json:"attempt"`
+	//tier of the model cascade the attempt ran with
+	Tier     string        `json:"tier,omitempty"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration"`
+
+	PromptTokens   int           `json:"prompt_tokens,omitempty"`
+	EvalTokens     int           `json:"eval_tokens,omitempty"`
+	ConversionTime time.Duration `json:"conversion_time,omitempty"`
+	//backends of the router that answered the LLM invocations of the span
+	Backends []string `json:"backends,omitempty"`
+
+	BuildTime  time.Duration   `json:"build_time,omitempty"`
+	BuildError bool            `json:"build_error,omitempty"`
+	TestTime   time.Duration   `json:"test_time,omitempty"`
+	TestError  int             `json:"test_error,omitempty"`
+	TestCases  map[string]bool `json:"test_cases,omitempty"`
+	Error      string          `json:"error,omitempty"`
+
+	Children []*Span `json:"children,omitempty"`
+
+	parent *Span
+	closed bool
+}
+
+func newSpan(kind SpanKind, taskID string) *Span {
+	return &Span{
+		Kind:   kind,
+		TaskID: taskID,
+		Start:  time.Now(),
+	}
+}
+
+func (s *Span) add(child *Span) {
+	child.parent = s
+	s.Children = append(s.Children, child)
+}
+
+// end records the duration of the span, it has no effect on a closed span.
+func (s *Span) end() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.Duration = time.Since(s.Start)
+}
+
+// fail records the error of the span, the last error of an attempt wins.
+func (s *Span) fail(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Error = err.Error()
+}
+
+// recordLLM adds the usage of an LLM invocation to the span.
+func (s *Span) recordLLM(m Metrics) {
+	if s == nil {
+		return
+	}
+	s.PromptTokens += m.ConversionPromptTokenCount
+	s.EvalTokens += m.ConversionEvalTokenCount
+	s.ConversionTime += m.ConversionTime
+}
+
+// recordBackend adds the backend that answered an LLM invocation to the span.
+func (s *Span) recordBackend(backend string) {
+	if s == nil || backend == "" {
+		return
+	}
+	s.Backends = append(s.Backends, backend)
+}
+
+// recordBuild adds a build of the working package to the span.
+func (s *Span) recordBuild(duration time.Duration, failed bool) {
+	if s == nil {
+		return
+	}
+	s.BuildTime += duration
+	s.BuildError = s.BuildError || failed
+}
+
+// recordTests sets the result of a test run of the working package.
+func (s *Span) recordTests(duration time.Duration, failed int, cases map[string]bool) {
+	if s == nil {
+		return
+	}
+	s.TestTime = duration
+	s.TestError = failed
+	s.TestCases = maps.Clone(cases)
+}
+
+// openSpan starts the span of a task attempt below the current span and makes it the current span.
+func (req *ConversionRequest) openSpan(task *ConversionTask) *Span {
+	if req.span == nil {
+		if req.Trace == nil {
+			req.Trace = newSpan(SpanJob, "")
+		}
+		req.span = req.Trace
+	}
+	span := newSpan(SpanAttempt, task.ID)
+	span.Converter = task.Converter
+	span.Attempt = req.attempt(task)
+	req.span.add(span)
+	req.span = span
+	return span
+}
+
+// closeSpan ends the span and makes its parent the current span again. The working package the attempt left behind
+// is recorded as a revision. Closing a span twice has no effect.
+func (req *ConversionRequest) closeSpan(span *Span) {
+	if span.closed {
+		return
+	}
+	span.end()
+	req.recordRevision(span.TaskID, span.Attempt)
+	req.span = span.parent
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/google/uuid"
 	"iter"
 	"maps"
+	"slices"
 	"time"
 )
 
@@ -21,12 +22,19 @@ type ConversionTask struct {
 	ID            string
 	Execute       Converter         // Task execution function
 	CanApply      Converter         // Checks if the preconditions are met to run this task, otherwise the pipeline will fail
-	RetryCount    int               // RetryAttempts
 	MaxRetryCount int               // Max retries
 	RetryDelay    time.Duration     // Delay between retries
 	Next          []*ConversionTask // Next tasks (normal execution flow)
 	OnFailure     *ConversionTask   // Recovery task if this task fails
 	Validation    Converter
+	Timeout       time.Duration                  // Limit for each attempt of the task, zero means no limit
+	Join          JoinPolicy                     // How the outcomes of the next tasks are joined, empty runs them sequentially
+	OnError       map[ErrorClass]*ConversionTask // Recovery tasks for specific failure classes, preferred over OnFailure
+	Loop          *TaskLoop                      // Jumps back to an earlier task after this task succeeded
+	Retry         *RetryPolicy                   // Backoff and per error class budgets of the retries, nil retries every failure alike
+	Converter     string                         // Name of the execute converter, used in traces
+	Cascade       ModelCascade                   // Models the task escalates through, MaxRetryCount is the sum of their retries
+	Budget        *Budget                        // Limits the LLM usage of the task and its recovery tasks, nil means no limit
 }
 
 type ConverterFactory func(map[string]interface{}) Converter
@@ -41,22 +49,44 @@ var ConverterFactories map[string]ConverterFactory = map[string]ConverterFactory
 	"realign":    makeAlignmentConverter,
 	"noop":       makeNoopConverter,
 	"canCompile": makeCompilePrecheckConverter,
+	ExecTask:     makeExecConverter,
+	ReviewTask:   makeReviewConverter,
+}
+
+// ConverterArgs lists the options and task_args each converter consumes
+var ConverterArgs = map[string][]string{
+	"goBuilder":     {"handler"},
+	"goTester":      {"strategy"},
+	"llmTask":       llmArgKeys(),
+	"cleaner":       llmArgKeys(),
+	"coder":         llmArgKeys(),
+	"fixer":         llmArgKeys(),
+	"realign":       llmArgKeys(),
+	"noop":          {},
+	"canCompile":    {},
+	SubpipelineTask: {"pipeline"},
+	ExecTask:        {"command", "args"},
+	ReviewTask:      {},
 }
 
 // Pipeline represents the workflow pipeline
 type Pipeline struct {
 	FirstTask *ConversionTask
+	Deadline  time.Duration // Limit for a whole job, zero means no limit
+	Budget    *Budget       // Limits the LLM usage of a whole job, nil means no limit
+	Prices    PriceTable    // Prices of the models, used to estimate the cost of the LLM invocations
+	source    *PipelineFile
 }
 
 type LLMInvocationClient interface {
 	//Configures the client to serve multiple invocations, e.g., setting up a conncetion pool
 	Configure(args map[string]interface{}) error
-	//Prepares a request to the client, e.g., changing invocation parameters. WARNNING, could create raise conditions.
-	Prepare(map[string]interface{}) error
-	//InvokeLLM takes the given prompt and invokes the llm
+	//InvokeLLM takes the given prompt and invokes the llm with the options of the invocation in the context (see
+	//llmInvocation.Args), clients that can stream pass the output to the observer of the
+	//invocation in the context as it is generated
 	InvokeLLM(ctx context.Context, buf bytes.Buffer) (string, Metrics, error)
-	//logs details about a llm invocation to a file and console
-	logLLMResponse(...string)
+	//logs details about a llm invocation to a file and console, the context is the one of the invocation
+	logLLMResponse(ctx context.Context, args ...string)
 }
 
 type LLMFactory func(map[string]interface{}) (LLMInvocationClient, error)
@@ -86,6 +116,14 @@ var LLMClientFactories map[string]LLMFactory = map[string]LLMFactory{
 		}
 		return gc, nil
 	},
+	"openai": func(args map[string]interface{}) (LLMInvocationClient, error) {
+		oc := &OpenAIInvocationClient{}
+		err := oc.Configure(args)
+		if err != nil {
+			return nil, err
+		}
+		return oc, nil
+	},
 }
 
 type ConversionRequest struct {
@@ -95,6 +133,123 @@ type ConversionRequest struct {
 	Metrics        *Metrics           `json:"metrics,omitempty"`
 	err            []error
 	Completed      bool `json:"completed,omitempty"`
+	//values of the pipeline file this request overrides, see PipelineFile.interpolate
+	Overrides map[string]any `json:"overrides,omitempty"`
+	//span tree of the task attempts of the job
+	Trace *Span `json:"trace,omitempty"`
+	//span of the running task attempt
+	span *Span
+	//versions of the working package, the first one is the source package
+	Revisions []*Revision `json:"revisions,omitempty"`
+	//test score of each loop when it last jumped back
+	loopScores map[string]int
+	//iterations of each loop since the task it jumps back to was last entered, the loops metric counts all of them
+	loopIterations map[string]int
+	//attempts of each task in this execution, the task graph is shared by all executions of a pipeline
+	attempts map[*ConversionTask]int
+	//failed attempts of each task that were charged to the budget of an error class instead of maxRetryCount
+	retries map[*ConversionTask]map[ErrorClass]int
+	//main flow tasks from root to the running task
+	path []string
+	//depth of recovery tasks and pipeline fragments the running task is part of, these are not checkpointed
+	nested int
+	//checkpoint the request resumes from
+	checkpoint *Checkpoint
+	//decision of the reviewer the paused request resumes with
+	review *ReviewDecision
+	//usage of the job against its budgets, shared with branches and candidates
+	budget *jobBudget
+	//progress of the job for the status endpoint, shared with branches and candidates
+	progress *JobProgress
+	//validation result of the candidate the last attempt kept, see CandidateSampler
+	sampled *sampledValidation
+}
+
+// fork creates a copy of the request for a concurrent branch, with its own working package and metrics.
+func (req *ConversionRequest) fork() *ConversionRequest {
+	branch := &ConversionRequest{
+		Id:            req.Id,
+		SourcePackage: req.SourcePackage,
+		Metrics: &Metrics{
+			TestCases: make(map[string]bool),
+			Loops:     make(map[string]int),
+		},
+		err:            slices.Clone(req.err),
+		Overrides:      maps.Clone(req.Overrides),
+		Revisions:      req.forkRevisions(),
+		loopScores:     maps.Clone(req.loopScores),
+		loopIterations: maps.Clone(req.loopIterations),
+		attempts:       maps.Clone(req.attempts),
+		retries:        make(map[*ConversionTask]map[ErrorClass]int, len(req.retries)),
+		//branches are not checkpointed
+		nested:   req.nested + 1,
+		budget:   req.budget,
+		progress: req.progress,
+	}
+	for task, retries := range req.retries {
+		branch.retries[task] = maps.Clone(retries)
+	}
+	if req.WorkingPackage != nil {
+		branch.WorkingPackage = req.WorkingPackage.copy()
+	}
+	return branch
+}
+
+// join takes over the working package, errors and test results of a finished branch.
+func (req *ConversionRequest) join(branch *ConversionRequest) {
+	req.WorkingPackage = branch.WorkingPackage
+	req.err = branch.err
+	req.joinRevisions(branch)
+	if len(branch.Metrics.TestCases) > 0 {
+		req.Metrics.TestCases = branch.Metrics.TestCases
+		req.Metrics.TestTime = branch.Metrics.TestTime
+		req.Metrics.TestError = branch.Metrics.TestError
+		req.Metrics.TestSimilarity = branch.Metrics.TestSimilarity
+	}
+}
+
+// attempt returns the number of failed attempts of the task in this execution.
+func (req *ConversionRequest) attempt(task *ConversionTask) int {
+	return req.attempts[task]
+}
+
+func (req *ConversionRequest) nextAttempt(task *ConversionTask) {
+	if req.attempts == nil {
+		req.attempts = make(map[*ConversionTask]int)
+	}
+	req.attempts[task]++
+}
+
+// resetAttempts clears the attempts of the task and all tasks that can follow it, e.g., when a loop restarts the task.
+func (req *ConversionRequest) resetAttempts(task *ConversionTask) {
+	if task == nil {
+		return
+	}
+	delete(req.attempts, task)
+	delete(req.retries, task)
+	req.resetAttempts(task.OnFailure)
+	for _, recovery := range task.OnError {
+		req.resetAttempts(recovery)
+	}
+	for _, next := range task.Next {
+		req.resetAttempts(next)
+	}
+}
+
+// testScore counts the test cases that passed in the last test run.
+func (req *ConversionRequest) testScore() int {
+	score := 0
+	for _, passed := range req.Metrics.TestCases {
+		if passed {
+			score++
+		}
+	}
+	return score
+}
+
+// testsPass reports whether tests ran and all of them passed.
+func (req *ConversionRequest) testsPass() bool {
+	return len(req.Metrics.TestCases) > 0 && req.testScore() == len(req.Metrics.TestCases)
 }
 
 type DeploymentPackage struct {
@@ -143,6 +298,8 @@ type Metrics struct {
 	EndTime   time.Time
 
 	TotalTime time.Duration
+	//time the job ran over all its runs, without the time it was paused for a review or waited for a restart
+	ActiveTime time.Duration `json:"active_time,omitempty"`
 
 	ConversionTime       time.Duration `json:"conversion_time"`
 	ConversionPromptTime time.Duration `json:"conversion_prompt_time"`
@@ -151,6 +308,16 @@ type Metrics struct {
 	ConversionPromptTokenCount int `json:"conversion_prompt_token_count"`
 	ConversionEvalTokenCount   int `json:"conversion_eval_token_count"`
 
+	//invocations answered from and missed by the LLM response cache, and the tokens of the cached responses
+	CacheHits        int `json:"cache_hits,omitempty"`
+	CacheMisses      int `json:"cache_misses,omitempty"`
+	CacheTokensSaved int `json:"cache_tokens_saved,omitempty"`
+
+	//estimated cost of the LLM invocations, see PriceTable
+	Cost float64 `json:"cost,omitempty"`
+	//the budget the job was stopped by
+	BudgetExceeded string `json:"budget_exceeded,omitempty"`
+
 	BuildTime time.Duration `json:"build_time"`
 	TestTime  time.Duration `json:"test_time"`
 
@@ -160,6 +327,27 @@ type Metrics struct {
 
 	TestCases map[string]bool `json:"test_cases"`
 	Issues    []string        `json:"issues"`
+
+	Loops map[string]int `json:"loops,omitempty"`
+
+	Timeouts         int  `json:"timeouts"`
+	DeadlineExceeded bool `json:"deadline_exceeded"`
+
+	//similarity of the test outputs to the expected outputs in the last test run
+	TestSimilarity map[string]float64 `json:"test_similarity,omitempty"`
+	Candidates     []CandidateOutcome `json:"candidates,omitempty"`
+
+	//revision of the working package returned for the job
+	Revision int `json:"revision"`
+
+	//metrics of each subpipeline task, also included in the totals
+	Scopes map[string]*Metrics `json:"scopes,omitempty"`
+
+	//times the finished job was run again from one of its tasks
+	Resumes []ResumeRecord `json:"resumes,omitempty"`
+
+	//usage of each tier of the model cascades, keyed by <task>/<tier>
+	Tiers map[string]*TierUsage `json:"tiers,omitempty"`
 }
 
 func (m *Metrics) AddMetric(mm Metrics) {
@@ -169,11 +357,30 @@ func (m *Metrics) AddMetric(mm Metrics) {
 	m.ConversionEvalTime += mm.ConversionEvalTime
 	m.ConversionPromptTokenCount += mm.ConversionPromptTokenCount
 	m.ConversionEvalTokenCount += mm.ConversionEvalTokenCount
+	m.CacheHits += mm.CacheHits
+	m.CacheMisses += mm.CacheMisses
+	m.CacheTokensSaved += mm.CacheTokensSaved
+	m.Cost += mm.Cost
+	if mm.BudgetExceeded != "" {
+		m.BudgetExceeded = mm.BudgetExceeded
+	}
 	m.BuildTime += mm.BuildTime
 	m.BuildError += mm.BuildError
 	m.Tasks += mm.Tasks
+	m.Timeouts += mm.Timeouts
+	m.DeadlineExceeded = m.DeadlineExceeded || mm.DeadlineExceeded
+	m.Candidates = append(m.Candidates, mm.Candidates...)
+	for key, usage := range mm.Tiers {
+		m.tierUsage(key).add(usage)
+	}
+	for id, iterations := range mm.Loops {
+		if m.Loops == nil {
+			m.Loops = make(map[string]int)
+		}
+		m.Loops[id] += iterations
+	}
 
-	if m.StartTime.After(mm.StartTime) {
+	if !mm.StartTime.IsZero() && m.StartTime.After(mm.StartTime) {
 		m.StartTime = mm.StartTime
 	}
 
@@ -191,8 +398,7 @@ type TestFile struct {
 	//Services to mock/deploy for the test
 	Services map[string]string `json:"services"`
 	//If this test will produce deterministicResults
-	UndeterministicResults bool `json:"deterministic"
-`
+	UndeterministicResults bool `json:"deterministic"`
 }
 
 //go:embed prompts/stage-zero.md
@@ -267,3 +473,14 @@ func (CanCompileConverter) Apply(run *PipelineRunner, req *ConversionRequest) er
 func makeCompilePrecheckConverter(args map[string]interface{}) Converter {
 	return &CanCompileConverter{}
 }
+
+// edit returns a copy of the package with the main file of the edited package, e.g., uploaded by a reviewer. Tests and
+// build files are kept.
+func (dp *DeploymentPackage) edit(edited *DeploymentPackage) *DeploymentPackage {
+	if dp == nil || edited == nil {
+		return edited
+	}
+	result := dp.copy()
+	result.RootFile = edited.RootFile
+	return result
+}
@@ -41,6 +41,9 @@ func (cc *GoPackageTester) Apply(runner *PipelineRunner, request *ConversionRequ
 		log.Errorf("missing working package for %s", request.Id)
 		return fmt.Errorf("the working package is required")
 	}
+	if runner.WorkingDir == "" {
+		return TestingError{fmt.Errorf("the working package of %s was not built, run goBuilder first", request.Id), len(request.WorkingPackage.TestFiles)}
+	}
 
 	if request.SourcePackage != nil && (len(request.SourcePackage.TestFiles)) > len(request.WorkingPackage.TestFiles) {
 		request.WorkingPackage.TestFiles = make(map[string]string)
@@ -61,7 +64,7 @@ func (cc *GoPackageTester) Apply(runner *PipelineRunner, request *ConversionRequ
 			continue
 		}
 
-		success, err := cc.doTest(ctx, runner.WorkingDir, testfile)
+		success, err := cc.doTest(ctx, runner.WorkingDir, testfile, request.Metrics)
 		if err != nil {
 			err_cnt++
 			log.Debugf("test %s failed: %v", testfile.Name, err)
@@ -77,6 +80,8 @@ func (cc *GoPackageTester) Apply(runner *PipelineRunner, request *ConversionRequ
 	}
 	request.Metrics.TestTime = time.Since(start_time)
 	request.Metrics.TestError = err_cnt
+	request.span.recordTests(request.Metrics.TestTime, err_cnt, request.Metrics.TestCases)
+	request.scoreRevision()
 	if err_cnt != 0 {
 		log.Debugf("tests failed: %d/%d", err_cnt, len(request.WorkingPackage.TestFiles))
 		return TestingError{fmt.Errorf("%d tests failed", err_cnt), err_cnt}
@@ -85,9 +90,14 @@ func (cc *GoPackageTester) Apply(runner *PipelineRunner, request *ConversionRequ
 	return nil
 }
 
-func (cc *GoPackageTester) doTest(ctx context.Context, dir string, t *TestFile) (bool, error) {
+func (cc *GoPackageTester) doTest(ctx context.Context, dir string, t *TestFile, m *Metrics) (bool, error) {
+	if m.TestSimilarity == nil {
+		m.TestSimilarity = make(map[string]float64)
+	}
+	m.TestSimilarity[t.Name] = 0
 	cmd := exec.CommandContext(ctx, "go", "run", ".")
 	cmd.Dir = dir
+	killOnCancel(cmd)
 	cmd.Env = append(os.Environ(), t.Env...)
 	_in := strings.NewReader(t.Input)
 	_out := &bytes.Buffer{}
@@ -101,6 +111,7 @@ func (cc *GoPackageTester) doTest(ctx context.Context, dir string, t *TestFile)
 		return false, fmt.Errorf("test failed. %s - %s - %s", _out.String(), _err.String(), err)
 	}
 	cleanOut := MinimizeString(_out.String())
+	m.TestSimilarity[t.Name] = strutil.Similarity(cleanOut, MinimizeString(t.Output), metrics.NewOverlapCoefficient())
 
 	assertEquals := cc.validateTestOutput(ctx, cleanOut, t)
 	if !assertEquals {